@@ -34,9 +34,12 @@ var (
 )
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getPayloadFormat := mqtt_action_router.AddPayloadFormatFlags(flag.CommandLine)
 	flag.Var(&hosts, "airconHost", "a host for an aircon")
 	flag.Var(&names, "airconName", "a name for an aircon")
 	flag.Var(&codesNames, "airconCodesName", "a codes name for an aircon")
@@ -45,6 +48,16 @@ func main() {
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	payloadFormat, err := getPayloadFormat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
@@ -84,6 +97,18 @@ func main() {
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("inside/aircons/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
@@ -94,6 +119,7 @@ func main() {
 		time.Millisecond*10,
 		true,
 	)
+	actionRouter.SetPayloadFormat(payloadFormat)
 
 	aircons, err := airconsClient.GetAircons()
 	if err != nil {
@@ -102,12 +128,12 @@ func main() {
 
 	for _, a := range aircons {
 		err = actionRouter.AddAction(
-			fmt.Sprintf("home/inside/aircons/%v/state/set", a.Name),
+			namespace.Topicf("inside/aircons/%v/state/set", a.Name),
 			aircons_client.Arguments{Name: a.Name},
 			actionable.On,
 			actionable.Off,
 			mqtt_action_router.Unknown,
-			fmt.Sprintf("home/inside/aircons/%v/state/get", a.Name),
+			namespace.Topicf("inside/aircons/%v/state/get", a.Name),
 		)
 		if err != nil {
 			log.Fatal(err)
@@ -131,7 +157,10 @@ func main() {
 		os.Exit(0)
 	}()
 
-	lastStateByName := make(map[string]aircons_client.State, 0)
+	statePublisher := mqtt.NewStatePublisher(mqttClient, mqtt.StatePublisherOptions{
+		QoS:      mqtt.ExactlyOnce,
+		Retained: true,
+	})
 
 	ticker := time.NewTicker(time.Millisecond * 1000)
 	for {
@@ -143,25 +172,19 @@ func main() {
 			}
 
 			for _, a := range aircons {
-				_, ok := lastStateByName[a.Name]
-				if !ok {
-					lastStateByName[a.Name] = a.State
-				} else if a.State == lastStateByName[a.Name] {
-					continue
+				payload, err := payloadFormat.Format(mqtt_action_router.State(a.State))
+				if err != nil {
+					// i.e. unknown, which there's no dialect for
+					payload = fmt.Sprintf("%v", a.State)
 				}
 
-				err := mqttClient.Publish(
-					fmt.Sprintf("home/inside/aircons/%v/state/get", a.Name),
-					mqtt.ExactlyOnce,
-					true,
-					fmt.Sprintf("%v", a.State),
-					true,
+				err = statePublisher.Set(
+					namespace.Topicf("inside/aircons/%v/state/get", a.Name),
+					payload,
 				)
 				if err != nil {
 					log.Fatal(err)
 				}
-
-				lastStateByName[a.Name] = a.State
 			}
 		}
 	}
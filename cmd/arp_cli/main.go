@@ -50,16 +50,17 @@ func (f *flagArrayString) Set(value string) error {
 }
 
 const (
-	topicPrefix     = "home/arp"
 	timeoutDuration = time.Second * 10
 )
 
 var (
-	arpIPs        flagArrayString
-	mqttClient    mqtt.Client
-	mu            sync.Mutex
-	lastSeenByIP  = make(map[string]time.Time, 0)
-	lastStateByIP = make(map[string]string, 0)
+	topicPrefix    string
+	arpIPs         flagArrayString
+	mqttClient     *mqtt.PersistentClient
+	statePublisher *mqtt.StatePublisher
+	mu             sync.Mutex
+	lastSeenByIP   = make(map[string]time.Time, 0)
+	lastStateByIP  = make(map[string]string, 0)
 )
 
 func readARP(handle *pcap.Handle, iface *net.Interface, stop chan struct{}) {
@@ -231,14 +232,7 @@ func publish() {
 		case <-ticker.C:
 			mu.Lock()
 			for ip, state := range lastStateByIP {
-				log.Printf("publishing %v state for %v", state, ip)
-				err := mqttClient.Publish(
-					fmt.Sprintf("%v/%v/get", topicPrefix, ip),
-					mqtt.ExactlyOnce,
-					false,
-					state,
-					true,
-				)
+				err := statePublisher.Set(fmt.Sprintf("%v/%v/get", topicPrefix, ip), state)
 				if err != nil {
 					log.Fatal(err)
 				}
@@ -249,16 +243,31 @@ func publish() {
 }
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
 	interfaceName := flag.String("interfaceName", "", "interface to capture on")
 	flag.Var(&arpIPs, "arpIP", "a host to ARP")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getRateLimitOptions := mqtt.AddRateLimitFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rateLimitOptions, err := getRateLimitOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	topicPrefix = namespace.Topic("arp")
+
 	if *hostPtr == "" {
 		log.Fatal("no -host flag specified")
 	}
@@ -295,11 +304,36 @@ func main() {
 
 	mqttClient = mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
 
+	err = mqttClient.SetAvailabilityTopic(fmt.Sprintf("%v/availability", topicPrefix))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if rateLimitOptions.IsEnabled() {
+		err = mqttClient.EnableRateLimit(rateLimitOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// these aren't retained, so there's a periodic refresh for anything that's only just started listening
+	statePublisher = mqtt.NewStatePublisher(mqttClient, mqtt.StatePublisherOptions{
+		QoS:             mqtt.ExactlyOnce,
+		RefreshInterval: time.Second * 30,
+	})
+
 	mu.Lock()
 	for _, ip := range arpIPs {
 		lastSeenByIP[ip] = time.Now().Add(-timeoutDuration)
@@ -320,7 +354,7 @@ func main() {
 				"0",
 			)
 			if err != nil {
-				log.Fatal(err)
+				log.Printf("warning: %v", err)
 			}
 		}
 
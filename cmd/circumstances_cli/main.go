@@ -17,14 +17,13 @@ import (
 )
 
 const (
-	cyclePeriod      = time.Second * 1
-	temperatureTopic = "home/outside/weather/temperature/get"
-	sunriseTopic     = "home/outside/weather/sunrise/get"
-	sunsetTopic      = "home/outside/weather/sunset/get"
-	prefix           = "home/circumstances"
+	cyclePeriod = time.Second * 1
 )
 
 var (
+	// set from the namespace in main
+	temperatureTopic, sunriseTopic, sunsetTopic, prefix string
+
 	mu                                    sync.Mutex
 	temperature                           float64
 	gotSunrise, gotSunset, gotTemperature bool
@@ -95,15 +94,17 @@ func handleMessage(message mqtt.Message) {
 }
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username (optional)")
 	passwordPtr := flag.String("password", "", "mqtt password (optional)")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
 	bedtimePtr := flag.String("bedtime", "22:00:00", "bedtime HH:MM:SS (optional, default 22:00:00)")
 	waketimePtr := flag.String("waketime", "06:00:00", "bedtime HH:MM:SS (optional, default 06:00:00)")
 	hotEntryPtr := flag.Float64("hotEntry", 29, "hot entry deg C (optional, default 29)")
 	hotExitPtr := flag.Float64("hotExit", 27, "hot exit deg C (optional, default 27)")
 	coldEntryPtr := flag.Float64("coldEntry", 12, "cold entry deg C (optional, default 12)")
 	coldExitPtr := flag.Float64("coldExit", 14, "cold exit deg C (optional, default 14)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -113,7 +114,17 @@ func main() {
 		log.Fatal("host flag empty")
 	}
 
-	_, err := parseNowForHoursMinutesSeconds(*bedtimePtr)
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	temperatureTopic = namespace.Topic("outside/weather/temperature/get")
+	sunriseTopic = namespace.Topic("outside/weather/sunrise/get")
+	sunsetTopic = namespace.Topic("outside/weather/sunset/get")
+	prefix = namespace.Topic("circumstances")
+
+	_, err = parseNowForHoursMinutesSeconds(*bedtimePtr)
 	if err != nil {
 		log.Fatalf("failed to parse HH:MM:SS fom '%v'", *bedtimePtr)
 	}
@@ -124,6 +135,18 @@ func main() {
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
+	err = mqttClient.SetAvailabilityTopic(fmt.Sprintf("%v/availability", prefix))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
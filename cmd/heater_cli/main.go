@@ -5,25 +5,59 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/initialed85/mqtt_things/pkg/leader_election"
 	"github.com/initialed85/mqtt_things/pkg/mqtt_action_router"
 	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
 	"github.com/initialed85/mqtt_things/pkg/relays_client"
 )
 
+type flagArrayString []string
+
+func (f *flagArrayString) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *flagArrayString) Set(value string) error {
+	*f = append(*f, value)
+
+	return nil
+}
+
+var interlockWatches flagArrayString
+
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getPayloadFormat := mqtt_action_router.AddPayloadFormatFlags(flag.CommandLine)
+	getTimedActionOptions := mqtt_action_router.AddTimedActionFlags(flag.CommandLine)
 	portPtr := flag.String("port", "", "serial port")
 	relayPtr := flag.Int64("relay", -1, "relay number")
+	leaseTopicPtr := flag.String("leaseTopic", "", "topic to hold a leader election on, for running more than one instance (optional)")
+	instanceIDPtr := flag.String("instanceID", "", "unique ID for this instance in the leader election (optional; defaults to hostname and PID)")
+	flag.Var(&interlockWatches, "interlockWatch", "an aircon's mode get topic (e.g. home/inside/smart-aircons/+/mode/get; wildcards are fine); the heater mustn't run while it says heat (optional)")
+	interlockPolicyPtr := flag.String("interlockPolicy", "reject", "what to do with a request to run the heater while something being watched is on; reject or queue")
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	payloadFormat, err := getPayloadFormat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
@@ -36,6 +70,11 @@ func main() {
 		log.Fatal("relay flag empty")
 	}
 
+	interlockPolicy, err := mqtt_action_router.ParseInterlockPolicy(*interlockPolicyPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	relaysClient, err := relays_client.New(*portPtr, 9600)
 	if err != nil {
 		log.Fatal(err)
@@ -46,6 +85,18 @@ func main() {
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("inside/heater/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
@@ -56,17 +107,62 @@ func main() {
 		time.Millisecond*10,
 		false,
 	)
+	actionRouter.SetPayloadFormat(payloadFormat)
+
+	err = actionRouter.EnableTimedActions(getTimedActionOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(interlockWatches) > 0 {
+		err = actionRouter.SetStatusTopic(namespace.Topic("inside/heater/status"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = actionRouter.AddInterlockGroup("heating", interlockPolicy, namespace.Topic("inside/heater/state/set"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// an aircon that's cooling (or just running its fan) isn't fighting the heater
+		isHeating := func(payload string) (bool, error) {
+			return strings.EqualFold(strings.TrimSpace(payload), "heat"), nil
+		}
+
+		for _, interlockWatch := range interlockWatches {
+			err = actionRouter.AddInterlockWatchFunc("heating", interlockWatch, isHeating)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	var elector *leader_election.Elector
+	if *leaseTopicPtr != "" {
+		elector = leader_election.New(mqttClient, *leaseTopicPtr, *instanceIDPtr, leader_election.DefaultOptions)
+
+		err = actionRouter.SetLeadership(elector)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = elector.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	relayNumbers := []int64{*relayPtr}
 
 	for _, relayNumber := range relayNumbers {
 		err = actionRouter.AddAction(
-			"home/inside/heater/state/set",
+			namespace.Topic("inside/heater/state/set"),
 			relays_client.Arguments{Relay: relayNumber},
 			actionable.On,
 			actionable.Off,
 			mqtt_action_router.Off,
-			"home/inside/heater/state/get",
+			namespace.Topic("inside/heater/state/get"),
 		)
 		if err != nil {
 			log.Fatal(err)
@@ -77,11 +173,20 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		// turn the heater off while we're still the leader (after resigning it'd only be noted, leaving it on with
+		// nothing looking after it if there's no standby); a standby takes over from the state we leave behind
 		err = actionRouter.RemoveAllActions()
 		if err != nil {
 			log.Print(err)
 		}
 
+		if elector != nil {
+			err = elector.Stop()
+			if err != nil {
+				log.Print(err)
+			}
+		}
+
 		err = mqttClient.Disconnect()
 		if err != nil {
 			log.Print(err)
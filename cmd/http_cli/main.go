@@ -26,12 +26,9 @@ type ErrorResponse struct {
 	Reason     string `json:"reason"`
 }
 
-const (
-	topic = "+/+/#"
-)
-
 var (
-	substitutes       = []string{"home/", "outside/", "inside/", "globe/", "bank/", "state/", "/get"}
+	namespace         mqtt.Namespace
+	substitutes       = []string{"outside/", "inside/", "globe/", "bank/", "state/", "/get"}
 	lock              sync.RWMutex
 	topicPayloadByUrl = map[string]TopicPayload{}
 )
@@ -41,7 +38,12 @@ func callback(message mqtt.Message) {
 		return
 	}
 
-	url := message.Topic
+	// e.g. home/inside/heater/state/get is served as /heater, as it always has been
+	url, ok := namespace.Relative(message.Topic)
+	if !ok {
+		return
+	}
+
 	for _, substitute := range substitutes {
 		url = strings.ReplaceAll(url, substitute, "")
 	}
@@ -123,15 +125,25 @@ func handler(w http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
 	portPtr := flag.Int("port", -1, "http port")
+	shareGroupPtr := flag.String("shareGroup", "", "shared subscription group, so that replicas split the messages between them (optional; needs a broker that supports $share)")
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	var err error
+
+	namespace, err = getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
@@ -141,7 +153,19 @@ func main() {
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
-	err := mqttClient.Connect()
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("http/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -158,7 +182,12 @@ func main() {
 		os.Exit(0)
 	}()
 
-	err = mqttClient.Subscribe(topic, mqtt.ExactlyOnce, callback)
+	subscribeTopic := namespace.Topic("#")
+	if *shareGroupPtr != "" {
+		subscribeTopic = mqtt.SharedSubscription(*shareGroupPtr, subscribeTopic)
+	}
+
+	err = mqttClient.Subscribe(subscribeTopic, mqtt.ExactlyOnce, callback)
 	if err != nil {
 		log.Fatal(err)
 	}
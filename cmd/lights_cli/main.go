@@ -2,11 +2,9 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"reflect"
 	"syscall"
 	"time"
 
@@ -16,9 +14,13 @@ import (
 )
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getPayloadFormat := mqtt_action_router.AddPayloadFormatFlags(flag.CommandLine)
+	getReconcileOptions := mqtt_action_router.AddReconcileFlags(flag.CommandLine)
 	bridgeHost := flag.String("bridgeHost", "", "hue bridge host")
 	apiKeyPtr := flag.String("apiKey", "", "hue api key")
 
@@ -26,6 +28,21 @@ func main() {
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	payloadFormat, err := getPayloadFormat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reconcileOptions, err := getReconcileOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
@@ -41,11 +58,24 @@ func main() {
 	lightsClient := lights_client.New(*bridgeHost, "smart_home", *apiKeyPtr)
 
 	actionable := lights_client.Actionable{
-		Client: lightsClient,
+		Client:     lightsClient,
+		ReadMaxAge: reconcileOptions.Interval / 2,
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
-	err := mqttClient.Connect()
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("inside/lights/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -55,6 +85,7 @@ func main() {
 		time.Millisecond*10,
 		true,
 	)
+	actionRouter.SetPayloadFormat(payloadFormat)
 
 	lights, err := lightsClient.GetLights()
 	if err != nil {
@@ -63,12 +94,21 @@ func main() {
 
 	for _, light := range lights {
 		err = actionRouter.AddAction(
-			fmt.Sprintf("home/inside/lights/globe/%v/state/set", light.Name),
+			namespace.Topicf("inside/lights/globe/%v/state/set", light.Name),
 			lights_client.Arguments{Name: light.Name},
 			actionable.On,
 			actionable.Off,
 			mqtt_action_router.Off,
-			fmt.Sprintf("home/inside/lights/globe/%v/state/get", light.Name),
+			namespace.Topicf("inside/lights/globe/%v/state/get", light.Name),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = actionRouter.Reconcile(
+			namespace.Topicf("inside/lights/globe/%v/state/set", light.Name),
+			actionable.Read,
+			reconcileOptions,
 		)
 		if err != nil {
 			log.Fatal(err)
@@ -92,39 +132,11 @@ func main() {
 		os.Exit(0)
 	}()
 
-	lastStateByName := make(map[string]lights_client.State, 0)
+	ticker := time.NewTicker(time.Second * 1)
 
-	ticker := time.NewTicker(time.Millisecond * 1000)
 	for {
 		select {
 		case <-ticker.C:
-			lights, err := lightsClient.GetLights()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			for _, l := range lights {
-				_, ok := lastStateByName[l.Name]
-				if !ok {
-					lastStateByName[l.Name] = l.State
-				} else if reflect.DeepEqual(l.State, lastStateByName[l.Name]) {
-					log.Printf("no change for %v; deferring", l.Name)
-					continue
-				}
-
-				err := mqttClient.Publish(
-					fmt.Sprintf("home/inside/lights/globe/%v/state/get", l.Name),
-					mqtt.ExactlyOnce,
-					true,
-					fmt.Sprintf("%v", l.State),
-					true,
-				)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				lastStateByName[l.Name] = l.State
-			}
 		}
 	}
 }
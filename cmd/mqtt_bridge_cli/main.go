@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/topic_bridge"
+)
+
+const (
+	local         = "local"
+	remote        = "remote"
+	localToRemote = "local_to_remote"
+	remoteToLocal = "remote_to_local"
+)
+
+type sideFlags struct {
+	host     *string
+	username *string
+	password *string
+	provider *string
+}
+
+func addSideFlags(name string) sideFlags {
+	return sideFlags{
+		host:     flag.String(name+"Host", "", fmt.Sprintf("%v mqtt broker host or URL", name)),
+		username: flag.String(name+"Username", "", fmt.Sprintf("%v mqtt username", name)),
+		password: flag.String(name+"Password", "", fmt.Sprintf("%v mqtt password", name)),
+		provider: flag.String(name+"Provider", "paho", fmt.Sprintf("%v mqtt client provider (libmqtt5 lets loops be suppressed by origin rather than by recent payloads; not gmq, as it can't report retained messages)", name)),
+	}
+}
+
+func getFilters(rawFilters string) []string {
+	filters := make([]string, 0)
+	for _, filter := range strings.Split(rawFilters, ",") {
+		filter = strings.TrimSpace(filter)
+		if filter == "" {
+			continue
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return filters
+}
+
+func getRule(rawFilters string, from string, to string) *topic_bridge.Rule {
+	filters := getFilters(rawFilters)
+	if len(filters) == 0 {
+		return nil
+	}
+
+	rule := &topic_bridge.Rule{Include: filters}
+
+	if strings.Trim(from, "/") != strings.Trim(to, "/") {
+		rule.Rewrite = []topic_bridge.Rewrite{{From: from, To: to}}
+	}
+
+	return rule
+}
+
+func getRoute(ruleByDirection map[string]topic_bridge.Rule, direction string) (*topic_bridge.Route, error) {
+	rule, ok := ruleByDirection[direction]
+	if !ok {
+		return nil, nil
+	}
+
+	route, err := topic_bridge.NewRoute(rule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule for %v because: %v", direction, err)
+	}
+
+	return route, nil
+}
+
+func getClient(name string, flags sideFlags, publishQueueOptions mqtt.PublishQueueOptions) (*mqtt.PersistentClient, error) {
+	if *flags.host == "" {
+		return nil, fmt.Errorf("%vHost flag empty", name)
+	}
+
+	// deliberately no env overrides, as they'd apply to both sides
+	client, err := mqtt.NewMQTTClient(mqtt.Config{
+		Provider:       *flags.provider,
+		URL:            *flags.host,
+		Username:       *flags.username,
+		Password:       *flags.password,
+		ClientIDPrefix: fmt.Sprintf("mqtt_bridge_cli_%v", name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// retained state would otherwise arrive on the other side as live messages (whatever the rule says)
+	if !mqtt.ReportsRetained(client) {
+		return nil, fmt.Errorf("%vProvider %v can't tell retained messages from live ones; use paho, libmqtt or libmqtt5", name, *flags.provider)
+	}
+
+	if publishQueueOptions.MaxSize > 0 {
+		if publishQueueOptions.SpoolPath != "" {
+			publishQueueOptions.SpoolPath = fmt.Sprintf("%v.%v", publishQueueOptions.SpoolPath, name)
+		}
+
+		err = client.EnablePublishQueue(publishQueueOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func main() {
+	localFlags := addSideFlags(local)
+	remoteFlags := addSideFlags(remote)
+	bridgeIDPtr := flag.String("bridgeID", "", "ID to mark forwarded messages with (default mqtt_bridge_cli_ and the hostname)")
+	rulesPtr := flag.String("rules", "", fmt.Sprintf("path to a JSON rule file keyed by %v and/or %v (overrides the filter and prefix flags)", localToRemote, remoteToLocal))
+	localToRemotePtr := flag.String("localToRemote", "", "comma-separated topic filters to mirror from local to remote")
+	remoteToLocalPtr := flag.String("remoteToLocal", "", "comma-separated topic filters to mirror from remote to local")
+	localPrefixPtr := flag.String("localPrefix", "", "topic prefix on the local side, rewritten to remotePrefix (and back)")
+	remotePrefixPtr := flag.String("remotePrefix", "", "topic prefix on the remote side, rewritten to localPrefix (and back)")
+	publishQueueSizePtr := flag.Int("publishQueueSize", 10000, "how many publishes to buffer per side while that side is disconnected (0 to disable)")
+	publishQueueOverflowPtr := flag.String("publishQueueOverflow", "drop-oldest", "what to do when a publish queue is full (drop-oldest, drop-newest or block)")
+	publishQueueSpoolPtr := flag.String("publishQueueSpool", "", "file to persist the publish queues to (suffixed with .local / .remote; optional)")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve local mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bridgeID := *bridgeIDPtr
+	if bridgeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bridgeID = fmt.Sprintf("mqtt_bridge_cli_%v", hostname)
+	}
+
+	ruleByDirection := make(map[string]topic_bridge.Rule)
+
+	if *rulesPtr != "" {
+		ruleByDirection, err = topic_bridge.LoadRules(*rulesPtr, localToRemote, remoteToLocal)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		for direction, rule := range map[string]*topic_bridge.Rule{
+			localToRemote: getRule(*localToRemotePtr, *localPrefixPtr, *remotePrefixPtr),
+			remoteToLocal: getRule(*remoteToLocalPtr, *remotePrefixPtr, *localPrefixPtr),
+		} {
+			if rule != nil {
+				ruleByDirection[direction] = *rule
+			}
+		}
+	}
+
+	if len(ruleByDirection) == 0 {
+		log.Fatal("nothing to mirror; set rules, localToRemote and/or remoteToLocal")
+	}
+
+	localToRemoteRoute, err := getRoute(ruleByDirection, localToRemote)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	remoteToLocalRoute, err := getRoute(ruleByDirection, remoteToLocal)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	publishQueueOverflow, err := mqtt.ParseOverflowPolicy(*publishQueueOverflowPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	publishQueueOptions := mqtt.PublishQueueOptions{
+		MaxSize:        *publishQueueSizePtr,
+		OverflowPolicy: publishQueueOverflow,
+		SpoolPath:      *publishQueueSpoolPtr,
+	}
+
+	localClient, err := getClient(local, localFlags, publishQueueOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	remoteClient, err := getClient(remote, remoteFlags, publishQueueOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = localClient.SetAvailabilityTopic(namespace.Topic("mqtt-bridge/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(localClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = localClient.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = remoteClient.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bridge, err := topic_bridge.New(
+		bridgeID,
+		topic_bridge.Side{Name: local, Client: localClient},
+		topic_bridge.Side{Name: remote, Client: remoteClient},
+		localToRemoteRoute,
+		remoteToLocalRoute,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the broker on a side that's been away may have lost (or never seen) the retained state from the other side
+	for name, client := range map[string]*mqtt.PersistentClient{local: localClient, remote: remoteClient} {
+		name := name
+
+		client.AddObserver(func(event mqtt.ConnectionEvent) {
+			if event.State != mqtt.Connected || event.Previous != mqtt.Reconnecting {
+				return
+			}
+
+			go bridge.Resync(name)
+		})
+	}
+
+	c := make(chan os.Signal, 16)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+
+		_ = bridge.Stop()
+
+		err = remoteClient.Disconnect()
+		if err != nil {
+			log.Printf("warning: %v", err)
+		}
+
+		err = localClient.Disconnect()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}()
+
+	err = bridge.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		time.Sleep(time.Second)
+	}
+}
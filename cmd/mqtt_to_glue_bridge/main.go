@@ -2,101 +2,173 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/initialed85/glue/pkg/endpoint"
-	"github.com/initialed85/glue/pkg/topics"
-
 	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/topic_bridge"
+)
+
+const (
+	mqttToGlue = "mqtt_to_glue"
+	glueToMQTT = "glue_to_mqtt"
 )
 
+// peerResyncDelay gives a new Glue peer a moment to subscribe before we send it our snapshot
+const peerResyncDelay = time.Second * 2
+
+func getRoutes(rulesPath string) (*topic_bridge.Route, *topic_bridge.Route, error) {
+	qos := mqtt.ExactlyOnce
+
+	// what this bridge has always done
+	ruleByDirection := map[string]topic_bridge.Rule{
+		mqttToGlue: {Include: []string{"+/+/#"}},
+		glueToMQTT: {Include: []string{"+/+/#"}, QoS: &qos},
+	}
+
+	if rulesPath != "" {
+		var err error
+
+		ruleByDirection, err = topic_bridge.LoadRules(rulesPath, mqttToGlue, glueToMQTT)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	routeByDirection := make(map[string]*topic_bridge.Route)
+
+	for direction, rule := range ruleByDirection {
+		route, err := topic_bridge.NewRoute(rule)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid rule for %v because: %v", direction, err)
+		}
+
+		routeByDirection[direction] = route
+	}
+
+	return routeByDirection[mqttToGlue], routeByDirection[glueToMQTT], nil
+}
+
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	glueURLPtr := flag.String("glueURL", "glue://", "glue URL to scope discovery (e.g. glue://239.192.137.1:27320?interface=eth0)")
+	glueSecretPtr := flag.String("glueSecret", "", fmt.Sprintf("shared secret to seal glue payloads with (optional; overrides %v and a secret in -glueURL)", mqtt.GlueSecretEnvVar))
+	rulesPtr := flag.String("rules", "", fmt.Sprintf("path to a JSON rule file keyed by %v and/or %v (optional; default is everything both ways)", mqttToGlue, glueToMQTT))
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
 
+	mqttToGlueRoute, glueToMQTTRoute, err := getRoutes(*rulesPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	mqttClient := mqtt.NewPersistentClient()
-	gmqClient := mqtt.GetGMQClient(*hostPtr, *usernamePtr, *passwordPtr, mqttClient.HandleError)
-	mqttClient.SetClient(gmqClient)
+	// not GMQ, because the bridge needs to know which messages are retained (see topic_bridge.New)
+	pahoClient := mqtt.GetPahoClient(*hostPtr, *usernamePtr, *passwordPtr, mqttClient.HandleError)
+	mqttClient.SetClient(pahoClient)
+
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("mqtt-to-glue-bridge/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	persistentGlueClient := mqtt.NewPersistentClient()
+	glueOptions, err := mqtt.ParseGlueOptions(*glueURLPtr, "", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *glueSecretPtr != "" {
+		glueOptions.SharedSecret = *glueSecretPtr
+	}
+
+	glueClient, err := mqtt.NewGlueClientWithOptions(glueOptions, persistentGlueClient.HandleError)
+	if err != nil {
+		log.Fatal(err)
+	}
+	persistentGlueClient.SetClient(glueClient)
+
+	err = mqttClient.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	err := mqttClient.Connect()
+	err = persistentGlueClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	glueClient, err := endpoint.NewManagerSimple()
+	bridge, err := topic_bridge.New(
+		fmt.Sprintf("mqtt_to_glue_bridge_%v", glueClient.EndpointID()),
+		topic_bridge.Side{Name: "mqtt", Client: mqttClient},
+		topic_bridge.Side{Name: "glue", Client: persistentGlueClient, OriginID: glueClient.EndpointID()},
+		mqttToGlueRoute,
+		glueToMQTTRoute,
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	glueClient.Start()
+	// Glue has no retained messages, so a peer that turns up late gets our snapshot of the retained MQTT state
+	glueClient.AddPeerObserver(func(peer string, added bool) {
+		if !added {
+			return
+		}
+
+		time.Sleep(peerResyncDelay)
+
+		log.Printf("resyncing for new glue peer %v", peer)
+
+		bridge.Resync("glue")
+	})
 
 	c := make(chan os.Signal, 16)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+
+		_ = bridge.Stop()
+
+		err = persistentGlueClient.Disconnect()
+		if err != nil {
+			log.Printf("warning: %v", err)
+		}
+
 		err = mqttClient.Disconnect()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		glueClient.Stop()
-
 		os.Exit(0)
 	}()
 
-	// feed stuff from mqtt into glue
-	err = mqttClient.Subscribe(
-		"+/+/#",
-		mqtt.ExactlyOnce,
-		func(message mqtt.Message) {
-			err = glueClient.Publish(
-				message.Topic,
-				"__mqtt_to_glue_bridge__",
-				time.Second,
-				[]byte(message.Payload),
-			)
-			if err != nil {
-				log.Printf("warning: %v", err)
-			}
-		},
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// feed stuff from glue into mqtt
-	err = glueClient.Subscribe(
-		"+/+/#",
-		"", // ignored for a wildcard subscription
-		func(message *topics.Message) {
-			if message.TopicType == "__mqtt_to_glue_bridge__" {
-				return
-			}
-
-			err = mqttClient.Publish(
-				message.TopicName,
-				mqtt.ExactlyOnce,
-				false,
-				string(message.Payload),
-			)
-			if err != nil {
-				log.Printf("warning: %v", err)
-			}
-		},
-	)
+	err = bridge.Start()
 	if err != nil {
 		log.Fatal(err)
 	}
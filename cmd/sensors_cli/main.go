@@ -17,7 +17,6 @@ import (
 
 const (
 	cyclePeriod      = time.Millisecond * 1000
-	topicPrefix      = "home/inside/environment"
 	topicSuffix      = "get"
 	presenceAffix    = "presence"
 	lightLevelAffix  = "light_level"
@@ -46,20 +45,43 @@ func getTopicFriendlyName(name string) string {
 }
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	publishQueueSizePtr := flag.Int("publishQueueSize", 1000, "how many publishes to buffer while disconnected (0 to disable)")
+	publishQueueOverflowPtr := flag.String("publishQueueOverflow", "drop-oldest", "what to do when the publish queue is full (drop-oldest, drop-newest or block)")
+	publishQueueSpoolPtr := flag.String("publishQueueSpool", "", "file to persist the publish queue to (optional)")
 	bridgeHost := flag.String("bridgeHost", "", "hue bridge host")
 	apiKeyPtr := flag.String("apiKey", "", "hue api key")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getRateLimitOptions := mqtt.AddRateLimitFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rateLimitOptions, err := getRateLimitOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	topicPrefix := namespace.Topic("inside/environment")
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
 
+	publishQueueOverflow, err := mqtt.ParseOverflowPolicy(*publishQueueOverflowPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *apiKeyPtr == "" {
 		log.Fatal("apiKey flag empty")
 	}
@@ -75,6 +97,36 @@ func main() {
 	time.Sleep(time.Second * 1)
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
+	err = mqttClient.SetAvailabilityTopic(fmt.Sprintf("%v/availability", topicPrefix))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if rateLimitOptions.IsEnabled() {
+		err = mqttClient.EnableRateLimit(rateLimitOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *publishQueueSizePtr > 0 {
+		err = mqttClient.EnablePublishQueue(mqtt.PublishQueueOptions{
+			MaxSize:        *publishQueueSizePtr,
+			OverflowPolicy: publishQueueOverflow,
+			SpoolPath:      *publishQueueSpoolPtr,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/initialed85/mqtt_things/pkg/leader_election"
 	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
 	"github.com/initialed85/mqtt_things/pkg/smart_aircons_client"
 )
@@ -28,10 +30,6 @@ func (f *flagArrayString) Set(value string) error {
 	return nil
 }
 
-const (
-	overallTopicPrefix = "home/inside/smart-aircons"
-)
-
 var (
 	airconHosts      flagArrayString
 	airconNames      flagArrayString
@@ -39,12 +37,16 @@ var (
 )
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
 	flag.Var(&airconHosts, "airconHost", "a host for an aircon")
 	flag.Var(&airconNames, "airconName", "a name for an aircon")
 	flag.Var(&airconCodesNames, "airconCodesName", "a codes name for an aircon")
+	leaseTopicPtr := flag.String("leaseTopic", "", "topic to hold a leader election on, for running more than one instance (optional)")
+	instanceIDPtr := flag.String("instanceID", "", "unique ID for this instance in the leader election (optional; defaults to hostname and PID)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -70,15 +72,45 @@ func main() {
 		log.Fatal("unbalanced mixture of -airconName and -airconName and airconCodesName flags")
 	}
 
-	var err error
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	overallTopicPrefix := namespace.Topic("inside/smart-aircons")
+	codesRPCTopic := overallTopicPrefix + "/rpc/codes"
+	learnRPCTopic := overallTopicPrefix + "/rpc/learn"
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
+	err = mqttClient.SetAvailabilityTopic(fmt.Sprintf("%v/availability", overallTopicPrefix))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
 	time.Sleep(time.Second)
 
+	// standbys keep their models up to date from the /set topics but only the leader sends IR and publishes state
+	var elector *leader_election.Elector
+	if *leaseTopicPtr != "" {
+		elector = leader_election.New(mqttClient, *leaseTopicPtr, *instanceIDPtr, leader_election.DefaultOptions)
+
+		err = elector.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	clients := make([]*smart_aircons_client.Client, 0)
 	for i, airconHost := range airconHosts {
 		airconName := airconNames[i]
@@ -111,6 +143,10 @@ func main() {
 			mqttClient.Publish,
 		)
 
+		if elector != nil {
+			client.SetLeadership(elector)
+		}
+
 		err = mqttClient.Subscribe(
 			fmt.Sprintf("%v/#", topicPrefix),
 			mqtt.ExactlyOnce,
@@ -125,6 +161,48 @@ func main() {
 		clients = append(clients, client)
 	}
 
+	getAirconIndex := func(request mqtt.Message) (int, error) {
+		airconName := strings.TrimSpace(request.Payload)
+		for i, possibleAirconName := range airconNames {
+			if possibleAirconName == airconName {
+				return i, nil
+			}
+		}
+
+		return -1, fmt.Errorf("%#+v not one of %v", airconName, airconNames.String())
+	}
+
+	rpcServer := mqtt.NewRPCServer(mqttClient)
+
+	err = rpcServer.Handle(codesRPCTopic, func(ctx context.Context, request mqtt.Message) (interface{}, error) {
+		i, err := getAirconIndex(request)
+		if err != nil {
+			return nil, err
+		}
+
+		codeNames, err := smart_aircons_client.GetCodeNames(airconCodesNames[i])
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(codeNames)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = rpcServer.Handle(learnRPCTopic, func(ctx context.Context, request mqtt.Message) (interface{}, error) {
+		i, err := getAirconIndex(request)
+		if err != nil {
+			return nil, err
+		}
+
+		return smart_aircons_client.BroadlinkLearnIR(airconHosts[i])
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	for _, client := range clients {
 		client.EnableRestoreMode()
 	}
@@ -162,6 +240,15 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
+		_ = rpcServer.Close()
+
+		if elector != nil {
+			err = elector.Stop()
+			if err != nil {
+				log.Print(err)
+			}
+		}
+
 		err = mqttClient.Disconnect()
 		if err != nil {
 			log.Print(err)
@@ -35,16 +35,31 @@ func (f *flagArrayInt64) Set(value string) error {
 var relaysPtr flagArrayInt64
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getPayloadFormat := mqtt_action_router.AddPayloadFormatFlags(flag.CommandLine)
+	getTimedActionOptions := mqtt_action_router.AddTimedActionFlags(flag.CommandLine)
 	portPtr := flag.String("port", "", "serial port")
 	flag.Var(&relaysPtr, "relay", "a relay to map to")
+	interlockPolicyPtr := flag.String("interlockPolicy", "", "stop banks running together (they share a water supply) by way of reject, turn_off_others or queue (optional)")
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	payloadFormat, err := getPayloadFormat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
@@ -62,6 +77,14 @@ func main() {
 		log.Fatal("no relays specified")
 	}
 
+	var interlockPolicy mqtt_action_router.InterlockPolicy
+	if *interlockPolicyPtr != "" {
+		interlockPolicy, err = mqtt_action_router.ParseInterlockPolicy(*interlockPolicyPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	relaysClient, err := relays_client.New(*portPtr, 9600)
 	if err != nil {
 		log.Fatal(err)
@@ -72,6 +95,18 @@ func main() {
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("outside/sprinklers/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
@@ -82,15 +117,38 @@ func main() {
 		time.Millisecond*10,
 		false,
 	)
+	actionRouter.SetPayloadFormat(payloadFormat)
+
+	err = actionRouter.EnableTimedActions(getTimedActionOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *interlockPolicyPtr != "" {
+		err = actionRouter.SetStatusTopic(namespace.Topic("outside/sprinklers/status"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		setTopics := make([]string, 0, len(relayNumbers))
+		for _, relayNumber := range relayNumbers {
+			setTopics = append(setTopics, namespace.Topicf("outside/sprinklers/bank/%v/state/set", relayNumber))
+		}
+
+		err = actionRouter.AddInterlockGroup("water", interlockPolicy, setTopics...)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	for _, relayNumber := range relayNumbers {
 		err = actionRouter.AddAction(
-			fmt.Sprintf("home/outside/sprinklers/bank/%v/state/set", relayNumber),
+			namespace.Topicf("outside/sprinklers/bank/%v/state/set", relayNumber),
 			relays_client.Arguments{Relay: relayNumber},
 			actionable.On,
 			actionable.Off,
 			mqtt_action_router.Off,
-			fmt.Sprintf("home/outside/sprinklers/bank/%v/state/get", relayNumber),
+			namespace.Topicf("outside/sprinklers/bank/%v/state/get", relayNumber),
 		)
 		if err != nil {
 			log.Fatal(err)
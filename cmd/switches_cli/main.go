@@ -2,7 +2,6 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -33,9 +32,13 @@ var (
 )
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getPayloadFormat := mqtt_action_router.AddPayloadFormatFlags(flag.CommandLine)
+	getReconcileOptions := mqtt_action_router.AddReconcileFlags(flag.CommandLine)
 	flag.Var(&hosts, "switchHost", "a host for a switch")
 	flag.Var(&names, "switchName", "a name for a switch")
 
@@ -43,6 +46,21 @@ func main() {
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	payloadFormat, err := getPayloadFormat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reconcileOptions, err := getReconcileOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
@@ -75,7 +93,19 @@ func main() {
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
-	err := mqttClient.Connect()
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("inside/switches/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -85,6 +115,7 @@ func main() {
 		time.Millisecond*10,
 		true,
 	)
+	actionRouter.SetPayloadFormat(payloadFormat)
 
 	switches, err := switchesClient.GetSwitches()
 	if err != nil {
@@ -93,12 +124,21 @@ func main() {
 
 	for _, s := range switches {
 		err = actionRouter.AddAction(
-			fmt.Sprintf("home/inside/switches/globe/%v/state/set", s.Name),
+			namespace.Topicf("inside/switches/globe/%v/state/set", s.Name),
 			switches_client.Arguments{Name: s.Name},
 			actionable.On,
 			actionable.Off,
 			mqtt_action_router.Off,
-			fmt.Sprintf("home/inside/switches/globe/%v/state/get", s.Name),
+			namespace.Topicf("inside/switches/globe/%v/state/get", s.Name),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = actionRouter.Reconcile(
+			namespace.Topicf("inside/switches/globe/%v/state/set", s.Name),
+			actionable.Read,
+			reconcileOptions,
 		)
 		if err != nil {
 			log.Fatal(err)
@@ -122,38 +162,11 @@ func main() {
 		os.Exit(0)
 	}()
 
-	lastStateByName := make(map[string]switches_client.State, 0)
+	ticker := time.NewTicker(time.Second * 1)
 
-	ticker := time.NewTicker(time.Millisecond * 1000)
 	for {
 		select {
 		case <-ticker.C:
-			switches, err := switchesClient.GetSwitches()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			for _, s := range switches {
-				_, ok := lastStateByName[s.Name]
-				if !ok {
-					lastStateByName[s.Name] = s.State
-				} else if s.State == lastStateByName[s.Name] {
-					continue
-				}
-
-				err := mqttClient.Publish(
-					fmt.Sprintf("home/inside/switches/globe/%v/state/get", s.Name),
-					mqtt.ExactlyOnce,
-					true,
-					fmt.Sprintf("%v", s.State),
-					true,
-				)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				lastStateByName[s.Name] = s.State
-			}
 		}
 	}
 }
@@ -13,7 +13,7 @@ import (
 
 func main() {
 	modePtr := flag.String("mode", "sub", "pub / sub")
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
 	topicPtr := flag.String("topic", "", "mqtt topic")
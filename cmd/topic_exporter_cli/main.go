@@ -19,20 +19,39 @@ import (
 )
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
-	err := mqttClient.Connect()
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("topic-exporter/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -75,13 +94,13 @@ func main() {
 	}
 
 	err = mqttClient.Subscribe(
-		"+/+/#",
+		namespace.Topic("#"),
 		mqtt.ExactlyOnce,
 		func(message mqtt.Message) {
 			topic := message.Topic
 			payload := strings.TrimSpace(strings.ToLower(message.Payload))
 
-			if strings.Contains(topic, "home/inside/smart-aircons/") && strings.HasSuffix(topic, "/mode/get") {
+			if strings.Contains(topic, namespace.Topic("inside/smart-aircons")+"/") && strings.HasSuffix(topic, "/mode/get") {
 				heatTopic := strings.ReplaceAll(topic, "/mode/get", "/heat/get")
 				coolTopic := strings.ReplaceAll(topic, "/mode/get", "/cool/get")
 				fanTopic := strings.ReplaceAll(topic, "/mode/get", "/fan/get")
@@ -106,12 +125,17 @@ func main() {
 				return
 			}
 
+			// structured documents (e.g. the weather) are also published per-field, so there's nothing to export
+			if strings.HasPrefix(payload, "{") {
+				return
+			}
+
 			var value float64
 
 			switch payload {
-			case "yes", "true", "y", "t", "on":
+			case "yes", "true", "y", "t", "on", "online":
 				value = 1.0
-			case "no", "false", "n", "f", "off":
+			case "no", "false", "n", "f", "off", "offline":
 				value = 0.0
 			default:
 				value, err = strconv.ParseFloat(message.Payload, 64)
@@ -14,25 +14,27 @@ import (
 )
 
 const (
-	timestampTopic         = "home/outside/weather/timestamp/get"
-	stationIDTopic         = "home/outside/weather/station-id/get"
-	latitudeTopic          = "home/outside/weather/latitude/get"
-	longitudeTopic         = "home/outside/weather/longitude/get"
-	temperatureTopic       = "home/outside/weather/temperature/get"
-	dewPointTopic          = "home/outside/weather/dew-point/get"
-	humidityTopic          = "home/outside/weather/humidity/get"
-	windSpeedTopic         = "home/outside/weather/wind-speed/get"
-	windDirectionTopic     = "home/outside/weather/wind-direction/get"
-	windGustTopic          = "home/outside/weather/wind-gust/get"
-	airPressureTopic       = "home/outside/weather/air-pressure/get"
-	rainLast60MinsTopic    = "home/outside/weather/rain-last-60-mins/get"
-	rainTodayTopic         = "home/outside/weather/rain-today/get"
-	temperatureIndoorTopic = "home/inside/weather/temperature/get"
-	humidityIndoorTopic    = "home/inside/weather/humidity/get"
+	weatherTopic           = "outside/weather/get"
+	timestampTopic         = "outside/weather/timestamp/get"
+	stationIDTopic         = "outside/weather/station-id/get"
+	latitudeTopic          = "outside/weather/latitude/get"
+	longitudeTopic         = "outside/weather/longitude/get"
+	temperatureTopic       = "outside/weather/temperature/get"
+	dewPointTopic          = "outside/weather/dew-point/get"
+	humidityTopic          = "outside/weather/humidity/get"
+	windSpeedTopic         = "outside/weather/wind-speed/get"
+	windDirectionTopic     = "outside/weather/wind-direction/get"
+	windGustTopic          = "outside/weather/wind-gust/get"
+	airPressureTopic       = "outside/weather/air-pressure/get"
+	rainLast60MinsTopic    = "outside/weather/rain-last-60-mins/get"
+	rainTodayTopic         = "outside/weather/rain-today/get"
+	temperatureIndoorTopic = "inside/weather/temperature/get"
+	humidityIndoorTopic    = "inside/weather/humidity/get"
 )
 
 var (
 	allTopics = []string{
+		weatherTopic,
 		timestampTopic,
 		stationIDTopic,
 		latitudeTopic,
@@ -52,21 +54,42 @@ var (
 )
 
 func main() {
-	hostPtr := flag.String("host", "", "mqtt broker host")
+	hostPtr := flag.String("host", "", "mqtt broker host or URL")
 	usernamePtr := flag.String("username", "", "mqtt username")
 	passwordPtr := flag.String("password", "", "mqtt password")
+	metricsAddrPtr := flag.String("metricsAddr", "", "address to serve mqtt client metrics on (e.g. :9138; optional)")
+	publishQueueSizePtr := flag.Int("publishQueueSize", 1000, "how many publishes to buffer while disconnected (0 to disable)")
+	publishQueueOverflowPtr := flag.String("publishQueueOverflow", "drop-oldest", "what to do when the publish queue is full (drop-oldest, drop-newest or block)")
+	publishQueueSpoolPtr := flag.String("publishQueueSpool", "", "file to persist the publish queue to (optional)")
 	portPtr := flag.Uint64("port", 0, "port")
 	latitudePtr := flag.Float64("latitude", 0.0, "")
 	longitudePtr := flag.Float64("longitude", 0.0, "")
+	getNamespace := mqtt.AddNamespaceFlags(flag.CommandLine)
+	getRateLimitOptions := mqtt.AddRateLimitFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
+	namespace, err := getNamespace()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rateLimitOptions, err := getRateLimitOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *hostPtr == "" {
 		log.Fatal("host flag empty")
 	}
 
+	publishQueueOverflow, err := mqtt.ParseOverflowPolicy(*publishQueueOverflowPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *portPtr == 0 {
 		log.Fatal("port flag empty")
 	}
@@ -80,7 +103,37 @@ func main() {
 	}
 
 	mqttClient := mqtt.GetMQTTClient(*hostPtr, *usernamePtr, *passwordPtr)
-	err := mqttClient.Connect()
+	err = mqttClient.SetAvailabilityTopic(namespace.Topic("outside/weather/availability"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if rateLimitOptions.IsEnabled() {
+		err = mqttClient.EnableRateLimit(rateLimitOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *publishQueueSizePtr > 0 {
+		err = mqttClient.EnablePublishQueue(mqtt.PublishQueueOptions{
+			MaxSize:        *publishQueueSizePtr,
+			OverflowPolicy: publishQueueOverflow,
+			SpoolPath:      *publishQueueSpoolPtr,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *metricsAddrPtr != "" {
+		err = mqtt.ServeMetrics(mqttClient, *metricsAddrPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = mqttClient.Connect()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -90,7 +143,7 @@ func main() {
 	go func() {
 		<-c
 		for _, topic := range allTopics {
-			err = mqttClient.Publish(topic, mqtt.ExactlyOnce, false, "")
+			err = mqttClient.Publish(namespace.Topic(topic), mqtt.ExactlyOnce, false, "")
 			if err != nil {
 				log.Print(err)
 			}
@@ -112,8 +165,19 @@ func main() {
 		*latitudePtr,
 		*longitudePtr,
 		func(weather wunderground_weather_server.Weather) {
+			err = mqtt.PublishJSON(
+				mqttClient,
+				namespace.Topic(weatherTopic),
+				mqtt.ExactlyOnce,
+				false,
+				weather,
+			)
+			if err != nil {
+				log.Printf("failed to publish Weather (%+v): %v", weather, err)
+			}
+
 			err = mqttClient.Publish(
-				timestampTopic,
+				namespace.Topic(timestampTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%v", weather.Timestamp.UnixNano()),
@@ -123,7 +187,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				stationIDTopic,
+				namespace.Topic(stationIDTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%v", weather.StationID),
@@ -133,7 +197,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				latitudeTopic,
+				namespace.Topic(latitudeTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%v", weather.Latitude),
@@ -143,7 +207,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				longitudeTopic,
+				namespace.Topic(longitudeTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%v", weather.Longitude),
@@ -153,7 +217,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				temperatureTopic,
+				namespace.Topic(temperatureTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.Temperature),
@@ -163,7 +227,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				dewPointTopic,
+				namespace.Topic(dewPointTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.DewPoint),
@@ -173,7 +237,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				humidityTopic,
+				namespace.Topic(humidityTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.Humidity),
@@ -183,7 +247,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				windSpeedTopic,
+				namespace.Topic(windSpeedTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.WindSpeed),
@@ -193,7 +257,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				windDirectionTopic,
+				namespace.Topic(windDirectionTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.WindDirection),
@@ -203,7 +267,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				windGustTopic,
+				namespace.Topic(windGustTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.WindGust),
@@ -213,7 +277,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				airPressureTopic,
+				namespace.Topic(airPressureTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.AirPressure),
@@ -223,7 +287,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				rainLast60MinsTopic,
+				namespace.Topic(rainLast60MinsTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.RainLast60Mins),
@@ -233,7 +297,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				rainTodayTopic,
+				namespace.Topic(rainTodayTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.RainToday),
@@ -243,7 +307,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				temperatureIndoorTopic,
+				namespace.Topic(temperatureIndoorTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.TemperatureIndoor),
@@ -253,7 +317,7 @@ func main() {
 			}
 
 			err = mqttClient.Publish(
-				humidityIndoorTopic,
+				namespace.Topic(humidityIndoorTopic),
 				mqtt.ExactlyOnce,
 				false,
 				fmt.Sprintf("%.2f", weather.HumidityIndoor),
@@ -12,8 +12,10 @@ require (
 	github.com/hashicorp/go-rootcerts v1.0.2
 	github.com/initialed85/glue v0.0.0-20240324114717-73c317ae6909
 	github.com/prometheus/client_golang v1.19.1
+	github.com/segmentio/ksuid v1.0.4
 	github.com/stretchr/testify v1.6.1
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 	github.com/yosssi/gmq v0.0.1
 	golang.org/x/exp v0.0.0-20240525044651-4c93da0ed11d
 )
@@ -28,8 +30,6 @@ require (
 	github.com/prometheus/client_model v0.6.1 // indirect
 	github.com/prometheus/common v0.53.0 // indirect
 	github.com/prometheus/procfs v0.15.0 // indirect
-	github.com/segmentio/ksuid v1.0.4 // indirect
-	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
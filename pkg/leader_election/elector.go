@@ -0,0 +1,330 @@
+package leader_election
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+// Lease is what's (retained) on the lease topic; Token goes up by one each time leadership changes hands, so anything
+// that sees a lease with a lower token than one it's already seen knows it's stale (i.e. it's a fencing token)
+type Lease struct {
+	Holder   string        `json:"holder"`
+	Token    uint64        `json:"token"`
+	Duration time.Duration `json:"duration"`
+}
+
+type Options struct {
+	LeaseDuration     time.Duration
+	HeartbeatInterval time.Duration
+}
+
+var DefaultOptions = Options{
+	LeaseDuration:     time.Second * 15,
+	HeartbeatInterval: time.Second * 5,
+}
+
+// Elector competes with other Electors (probably on other hosts) for the lease on a topic; a lease expires if its
+// holder hasn't renewed it within its duration (as measured by our clock, so clock skew doesn't matter)
+type Elector struct {
+	mu             sync.Mutex
+	client         mqtt.Client
+	topic          string
+	id             string
+	options        Options
+	current        Lease
+	currentSeen    time.Time
+	token          uint64
+	candidate      bool
+	leading        bool
+	lastObserverID uint64
+	observerByID   map[uint64]func(leading bool)
+	stop           chan struct{}
+	stopped        chan struct{}
+}
+
+func GetDefaultID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%v-%v", hostname, os.Getpid())
+}
+
+// New returns an Elector for the lease on topic; id should be unique per instance (GetDefaultID is used if it's empty)
+func New(client mqtt.Client, topic string, id string, options Options) *Elector {
+	if id == "" {
+		id = GetDefaultID()
+	}
+
+	if options.LeaseDuration <= 0 {
+		options.LeaseDuration = DefaultOptions.LeaseDuration
+	}
+
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = options.LeaseDuration / 3
+	}
+
+	return &Elector{
+		client:       client,
+		topic:        topic,
+		id:           id,
+		options:      options,
+		observerByID: make(map[uint64]func(leading bool)),
+	}
+}
+
+func (e *Elector) ID() string {
+	return e.id
+}
+
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leading
+}
+
+// Token is our fencing token while we're the leader (and 0 otherwise)
+func (e *Elector) Token() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.leading {
+		return 0
+	}
+
+	return e.token
+}
+
+// Leader returns the most recent lease seen on the topic and whether or not it's still current
+func (e *Elector) Leader() (Lease, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.current, !e.expired(time.Now())
+}
+
+// AddObserver registers observer to be called whenever we gain or lose leadership; the returned func removes it
+func (e *Elector) AddObserver(observer func(leading bool)) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastObserverID++
+	id := e.lastObserverID
+
+	e.observerByID[id] = observer
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		delete(e.observerByID, id)
+	}
+}
+
+// setLeading must be called with the lock held; it returns a func to call (without the lock) to notify the observers
+func (e *Elector) setLeading(leading bool) func() {
+	if e.leading == leading {
+		return func() {}
+	}
+
+	e.leading = leading
+
+	if leading {
+		log.Printf("%v became the leader for %v with token %v", e.id, e.topic, e.token)
+	} else {
+		log.Printf("%v is no longer the leader for %v", e.id, e.topic)
+	}
+
+	observers := make([]func(leading bool), 0, len(e.observerByID))
+	for _, observer := range e.observerByID {
+		observers = append(observers, observer)
+	}
+
+	return func() {
+		for _, observer := range observers {
+			observer(leading)
+		}
+	}
+}
+
+func (e *Elector) expired(now time.Time) bool {
+	return e.current.Holder == "" || now.Sub(e.currentSeen) > e.current.Duration
+}
+
+func (e *Elector) publish(lease Lease) error {
+	payload, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	return e.client.Publish(e.topic, mqtt.AtLeastOnce, true, payload, true)
+}
+
+func (e *Elector) handleMessage(message mqtt.Message) {
+	lease := Lease{}
+
+	err := json.Unmarshal(message.RawPayload, &lease)
+	if err != nil {
+		log.Printf("warning: ignoring unparseable lease %#+v on %v because: %v", message.Payload, e.topic, err)
+		return
+	}
+
+	now := time.Now()
+
+	e.mu.Lock()
+
+	if lease.Token < e.current.Token && !e.expired(now) {
+		current := e.current
+		e.mu.Unlock()
+		log.Printf("warning: ignoring stale lease %+v on %v (current is %+v)", lease, e.topic, current)
+		return
+	}
+
+	e.current = lease
+	e.currentSeen = now
+
+	notify := func() {}
+	if lease.Holder != e.id {
+		e.candidate = false
+		notify = e.setLeading(false)
+	}
+
+	e.mu.Unlock()
+
+	notify()
+}
+
+// tick renews the lease if we're leading, otherwise claims it if it's expired; a claim only becomes leadership if
+// it's still the current lease at the next tick (which gives a competing claim time to arrive)
+func (e *Elector) tick() {
+	now := time.Now()
+
+	e.mu.Lock()
+
+	notify := func() {}
+	var lease *Lease
+
+	switch {
+	case e.leading && e.expired(now):
+		// our renewals haven't been making it back to us, so as far as everyone else is concerned we've gone away
+		log.Printf("warning: %v hasn't seen its own lease on %v for %v; stepping down", e.id, e.topic, now.Sub(e.currentSeen))
+		notify = e.setLeading(false)
+	case e.leading:
+		lease = &Lease{Holder: e.id, Token: e.token, Duration: e.options.LeaseDuration}
+	case e.candidate:
+		e.candidate = false
+		if e.current.Holder == e.id && e.current.Token == e.token && !e.expired(now) {
+			notify = e.setLeading(true)
+			lease = &Lease{Holder: e.id, Token: e.token, Duration: e.options.LeaseDuration}
+		}
+	case e.expired(now) || e.current.Holder == e.id:
+		e.token = e.current.Token + 1
+		e.candidate = true
+		lease = &Lease{Holder: e.id, Token: e.token, Duration: e.options.LeaseDuration}
+		log.Printf("%v claiming the lease for %v with token %v", e.id, e.topic, e.token)
+	}
+
+	e.mu.Unlock()
+
+	notify()
+
+	if lease == nil {
+		return
+	}
+
+	err := e.publish(*lease)
+	if err != nil {
+		log.Printf("warning: failed to publish lease %+v to %v because: %v", *lease, e.topic, err)
+	}
+}
+
+func (e *Elector) run(stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(e.options.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			e.tick()
+		}
+	}
+}
+
+// Start subscribes to the lease topic and starts competing for it; the first claim happens after one heartbeat
+// interval so that we've seen any (retained) lease that's already held
+func (e *Elector) Start() error {
+	e.mu.Lock()
+	if e.stop != nil {
+		e.mu.Unlock()
+		return fmt.Errorf("%v already started", e.id)
+	}
+
+	e.stop = make(chan struct{})
+	e.stopped = make(chan struct{})
+	stop, stopped := e.stop, e.stopped
+	e.mu.Unlock()
+
+	err := e.client.Subscribe(e.topic, mqtt.AtLeastOnce, e.handleMessage)
+	if err != nil {
+		e.mu.Lock()
+		e.stop, e.stopped = nil, nil
+		e.mu.Unlock()
+
+		return fmt.Errorf("failed to subscribe to %v because: %v", e.topic, err)
+	}
+
+	go e.run(stop, stopped)
+
+	return nil
+}
+
+// Stop stops competing for the lease; if we're the leader we resign (rather than making the others wait for the lease
+// to expire)
+func (e *Elector) Stop() error {
+	e.mu.Lock()
+	if e.stop == nil {
+		e.mu.Unlock()
+		return fmt.Errorf("%v not started", e.id)
+	}
+
+	stop, stopped := e.stop, e.stopped
+	e.stop, e.stopped = nil, nil
+	e.mu.Unlock()
+
+	close(stop)
+	<-stopped
+
+	e.mu.Lock()
+	wasLeading := e.leading
+	e.candidate = false
+	notify := e.setLeading(false)
+	token := e.token
+	e.mu.Unlock()
+
+	notify()
+
+	var publishErr error
+	if wasLeading {
+		publishErr = e.publish(Lease{Token: token, Duration: e.options.LeaseDuration})
+	}
+
+	unsubscribeErr := e.client.Unsubscribe(e.topic)
+
+	if publishErr != nil {
+		return fmt.Errorf("failed to resign because: %v", publishErr)
+	}
+
+	return unsubscribeErr
+}
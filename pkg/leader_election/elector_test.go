@@ -0,0 +1,148 @@
+package leader_election
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+const testTopic = "test/heater/lease"
+
+var testOptions = Options{
+	LeaseDuration:     time.Millisecond * 100,
+	HeartbeatInterval: time.Millisecond * 20,
+}
+
+func TestElector(t *testing.T) {
+	setup := func(t *testing.T, b *mqtttest.Broker, id string) (*mqtttest.Client, *Elector) {
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		e := New(c, testTopic, id, testOptions)
+		require.NoError(t, e.Start())
+		t.Cleanup(func() {
+			_ = e.Stop()
+		})
+
+		return c, e
+	}
+
+	requireLeader := func(t *testing.T, e *Elector) {
+		require.Eventually(t, e.IsLeader, time.Second, time.Millisecond*10)
+	}
+
+	t.Run("SingleInstance", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		_, e := setup(t, b, "a")
+
+		changes := make(chan bool, 4)
+		e.AddObserver(func(leading bool) {
+			changes <- leading
+		})
+
+		requireLeader(t, e)
+		require.True(t, <-changes)
+		require.Equal(t, uint64(1), e.Token())
+
+		retained, ok := b.Retained(testTopic)
+		require.True(t, ok)
+		lease := Lease{}
+		require.NoError(t, json.Unmarshal([]byte(retained.Payload), &lease))
+		require.Equal(t, Lease{Holder: "a", Token: 1, Duration: testOptions.LeaseDuration}, lease)
+
+		require.NoError(t, e.Stop())
+		require.False(t, <-changes)
+		require.False(t, e.IsLeader())
+		require.Equal(t, uint64(0), e.Token())
+		require.Error(t, e.Stop())
+	})
+
+	t.Run("StandbyWaitsThenTakesOverOnResign", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		_, a := setup(t, b, "a")
+		requireLeader(t, a)
+
+		_, standby := setup(t, b, "b")
+		time.Sleep(testOptions.LeaseDuration * 3)
+		require.True(t, a.IsLeader())
+		require.False(t, standby.IsLeader())
+
+		lease, current := standby.Leader()
+		require.True(t, current)
+		require.Equal(t, "a", lease.Holder)
+
+		require.NoError(t, a.Stop())
+		requireLeader(t, standby)
+		require.Equal(t, uint64(2), standby.Token())
+	})
+
+	t.Run("StandbyTakesOverOnExpiry", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c, a := setup(t, b, "a")
+		requireLeader(t, a)
+
+		_, standby := setup(t, b, "b")
+
+		c.Drop(fmt.Errorf("injected connection loss"))
+
+		requireLeader(t, standby)
+		require.Equal(t, uint64(2), standby.Token())
+
+		// a can't hear anything, but it notices its renewals aren't coming back
+		require.Eventually(t, func() bool { return !a.IsLeader() }, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("StaleLeaseIgnored", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		_, e := setup(t, b, "a")
+		requireLeader(t, e)
+
+		payload, err := json.Marshal(Lease{Holder: "b", Token: 0, Duration: time.Hour})
+		require.NoError(t, err)
+		b.Inject(testTopic, 1, true, payload)
+
+		time.Sleep(testOptions.HeartbeatInterval * 3)
+		require.True(t, e.IsLeader())
+		require.Equal(t, uint64(1), e.Token())
+
+		// whereas a newer token is another leader (e.g. one that was partitioned from us)
+		payload, err = json.Marshal(Lease{Holder: "b", Token: 2, Duration: time.Hour})
+		require.NoError(t, err)
+		b.Inject(testTopic, 1, true, payload)
+
+		require.False(t, e.IsLeader())
+	})
+}
+
+func TestFence(t *testing.T) {
+	f := Fence{}
+	require.True(t, f.Check(2))
+	require.True(t, f.Check(2))
+	require.False(t, f.Check(1))
+	require.True(t, f.Check(3))
+
+	b := mqtttest.NewBroker()
+	c := b.NewClient(nil)
+	c.EnableProperties()
+	require.NoError(t, c.Connect())
+
+	var received mqtt.Message
+	require.NoError(t, c.Subscribe("test/heater/state/get", mqtt.ExactlyOnce, func(message mqtt.Message) {
+		received = message
+	}))
+
+	require.NoError(t, c.PublishWithProperties("test/heater/state/get", mqtt.ExactlyOnce, true, "1", GetFencingProperties(7)))
+	token, ok := GetFencingToken(received)
+	require.True(t, ok)
+	require.Equal(t, uint64(7), token)
+
+	require.NoError(t, c.Publish("test/heater/state/get", mqtt.ExactlyOnce, true, "1"))
+	_, ok = GetFencingToken(received)
+	require.False(t, ok)
+}
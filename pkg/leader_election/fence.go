@@ -0,0 +1,57 @@
+package leader_election
+
+import (
+	"strconv"
+	"sync"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+// FencingTokenUserProperty carries the token (see Elector.Token) of the leader that published a message
+const FencingTokenUserProperty = "fencing_token"
+
+// GetFencingProperties returns the properties to publish with while leading with token
+func GetFencingProperties(token uint64) mqtt.Properties {
+	return mqtt.Properties{
+		UserProperties: map[string]string{FencingTokenUserProperty: strconv.FormatUint(token, 10)},
+	}
+}
+
+// GetFencingToken returns the token a message was published with (if it was published with one)
+func GetFencingToken(message mqtt.Message) (uint64, bool) {
+	if message.Properties == nil {
+		return 0, false
+	}
+
+	rawToken, ok := message.Properties.UserProperties[FencingTokenUserProperty]
+	if !ok {
+		return 0, false
+	}
+
+	token, err := strconv.ParseUint(rawToken, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return token, true
+}
+
+// Fence is the receiving end of fencing tokens; it remembers the highest token it's seen and turns away anything with
+// a lower one (i.e. something from a leader that's since been replaced, but doesn't know it yet)
+type Fence struct {
+	mu      sync.Mutex
+	highest uint64
+}
+
+func (f *Fence) Check(token uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if token < f.highest {
+		return false
+	}
+
+	f.highest = token
+
+	return true
+}
@@ -1,14 +1,30 @@
 package lights_client
 
+import (
+	"sync"
+	"time"
+)
+
+// DefaultReadMaxAge suits the default reconcile interval; with a light per action, every action's Read in the same
+// round shares one bulk read of the bridge
+const DefaultReadMaxAge = time.Millisecond * 500
+
 type Arguments struct {
 	Name string
 }
 
 type Actionable struct {
-	Client Client
+	Client     Client
+	ReadMaxAge time.Duration // how long a bulk read is shared between Reads; 0 means DefaultReadMaxAge
+
+	mu       sync.Mutex
+	lights   []Light
+	lastRead time.Time
 }
 
 func (a *Actionable) On(arguments interface{}) error {
+	defer a.forgetLights()
+
 	light, err := a.Client.GetLight(arguments.(Arguments).Name)
 	if err != nil {
 		return err
@@ -18,6 +34,8 @@ func (a *Actionable) On(arguments interface{}) error {
 }
 
 func (a *Actionable) Off(arguments interface{}) error {
+	defer a.forgetLights()
+
 	light, err := a.Client.GetLight(arguments.(Arguments).Name)
 	if err != nil {
 		return err
@@ -25,3 +43,52 @@ func (a *Actionable) Off(arguments interface{}) error {
 
 	return light.Off()
 }
+
+// getLights reads every light from the bridge, unless it's been done recently
+func (a *Actionable) getLights() ([]Light, error) {
+	readMaxAge := a.ReadMaxAge
+	if readMaxAge <= 0 {
+		readMaxAge = DefaultReadMaxAge
+	}
+
+	// held for the read, so that concurrent Reads wait for (and share) the one that's in flight
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.lights != nil && time.Since(a.lastRead) < readMaxAge {
+		return a.lights, nil
+	}
+
+	lights, err := a.Client.GetLights()
+	if err != nil {
+		return nil, err
+	}
+
+	a.lights = lights
+	a.lastRead = time.Now()
+
+	return lights, nil
+}
+
+// forgetLights makes sure the next Read sees what On / Off just did (it waits for a bulk read that's in flight)
+func (a *Actionable) forgetLights() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.lights = nil
+}
+
+// Read is for mqtt_action_router.Router.Reconcile
+func (a *Actionable) Read(arguments interface{}) (interface{}, error) {
+	lights, err := a.getLights()
+	if err != nil {
+		return Unknown, err
+	}
+
+	light, err := findLight(lights, arguments.(Arguments).Name)
+	if err != nil {
+		return Unknown, err
+	}
+
+	return light.State, nil
+}
@@ -113,6 +113,10 @@ func (c *Client) GetLight(name string) (Light, error) {
 		return Light{}, err
 	}
 
+	return findLight(lights, name)
+}
+
+func findLight(lights []Light, name string) (Light, error) {
 	for _, light := range lights {
 		// TODO: implicit behaviour is a little gross
 		if light.Name == name || light.Name == formatLightName(name) {
@@ -0,0 +1,195 @@
+package mqtt_action_router
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Dialect is one way of writing on / off in a payload
+type Dialect struct {
+	Name    string
+	On      string
+	Off     string
+	JSONKey string // if set, the state is wrapped in a JSON object under this key (e.g. {"state":"ON"})
+}
+
+var (
+	Numeric = Dialect{Name: "numeric", On: "1", Off: "0"}
+	OnOff   = Dialect{Name: "on_off", On: "ON", Off: "OFF"}
+	Boolean = Dialect{Name: "boolean", On: "true", Off: "false"}
+	JSON    = Dialect{Name: "json", On: "ON", Off: "OFF", JSONKey: "state"}
+)
+
+// GetDialects returns the preset dialects
+func GetDialects() []Dialect {
+	return []Dialect{Numeric, OnOff, Boolean, JSON}
+}
+
+func GetDialect(name string) (Dialect, error) {
+	names := make([]string, 0)
+	for _, dialect := range GetDialects() {
+		if strings.EqualFold(strings.TrimSpace(name), dialect.Name) {
+			return dialect, nil
+		}
+
+		names = append(names, dialect.Name)
+	}
+
+	return Dialect{}, fmt.Errorf("unknown payload dialect %#+v; known dialects are %v", name, strings.Join(names, ", "))
+}
+
+func (d Dialect) Format(state State) (string, error) {
+	var payload string
+
+	switch state {
+	case On:
+		payload = d.On
+	case Off:
+		payload = d.Off
+	default:
+		return "", fmt.Errorf("can't format state %v as %v", state, d.Name)
+	}
+
+	if d.JSONKey == "" {
+		return payload, nil
+	}
+
+	data, err := json.Marshal(map[string]string{d.JSONKey: payload})
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func (d Dialect) parseWord(word string) (State, error) {
+	word = strings.TrimSpace(word)
+
+	if strings.EqualFold(word, d.On) {
+		return On, nil
+	}
+
+	if strings.EqualFold(word, d.Off) {
+		return Off, nil
+	}
+
+	return Unknown, fmt.Errorf("%#+v not one of %#+v or %#+v", word, d.On, d.Off)
+}
+
+// Parse is case-insensitive; for a JSON dialect the value can also be a JSON boolean or 0 / 1
+func (d Dialect) Parse(payload string) (State, error) {
+	if d.JSONKey == "" {
+		return d.parseWord(payload)
+	}
+
+	valueByKey := make(map[string]interface{})
+
+	err := json.Unmarshal([]byte(payload), &valueByKey)
+	if err != nil {
+		return Unknown, fmt.Errorf("failed to parse %#+v as a JSON object because: %v", payload, err)
+	}
+
+	value, ok := valueByKey[d.JSONKey]
+	if !ok {
+		return Unknown, fmt.Errorf("%#+v has no %#+v", payload, d.JSONKey)
+	}
+
+	switch value := value.(type) {
+	case string:
+		return d.parseWord(value)
+	case bool:
+		if value {
+			return On, nil
+		}
+
+		return Off, nil
+	case float64:
+		if value == 1 {
+			return On, nil
+		} else if value == 0 {
+			return Off, nil
+		}
+	}
+
+	return Unknown, fmt.Errorf("%#+v for %#+v not a state", value, d.JSONKey)
+}
+
+// PayloadFormat is how a binary action reads its set topic (and the leader's get topic) and writes its get topic
+type PayloadFormat struct {
+	Accept []Dialect // tried in order, then Output (so that what we publish can always be read back)
+	Output Dialect
+}
+
+// DefaultPayloadFormat is what the router has always done
+var DefaultPayloadFormat = PayloadFormat{Accept: []Dialect{Numeric}, Output: Numeric}
+
+func (f PayloadFormat) Parse(payload string) (State, error) {
+	accept := append([]Dialect{}, f.Accept...)
+
+	outputAccepted := false
+	for _, dialect := range accept {
+		if dialect == f.Output {
+			outputAccepted = true
+			break
+		}
+	}
+
+	if !outputAccepted {
+		accept = append(accept, f.Output)
+	}
+
+	errs := make([]string, 0, len(accept))
+	for _, dialect := range accept {
+		state, err := dialect.Parse(payload)
+		if err == nil {
+			return state, nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%v: %v", dialect.Name, err))
+	}
+
+	return Unknown, fmt.Errorf("failed to parse %#+v because: %v", payload, strings.Join(errs, "; "))
+}
+
+func (f PayloadFormat) Format(state State) (string, error) {
+	return f.Output.Format(state)
+}
+
+// ParsePayloadFormat takes a comma-separated list of dialect names to accept and the name of the one to output
+func ParsePayloadFormat(rawAccept string, rawOutput string) (PayloadFormat, error) {
+	format := PayloadFormat{}
+
+	var err error
+
+	format.Output, err = GetDialect(rawOutput)
+	if err != nil {
+		return format, err
+	}
+
+	for _, name := range strings.Split(rawAccept, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+
+		dialect, err := GetDialect(name)
+		if err != nil {
+			return format, err
+		}
+
+		format.Accept = append(format.Accept, dialect)
+	}
+
+	return format, nil
+}
+
+// AddPayloadFormatFlags adds -payloadAccept and -payloadOutput to flagSet; call the returned func after parsing
+func AddPayloadFormatFlags(flagSet *flag.FlagSet) func() (PayloadFormat, error) {
+	acceptPtr := flagSet.String("payloadAccept", Numeric.Name, "comma-separated payload dialects to accept on set topics (numeric, on_off, boolean and / or json)")
+	outputPtr := flagSet.String("payloadOutput", Numeric.Name, "payload dialect to publish on get topics (numeric, on_off, boolean or json)")
+
+	return func() (PayloadFormat, error) {
+		return ParsePayloadFormat(*acceptPtr, *outputPtr)
+	}
+}
@@ -0,0 +1,105 @@
+package mqtt_action_router
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialect(t *testing.T) {
+	t.Run("Presets", func(t *testing.T) {
+		for _, testCase := range []struct {
+			dialect Dialect
+			on      string
+			off     string
+			parsed  map[string]State
+		}{
+			{Numeric, "1", "0", map[string]State{" 1 ": On, "0": Off}},
+			{OnOff, "ON", "OFF", map[string]State{"on": On, "Off": Off}},
+			{Boolean, "true", "false", map[string]State{"TRUE": On, "false": Off}},
+			{JSON, `{"state":"ON"}`, `{"state":"OFF"}`, map[string]State{
+				`{"state": "on", "brightness": 255}`: On,
+				`{"state": false}`:                   Off,
+				`{"state": 1}`:                       On,
+			}},
+		} {
+			on, err := testCase.dialect.Format(On)
+			require.NoError(t, err)
+			require.Equal(t, testCase.on, on)
+
+			off, err := testCase.dialect.Format(Off)
+			require.NoError(t, err)
+			require.Equal(t, testCase.off, off)
+
+			_, err = testCase.dialect.Format(Unknown)
+			require.Error(t, err)
+
+			for payload, expected := range map[string]State{on: On, off: Off} {
+				state, err := testCase.dialect.Parse(payload)
+				require.NoError(t, err, "%v %#+v", testCase.dialect.Name, payload)
+				require.Equal(t, expected, state)
+			}
+
+			for payload, expected := range testCase.parsed {
+				state, err := testCase.dialect.Parse(payload)
+				require.NoError(t, err, "%v %#+v", testCase.dialect.Name, payload)
+				require.Equal(t, expected, state)
+			}
+		}
+
+		for dialect, payloads := range map[string][]string{
+			Numeric.Name: {"2", "ON", ""},
+			OnOff.Name:   {"1", "ONN"},
+			Boolean.Name: {"yes"},
+			JSON.Name:    {"ON", `{"power":"ON"}`, `{"state":2}`, `{"state":null}`, `["ON"]`},
+		} {
+			d, err := GetDialect(dialect)
+			require.NoError(t, err)
+
+			for _, payload := range payloads {
+				_, err = d.Parse(payload)
+				require.Error(t, err, "%v %#+v", dialect, payload)
+			}
+		}
+	})
+
+	t.Run("PayloadFormat", func(t *testing.T) {
+		format, err := ParsePayloadFormat("on_off, boolean", "json")
+		require.NoError(t, err)
+		require.Equal(t, PayloadFormat{Accept: []Dialect{OnOff, Boolean}, Output: JSON}, format)
+
+		for payload, expected := range map[string]State{"ON": On, "false": Off, `{"state":"ON"}`: On} {
+			state, err := format.Parse(payload)
+			require.NoError(t, err, "%#+v", payload)
+			require.Equal(t, expected, state)
+		}
+
+		_, err = format.Parse("1")
+		require.Error(t, err)
+
+		_, err = ParsePayloadFormat("numeric,yaml", "numeric")
+		require.Error(t, err)
+
+		_, err = ParsePayloadFormat("numeric", "")
+		require.Error(t, err)
+	})
+
+	t.Run("Flags", func(t *testing.T) {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		getPayloadFormat := AddPayloadFormatFlags(flagSet)
+		require.NoError(t, flagSet.Parse([]string{}))
+
+		format, err := getPayloadFormat()
+		require.NoError(t, err)
+		require.Equal(t, DefaultPayloadFormat, format)
+
+		flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+		getPayloadFormat = AddPayloadFormatFlags(flagSet)
+		require.NoError(t, flagSet.Parse([]string{"-payloadAccept", "numeric,on_off,boolean,json", "-payloadOutput", "on_off"}))
+
+		format, err = getPayloadFormat()
+		require.NoError(t, err)
+		require.Equal(t, PayloadFormat{Accept: GetDialects(), Output: OnOff}, format)
+	})
+}
@@ -0,0 +1,357 @@
+package mqtt_action_router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+// InterlockPolicy is what happens when an action in an interlock group is asked to turn on while another member is on
+type InterlockPolicy int
+
+const (
+	InterlockReject        InterlockPolicy = iota // refuse the request
+	InterlockTurnOffOthers                        // turn the conflicting members off first
+	InterlockQueue                                // hold the request until the group is free
+)
+
+var interlockPolicyNames = map[InterlockPolicy]string{
+	InterlockReject:        "reject",
+	InterlockTurnOffOthers: "turn_off_others",
+	InterlockQueue:         "queue",
+}
+
+func (p InterlockPolicy) String() string {
+	name, ok := interlockPolicyNames[p]
+	if !ok {
+		return fmt.Sprintf("InterlockPolicy(%d)", int(p))
+	}
+
+	return name
+}
+
+func ParseInterlockPolicy(rawPolicy string) (InterlockPolicy, error) {
+	names := make([]string, 0)
+	for _, policy := range []InterlockPolicy{InterlockReject, InterlockTurnOffOthers, InterlockQueue} {
+		if strings.EqualFold(strings.TrimSpace(rawPolicy), policy.String()) {
+			return policy, nil
+		}
+
+		names = append(names, policy.String())
+	}
+
+	return InterlockReject, fmt.Errorf("unknown interlock policy %#+v; known policies are %v", rawPolicy, strings.Join(names, ", "))
+}
+
+// interlockStatus is what's published to the router's status topic when the interlock gets in the way of a request
+type interlockStatus struct {
+	SetTopic  string   `json:"set_topic"`
+	Group     string   `json:"group"`
+	Policy    string   `json:"policy"`
+	Outcome   string   `json:"outcome"` // rejected, queued or turned_off
+	Conflicts []string `json:"conflicts"`
+	Reason    string   `json:"reason"`
+}
+
+type interlockRequest struct {
+	action   *action
+	payload  string
+	duration time.Duration
+}
+
+type interlockGroup struct {
+	name          string
+	policy        InterlockPolicy
+	setTopics     map[string]bool
+	mu            sync.Mutex
+	members       []*action
+	activeWatches map[string]bool // get topics of things outside this router that are on
+	queue         []interlockRequest
+}
+
+func newInterlockGroup(name string, policy InterlockPolicy, setTopics []string) *interlockGroup {
+	g := &interlockGroup{
+		name:          name,
+		policy:        policy,
+		setTopics:     make(map[string]bool),
+		activeWatches: make(map[string]bool),
+	}
+
+	for _, setTopic := range setTopics {
+		g.setTopics[setTopic] = true
+	}
+
+	return g
+}
+
+// getConflicts must be called with the lock held; it returns the other members that are on and the get topics of the
+// watched things that are on
+func (g *interlockGroup) getConflicts(a *action) ([]*action, []string) {
+	actions := make([]*action, 0)
+	for _, member := range g.members {
+		if member == a {
+			continue
+		}
+
+		if member.getLastPayload() == getStatePayload(On) {
+			actions = append(actions, member)
+		}
+	}
+
+	watches := make([]string, 0)
+	for getTopic, active := range g.activeWatches {
+		if active {
+			watches = append(watches, getTopic)
+		}
+	}
+
+	sort.Strings(watches)
+
+	return actions, watches
+}
+
+// enqueue must be called with the lock held; a request from an action that's already waiting replaces its old one
+func (g *interlockGroup) enqueue(request interlockRequest) {
+	for i, queuedRequest := range g.queue {
+		if queuedRequest.action == request.action {
+			g.queue[i] = request
+			return
+		}
+	}
+
+	g.queue = append(g.queue, request)
+}
+
+// dequeue forgets any request a is waiting on
+func (g *interlockGroup) dequeue(a *action) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	queue := make([]interlockRequest, 0, len(g.queue))
+	for _, queuedRequest := range g.queue {
+		if queuedRequest.action != a {
+			queue = append(queue, queuedRequest)
+		}
+	}
+
+	g.queue = queue
+}
+
+func (g *interlockGroup) clearQueue() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.queue = nil
+}
+
+// release starts the request at the head of the queue if nothing's in its way any more; it's called (in a goroutine)
+// whenever a member or a watched thing turns off
+func (g *interlockGroup) release() {
+	g.mu.Lock()
+	if len(g.queue) == 0 {
+		g.mu.Unlock()
+		return
+	}
+
+	next := g.queue[0]
+
+	actions, watches := g.getConflicts(next.action)
+	if len(actions) > 0 || len(watches) > 0 {
+		g.mu.Unlock()
+		return
+	}
+
+	g.queue = g.queue[1:]
+	g.mu.Unlock()
+
+	log.Printf("interlock group %v is free; starting queued request for %v", g.name, next.action.setTopic)
+
+	// if something else got in first, this just goes back in the queue
+	err := next.action.request(next.payload, next.duration)
+	if err != nil {
+		log.Printf("queued request for %v caused %v", next.action.setTopic, err)
+	}
+}
+
+func (g *interlockGroup) watchCallback(isActive func(payload string) (bool, error)) func(mqtt.Message) {
+	return func(message mqtt.Message) {
+		active, err := isActive(message.Payload)
+		if err != nil {
+			log.Printf("ignoring %+v on %v because: %v", message.Payload, message.Topic, err)
+			return
+		}
+
+		g.mu.Lock()
+		g.activeWatches[message.Topic] = active
+		g.mu.Unlock()
+
+		if !active {
+			go g.release()
+		}
+	}
+}
+
+// publishInterlockStatus explains to the status topic (if there is one) why a didn't just do as it was asked
+func (a *action) publishInterlockStatus(g *interlockGroup, outcome string, actions []*action, watches []string) {
+	conflicts := append([]string{}, watches...)
+	for _, conflictingAction := range actions {
+		conflicts = append(conflicts, conflictingAction.setTopic)
+	}
+
+	reason := fmt.Sprintf("%v can't turn on while %v is on (interlock group %v)", a.setTopic, strings.Join(conflicts, " / "), g.name)
+	if outcome == "turned_off" {
+		reason = fmt.Sprintf("turning off %v so that %v can turn on (interlock group %v)", strings.Join(conflicts, " / "), a.setTopic, g.name)
+	}
+
+	status := interlockStatus{
+		SetTopic:  a.setTopic,
+		Group:     g.name,
+		Policy:    g.policy.String(),
+		Outcome:   outcome,
+		Conflicts: conflicts,
+		Reason:    reason,
+	}
+
+	log.Printf("interlock %v for %v; %v", outcome, a.setTopic, reason)
+
+	if a.statusTopic == "" || !a.isLeader() {
+		return
+	}
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("warning: failed to serialize %+v because: %v", status, err)
+		return
+	}
+
+	err = a.client.Publish(a.statusTopic, mqtt.ExactlyOnce, false, string(payload))
+	if err != nil {
+		log.Printf("warning: failed to publish %v to %v because: %v", string(payload), a.statusTopic, err)
+	}
+}
+
+// start actuates (canonical) payload, for duration if it's not 0; anything not timed cancels a running timer
+func (a *action) start(payload string, duration time.Duration) error {
+	if duration > 0 {
+		return a.actuateFor(payload, duration)
+	}
+
+	a.disarm(false)
+
+	return a.actuate(payload)
+}
+
+// request is start by way of the interlock groups (if any); only turning on can conflict with anything
+func (a *action) request(payload string, duration time.Duration) error {
+	if len(a.interlocks) == 0 {
+		return a.start(payload, duration)
+	}
+
+	if payload != getStatePayload(On) {
+		for _, g := range a.interlocks {
+			g.dequeue(a)
+		}
+
+		return a.start(payload, duration)
+	}
+
+	// the groups stay locked until we're on so that two requests can't both find the group free (they're sorted by
+	// name, so there's no lock ordering problem for actions in more than one group)
+	for _, g := range a.interlocks {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+	}
+
+	toTurnOff := make([]*action, 0)
+	groupByAction := make(map[*action]*interlockGroup)
+
+	for _, g := range a.interlocks {
+		actions, watches := g.getConflicts(a)
+		if len(actions) == 0 && len(watches) == 0 {
+			continue
+		}
+
+		switch g.policy {
+		case InterlockQueue:
+			g.enqueue(interlockRequest{action: a, payload: payload, duration: duration})
+			a.publishInterlockStatus(g, "queued", actions, watches)
+			return nil
+		case InterlockTurnOffOthers:
+			// we can only turn off what we're in charge of
+			if len(watches) == 0 {
+				for _, conflictingAction := range actions {
+					if groupByAction[conflictingAction] == nil {
+						groupByAction[conflictingAction] = g
+						toTurnOff = append(toTurnOff, conflictingAction)
+					}
+				}
+
+				continue
+			}
+		}
+
+		a.publishInterlockStatus(g, "rejected", actions, watches)
+		return fmt.Errorf("%v rejected by interlock group %v", a.setTopic, g.name)
+	}
+
+	for _, conflictingAction := range toTurnOff {
+		a.publishInterlockStatus(groupByAction[conflictingAction], "turned_off", []*action{conflictingAction}, nil)
+
+		conflictingAction.disarm(false)
+
+		err := conflictingAction.actuate(getStatePayload(Off))
+		if err != nil {
+			return fmt.Errorf("failed to turn off %v for %v because: %v", conflictingAction.setTopic, a.setTopic, err)
+		}
+	}
+
+	return a.start(payload, duration)
+}
+
+// adoptOn is reconcile's adopt for an action in interlock groups that's been turned on behind our back; it's only
+// adopted if nothing else in the groups is on, otherwise it lost and is turned back off
+func (a *action) adoptOn(desiredPayload string) (bool, error) {
+	for _, g := range a.interlocks {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+	}
+
+	for _, g := range a.interlocks {
+		actions, watches := g.getConflicts(a)
+		if len(actions) == 0 && len(watches) == 0 {
+			continue
+		}
+
+		a.publishInterlockStatus(g, "rejected", actions, watches)
+
+		a.disarm(false)
+
+		err := a.actuate(getStatePayload(Off))
+		if err != nil {
+			return false, fmt.Errorf("failed to turn %v back off because: %v", a.setTopic, err)
+		}
+
+		return false, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// something was actuated while the action was unlocked, so what was read is stale
+	if a.getLastPayload() != desiredPayload {
+		return false, nil
+	}
+
+	err := a.publishState(getStatePayload(On))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,227 @@
+package mqtt_action_router
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+func TestInterlock(t *testing.T) {
+	setup := func(t *testing.T, policy InterlockPolicy) (*mqtttest.Broker, *Router, *recorder) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		r := New(c, time.Millisecond, false)
+		require.NoError(t, r.SetStatusTopic("test/sprinklers/status"))
+		require.NoError(t, r.AddInterlockGroup("water", policy, "test/sprinklers/bank/1/state/set", "test/sprinklers/bank/2/state/set"))
+
+		rec := &recorder{}
+		for _, bank := range []string{"1", "2"} {
+			require.NoError(t, r.AddAction("test/sprinklers/bank/"+bank+"/state/set", bank, rec.on, rec.off, Off, "test/sprinklers/bank/"+bank+"/state/get"))
+		}
+
+		return b, r, rec
+	}
+
+	getStatuses := func(b *mqtttest.Broker) []interlockStatus {
+		statuses := make([]interlockStatus, 0)
+		for _, publishedMessage := range b.PublishedTo("test/sprinklers/status") {
+			status := interlockStatus{}
+			if json.Unmarshal([]byte(publishedMessage.Payload), &status) == nil {
+				statuses = append(statuses, status)
+			}
+		}
+
+		return statuses
+	}
+
+	t.Run("ParseInterlockPolicy", func(t *testing.T) {
+		for rawPolicy, expected := range map[string]InterlockPolicy{
+			"reject":          InterlockReject,
+			"Turn_Off_Others": InterlockTurnOffOthers,
+			" queue ":         InterlockQueue,
+		} {
+			policy, err := ParseInterlockPolicy(rawPolicy)
+			require.NoError(t, err)
+			require.Equal(t, expected, policy)
+		}
+
+		_, err := ParseInterlockPolicy("banana")
+		require.Error(t, err)
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		b, _, rec := setup(t, InterlockReject)
+
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "1")
+		b.Inject("test/sprinklers/bank/2/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)"}, rec.getCalls())
+
+		statuses := getStatuses(b)
+		require.Len(t, statuses, 1)
+		require.Equal(t, "test/sprinklers/bank/2/state/set", statuses[0].SetTopic)
+		require.Equal(t, "water", statuses[0].Group)
+		require.Equal(t, "rejected", statuses[0].Outcome)
+		require.Equal(t, []string{"test/sprinklers/bank/1/state/set"}, statuses[0].Conflicts)
+		require.NotEmpty(t, statuses[0].Reason)
+
+		// turning off is never in the way, and once bank 1 is off bank 2 is free
+		b.Inject("test/sprinklers/bank/2/state/set", mqtt.ExactlyOnce, false, "0")
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "0")
+		b.Inject("test/sprinklers/bank/2/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)", "off(2)", "off(1)", "on(2)"}, rec.getCalls())
+	})
+
+	t.Run("TurnOffOthers", func(t *testing.T) {
+		b, _, rec := setup(t, InterlockTurnOffOthers)
+
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "1")
+		b.Inject("test/sprinklers/bank/2/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)", "off(1)", "on(2)"}, rec.getCalls())
+		b.RequireRetained(t, "test/sprinklers/bank/1/state/get", "0")
+		b.RequireRetained(t, "test/sprinklers/bank/2/state/get", "1")
+
+		statuses := getStatuses(b)
+		require.Len(t, statuses, 1)
+		require.Equal(t, "turned_off", statuses[0].Outcome)
+		require.Equal(t, []string{"test/sprinklers/bank/1/state/set"}, statuses[0].Conflicts)
+	})
+
+	t.Run("Queue", func(t *testing.T) {
+		b, _, rec := setup(t, InterlockQueue)
+
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "1")
+		b.Inject("test/sprinklers/bank/2/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)"}, rec.getCalls())
+		require.Equal(t, "queued", getStatuses(b)[0].Outcome)
+
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "0")
+		require.Eventually(t, func() bool { return len(rec.getCalls()) == 5 }, time.Second, time.Millisecond*10)
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)", "off(1)", "on(2)"}, rec.getCalls())
+		b.RequireRetained(t, "test/sprinklers/bank/2/state/get", "1")
+
+		// turning off something that's waiting takes it out of the queue
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "1")
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "0")
+		b.Inject("test/sprinklers/bank/2/state/set", mqtt.ExactlyOnce, false, "0")
+		time.Sleep(time.Millisecond * 100)
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)", "off(1)", "on(2)", "off(1)", "off(2)"}, rec.getCalls())
+	})
+
+	t.Run("QueueWithTimedActions", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		r := New(c, time.Millisecond, true)
+		require.NoError(t, r.EnableTimedActions(TimedActionOptions{}))
+		require.NoError(t, r.AddInterlockGroup("water", InterlockQueue, "test/sprinklers/bank/1/state/set", "test/sprinklers/bank/2/state/set"))
+
+		rec := &recorder{}
+		require.NoError(t, r.AddAction("test/sprinklers/bank/1/state/set", "1", rec.on, rec.off, Off, "test/sprinklers/bank/1/state/get"))
+		require.NoError(t, r.AddAction("test/sprinklers/bank/2/state/set", "2", rec.on, rec.off, Off, "test/sprinklers/bank/2/state/get"))
+
+		// bank 2 runs for its full duration once bank 1's time is up
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "1:0.1")
+		b.Inject("test/sprinklers/bank/2/state/duration/set", mqtt.ExactlyOnce, false, "0.1")
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)"}, rec.getCalls())
+
+		require.Eventually(t, func() bool { return len(rec.getCalls()) == 6 }, time.Second, time.Millisecond*10)
+		require.Equal(t, []string{"off(1)", "off(2)", "on(1)", "off(1)", "on(2)", "off(2)"}, rec.getCalls())
+	})
+
+	t.Run("TimedRevertRespectsInterlock", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		r := New(c, time.Millisecond, true)
+		require.NoError(t, r.SetStatusTopic("test/sprinklers/status"))
+		require.NoError(t, r.EnableTimedActions(TimedActionOptions{}))
+		require.NoError(t, r.AddInterlockGroup("water", InterlockReject, "test/sprinklers/bank/1/state/set", "test/sprinklers/bank/2/state/set"))
+
+		rec := &recorder{}
+		require.NoError(t, r.AddAction("test/sprinklers/bank/1/state/set", "1", rec.on, rec.off, Off, "test/sprinklers/bank/1/state/get"))
+		require.NoError(t, r.AddAction("test/sprinklers/bank/2/state/set", "2", rec.on, rec.off, On, "test/sprinklers/bank/2/state/get"))
+
+		// bank 2 is off for a bit, and bank 1 takes its chance
+		b.Inject("test/sprinklers/bank/2/state/set", mqtt.ExactlyOnce, false, "0:0.1")
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(1)", "on(2)", "off(2)", "on(1)"}, rec.getCalls())
+
+		// so bank 2 can't go back to on when its time is up
+		require.Eventually(t, func() bool { return len(getStatuses(b)) == 1 }, time.Second, time.Millisecond*10)
+		require.Equal(t, "rejected", getStatuses(b)[0].Outcome)
+		require.Equal(t, "test/sprinklers/bank/2/state/set", getStatuses(b)[0].SetTopic)
+		require.Equal(t, []string{"off(1)", "on(2)", "off(2)", "on(1)"}, rec.getCalls())
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		r := New(c, time.Millisecond, false)
+		require.NoError(t, r.AddInterlockGroup("heating", InterlockTurnOffOthers, "test/heater/state/set"))
+		require.NoError(t, r.AddInterlockWatch("heating", "test/aircons/+/state/get", PayloadFormat{Accept: GetDialects(), Output: Numeric}))
+		require.Error(t, r.AddInterlockWatch("cooling", "test/aircons/+/state/get", DefaultPayloadFormat))
+
+		rec := &recorder{}
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+
+		// an aircon can't be turned off from here, so it's in the way regardless
+		b.Inject("test/aircons/lounge/state/get", mqtt.ExactlyOnce, true, "ON")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(<nil>)"}, rec.getCalls())
+
+		b.Inject("test/aircons/lounge/state/get", mqtt.ExactlyOnce, true, "OFF")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)"}, rec.getCalls())
+	})
+
+	t.Run("WatchFunc", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		r := New(c, time.Millisecond, false)
+		require.NoError(t, r.AddInterlockGroup("heating", InterlockReject, "test/heater/state/set"))
+		require.NoError(t, r.AddInterlockWatchFunc("heating", "test/aircons/+/mode/get", func(payload string) (bool, error) {
+			return payload == "heat", nil
+		}))
+
+		rec := &recorder{}
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+
+		// cooling isn't in the heater's way
+		b.Inject("test/aircons/lounge/mode/get", mqtt.ExactlyOnce, true, "cool")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)"}, rec.getCalls())
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "0")
+		b.Inject("test/aircons/lounge/mode/get", mqtt.ExactlyOnce, true, "heat")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)", "off(<nil>)"}, rec.getCalls())
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		b, r, _ := setup(t, InterlockReject)
+
+		require.Error(t, r.AddInterlockGroup("power", InterlockReject, "test/sprinklers/bank/3/state/set"))
+		require.Error(t, r.SetStatusTopic("test/sprinklers/other_status"))
+
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		r = New(c, time.Millisecond, true)
+		require.NoError(t, r.AddInterlockGroup("fans", InterlockReject, "test/fan/speed/set"))
+		require.Error(t, r.AddInterlockGroup("fans", InterlockQueue))
+		require.Error(t, r.AddValueAction("test/fan/speed/set", nil, Enum("low", "high"), func(interface{}, interface{}) error { return nil }, "low", "test/fan/speed/get"))
+	})
+}
@@ -0,0 +1,255 @@
+package mqtt_action_router
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const DefaultReconcileInterval = time.Second
+
+// ReconcileMode is what to do when what's read from a thing isn't what the router last actuated it to
+type ReconcileMode int
+
+const (
+	ReconcileAdopt    ReconcileMode = iota // the thing is right (e.g. someone pushed its button); publish what it says
+	ReconcileReassert                      // the router is right; actuate it back
+)
+
+var reconcileModeNames = map[ReconcileMode]string{
+	ReconcileAdopt:    "adopt",
+	ReconcileReassert: "reassert",
+}
+
+func (m ReconcileMode) String() string {
+	name, ok := reconcileModeNames[m]
+	if !ok {
+		return fmt.Sprintf("ReconcileMode(%d)", int(m))
+	}
+
+	return name
+}
+
+func ParseReconcileMode(rawMode string) (ReconcileMode, error) {
+	names := make([]string, 0)
+	for _, mode := range []ReconcileMode{ReconcileAdopt, ReconcileReassert} {
+		if strings.EqualFold(strings.TrimSpace(rawMode), mode.String()) {
+			return mode, nil
+		}
+
+		names = append(names, mode.String())
+	}
+
+	return ReconcileAdopt, fmt.Errorf("unknown reconcile mode %#+v; known modes are %v", rawMode, strings.Join(names, ", "))
+}
+
+type ReconcileOptions struct {
+	Interval time.Duration // how often to read; 0 means DefaultReconcileInterval
+	Mode     ReconcileMode
+}
+
+// AddReconcileFlags adds -reconcileInterval and -reconcileMode to flagSet; call the returned func after parsing
+func AddReconcileFlags(flagSet *flag.FlagSet) func() (ReconcileOptions, error) {
+	intervalPtr := flagSet.Duration("reconcileInterval", DefaultReconcileInterval, "how often to read the actual state of things")
+	modePtr := flagSet.String("reconcileMode", ReconcileAdopt.String(), "what to do when the actual state of a thing has drifted; adopt (publish it) or reassert (actuate it back)")
+
+	return func() (ReconcileOptions, error) {
+		mode, err := ParseReconcileMode(*modePtr)
+		if err != nil {
+			return ReconcileOptions{}, err
+		}
+
+		return ReconcileOptions{
+			Interval: *intervalPtr,
+			Mode:     mode,
+		}, nil
+	}
+}
+
+type reconciler struct {
+	read       func(arguments interface{}) (interface{}, error)
+	options    ReconcileOptions
+	stop       chan struct{}
+	driftCount uint64 // guarded by the action's stateMutex
+}
+
+// reconcile reads the thing and deals with any drift from the last state we actuated it to
+func (a *action) reconcile() {
+	if !a.isLeader() {
+		return
+	}
+
+	a.stateMutex.Lock()
+	r := a.reconciler
+	a.stateMutex.Unlock()
+
+	a.mutex.Lock()
+
+	observed, err := r.read(a.arguments)
+	if err != nil {
+		a.mutex.Unlock()
+		log.Printf("warning: failed to read %v because: %v", a.setTopic, err)
+		return
+	}
+
+	// the read func can return anything that formats as a payload the spec understands (e.g. a client's own State)
+	rawObserved := fmt.Sprintf("%v", observed)
+
+	// a binary thing that can't say what it's doing (i.e. Unknown) hasn't drifted, we just haven't seen it
+	if a.format != nil && rawObserved == fmt.Sprintf("%v", Unknown) {
+		a.mutex.Unlock()
+		return
+	}
+
+	_, observedPayload, err := a.spec.Parse(rawObserved)
+	if err != nil {
+		a.mutex.Unlock()
+		log.Printf("warning: ignoring %#+v read from %v because: %v", observed, a.setTopic, err)
+		return
+	}
+
+	desiredPayload := a.getLastPayload()
+	if observedPayload == desiredPayload {
+		a.mutex.Unlock()
+		return
+	}
+
+	a.stateMutex.Lock()
+	r.driftCount++
+	driftCount := r.driftCount
+	a.stateMutex.Unlock()
+
+	// with nothing to put back (i.e. the base state is Unknown and nothing's been asked for yet) all we can do is adopt
+	if r.options.Mode == ReconcileAdopt || desiredPayload == "" {
+		log.Printf("%v drifted from %#+v to %#+v (%v times now); adopting", a.setTopic, desiredPayload, observedPayload, driftCount)
+
+		// turning on behind our back has to get past the interlock groups too (and they're locked before the action)
+		if observedPayload == getStatePayload(On) && len(a.interlocks) > 0 {
+			a.mutex.Unlock()
+
+			adopted, err := a.adoptOn(desiredPayload)
+			if err != nil {
+				log.Printf("warning: failed to adopt %#+v for %v because: %v", observedPayload, a.setTopic, err)
+				return
+			}
+
+			if adopted {
+				a.disarm(false)
+			}
+
+			return
+		}
+
+		err = a.publishState(observedPayload)
+		a.mutex.Unlock()
+		if err != nil {
+			log.Printf("warning: failed to adopt %#+v for %v because: %v", observedPayload, a.setTopic, err)
+			return
+		}
+
+		// whoever changed it overrides a timer, like a plain set would
+		a.disarm(false)
+
+		return
+	}
+
+	a.mutex.Unlock()
+
+	log.Printf("%v drifted from %#+v to %#+v (%v times now); reasserting", a.setTopic, desiredPayload, observedPayload, driftCount)
+
+	err = a.actuate(desiredPayload)
+	if err != nil {
+		log.Printf("warning: failed to reassert %#+v for %v because: %v", desiredPayload, a.setTopic, err)
+	}
+}
+
+// publishState must be called with the action lock held; it's the publish half of actuate (without the retries)
+func (a *action) publishState(payload string) error {
+	outgoingPayload, err := a.encode(payload)
+	if err != nil {
+		return err
+	}
+
+	token := a.getToken()
+
+	err = a.checkToken(token)
+	if err != nil {
+		return err
+	}
+
+	err = a.publishGet(outgoingPayload, token)
+	if err != nil {
+		return err
+	}
+
+	a.noteState(payload)
+
+	return nil
+}
+
+func (a *action) runReconciler(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		a.reconcile()
+	}
+}
+
+func (a *action) startReconciler(read func(arguments interface{}) (interface{}, error), options ReconcileOptions) error {
+	if options.Interval <= 0 {
+		options.Interval = DefaultReconcileInterval
+	}
+
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	if a.reconciler != nil {
+		return fmt.Errorf("%v already being reconciled", a.setTopic)
+	}
+
+	stop := make(chan struct{})
+
+	a.reconciler = &reconciler{
+		read:    read,
+		options: options,
+		stop:    stop,
+	}
+
+	log.Printf("reconciling %v every %v by way of %v", a.setTopic, options.Interval, options.Mode)
+
+	go a.runReconciler(stop, options.Interval)
+
+	return nil
+}
+
+func (a *action) stopReconciler() {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	if a.reconciler == nil || a.reconciler.stop == nil {
+		return
+	}
+
+	close(a.reconciler.stop)
+	a.reconciler.stop = nil
+}
+
+func (a *action) getDriftCount() uint64 {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	if a.reconciler == nil {
+		return 0
+	}
+
+	return a.reconciler.driftCount
+}
@@ -0,0 +1,249 @@
+package mqtt_action_router
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+// thing is something with a button on it, so its state can change without the router knowing
+type thing struct {
+	mu      sync.Mutex
+	state   interface{}
+	readErr error
+	reads   int
+}
+
+func (t *thing) set(state interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.state = state
+}
+
+func (t *thing) on(interface{}) error {
+	t.set(On)
+	return nil
+}
+
+func (t *thing) off(interface{}) error {
+	t.set(Off)
+	return nil
+}
+
+func (t *thing) read(interface{}) (interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.reads++
+
+	return t.state, t.readErr
+}
+
+func (t *thing) getReads() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.reads
+}
+
+func TestReconcile(t *testing.T) {
+	setup := func(t *testing.T) (*mqtttest.Broker, *Router) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		return b, New(c, time.Millisecond, true)
+	}
+
+	interval := time.Millisecond * 20
+
+	t.Run("ParseReconcileMode", func(t *testing.T) {
+		mode, err := ParseReconcileMode("Reassert")
+		require.NoError(t, err)
+		require.Equal(t, ReconcileReassert, mode)
+
+		_, err = ParseReconcileMode("banana")
+		require.Error(t, err)
+	})
+
+	t.Run("Adopt", func(t *testing.T) {
+		b, r := setup(t)
+		r.SetPayloadFormat(PayloadFormat{Accept: []Dialect{Numeric}, Output: OnOff})
+
+		th := &thing{}
+		require.NoError(t, r.AddAction("test/plug/state/set", nil, th.on, th.off, Off, "test/plug/state/get"))
+		require.NoError(t, r.Reconcile("test/plug/state/set", th.read, ReconcileOptions{Interval: interval, Mode: ReconcileAdopt}))
+		require.Error(t, r.Reconcile("test/plug/state/set", th.read, ReconcileOptions{}))
+		require.Error(t, r.Reconcile("test/other/state/set", th.read, ReconcileOptions{}))
+
+		// nothing's drifted, so nothing's published
+		require.Eventually(t, func() bool { return th.getReads() >= 2 }, time.Second, time.Millisecond*10)
+		b.RequirePublishedSequence(t, "test/plug/state/get", "OFF")
+		require.Equal(t, uint64(0), r.GetDriftCounts()["test/plug/state/set"])
+
+		// someone pushed the button
+		th.set(On)
+		require.Eventually(t, func() bool {
+			publishedMessage, ok := b.Retained("test/plug/state/get")
+			return ok && publishedMessage.Payload == "ON"
+		}, time.Second, time.Millisecond*10)
+		require.Equal(t, uint64(1), r.GetDriftCounts()["test/plug/state/set"])
+
+		// and a set to what it's been adopted as is fine
+		b.Inject("test/plug/state/set", mqtt.ExactlyOnce, false, "0")
+		b.RequireRetained(t, "test/plug/state/get", "OFF")
+	})
+
+	t.Run("AdoptRespectsInterlock", func(t *testing.T) {
+		b, r := setup(t)
+		require.NoError(t, r.SetStatusTopic("test/sprinklers/status"))
+		require.NoError(t, r.AddInterlockGroup("water", InterlockTurnOffOthers, "test/sprinklers/bank/1/state/set", "test/sprinklers/bank/2/state/set"))
+
+		th1, th2 := &thing{}, &thing{}
+		require.NoError(t, r.AddAction("test/sprinklers/bank/1/state/set", nil, th1.on, th1.off, Off, "test/sprinklers/bank/1/state/get"))
+		require.NoError(t, r.AddAction("test/sprinklers/bank/2/state/set", nil, th2.on, th2.off, Off, "test/sprinklers/bank/2/state/get"))
+		require.NoError(t, r.Reconcile("test/sprinklers/bank/2/state/set", th2.read, ReconcileOptions{Interval: interval, Mode: ReconcileAdopt}))
+
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "1")
+
+		// someone turned bank 2 on at the tap while bank 1 was running, so it's turned back off rather than adopted
+		th2.set(On)
+		require.Eventually(t, func() bool { return r.GetDriftCounts()["test/sprinklers/bank/2/state/set"] >= 1 }, time.Second, time.Millisecond*10)
+		require.Eventually(t, func() bool {
+			th2.mu.Lock()
+			defer th2.mu.Unlock()
+
+			return th2.state == Off
+		}, time.Second, time.Millisecond*10)
+		b.RequireRetained(t, "test/sprinklers/bank/2/state/get", "0")
+		b.RequireRetained(t, "test/sprinklers/bank/1/state/get", "1")
+		publishedMessage, ok := b.LastPublishedTo("test/sprinklers/status")
+		require.True(t, ok)
+		require.Contains(t, publishedMessage.Payload, `"outcome":"rejected"`)
+
+		// but with bank 1 off, it's adopted
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "0")
+		th2.set(On)
+		require.Eventually(t, func() bool {
+			publishedMessage, ok := b.Retained("test/sprinklers/bank/2/state/get")
+			return ok && publishedMessage.Payload == "1"
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("Reassert", func(t *testing.T) {
+		b, r := setup(t)
+
+		th := &thing{}
+		require.NoError(t, r.AddAction("test/plug/state/set", nil, th.on, th.off, Off, "test/plug/state/get"))
+		b.Inject("test/plug/state/set", mqtt.ExactlyOnce, false, "1")
+		require.NoError(t, r.Reconcile("test/plug/state/set", th.read, ReconcileOptions{Interval: interval, Mode: ReconcileReassert}))
+
+		th.set(Off)
+		require.Eventually(t, func() bool { return r.GetDriftCounts()["test/plug/state/set"] == 1 }, time.Second, time.Millisecond*10)
+		require.Eventually(t, func() bool {
+			th.mu.Lock()
+			defer th.mu.Unlock()
+
+			return th.state == On
+		}, time.Second, time.Millisecond*10)
+		b.RequirePublishedSequence(t, "test/plug/state/get", "0", "1", "1")
+	})
+
+	t.Run("UnknownBaseStateIsAdopted", func(t *testing.T) {
+		b, r := setup(t)
+
+		th := &thing{state: 1}
+		require.NoError(t, r.AddAction("test/aircon/state/set", nil, th.on, th.off, Unknown, "test/aircon/state/get"))
+		require.NoError(t, r.Reconcile("test/aircon/state/set", th.read, ReconcileOptions{Interval: interval, Mode: ReconcileReassert}))
+
+		require.Eventually(t, func() bool {
+			publishedMessage, ok := b.Retained("test/aircon/state/get")
+			return ok && publishedMessage.Payload == "1"
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("ReadErrorsAndUnknownStatesIgnored", func(t *testing.T) {
+		b, r := setup(t)
+
+		th := &thing{state: -1}
+		require.NoError(t, r.AddAction("test/plug/state/set", nil, th.on, th.off, Unknown, "test/plug/state/get"))
+		require.NoError(t, r.Reconcile("test/plug/state/set", th.read, ReconcileOptions{Interval: interval}))
+		require.Eventually(t, func() bool { return th.getReads() >= 2 }, time.Second, time.Millisecond*10)
+
+		th.mu.Lock()
+		th.state = 1
+		th.readErr = fmt.Errorf("some error")
+		th.mu.Unlock()
+
+		reads := th.getReads()
+		require.Eventually(t, func() bool { return th.getReads() >= reads+2 }, time.Second, time.Millisecond*10)
+
+		b.RequireNotPublished(t, "test/plug/state/get")
+		require.Equal(t, uint64(0), r.GetDriftCounts()["test/plug/state/set"])
+	})
+
+	t.Run("UnknownIsOnlySpecialForBinaryActions", func(t *testing.T) {
+		b, r := setup(t)
+
+		th := &thing{state: -1}
+		require.NoError(t, r.AddValueAction("test/thermostat/offset/set", nil, IntegerRange(-5, 5), func(interface{}, interface{}) error { return nil }, "0", "test/thermostat/offset/get"))
+		require.NoError(t, r.Reconcile("test/thermostat/offset/set", th.read, ReconcileOptions{Interval: interval}))
+
+		b.WaitForPublished(t, "test/thermostat/offset/get", "-1", time.Second)
+	})
+
+	t.Run("ValueAction", func(t *testing.T) {
+		b, r := setup(t)
+
+		th := &thing{state: "low"}
+		require.NoError(t, r.AddValueAction("test/fan/speed/set", nil, Enum("low", "high"), func(_ interface{}, value interface{}) error {
+			th.set(value)
+			return nil
+		}, "low", "test/fan/speed/get"))
+		require.NoError(t, r.Reconcile("test/fan/speed/set", th.read, ReconcileOptions{Interval: interval}))
+
+		th.set("high")
+		require.Eventually(t, func() bool {
+			publishedMessage, ok := b.Retained("test/fan/speed/get")
+			return ok && publishedMessage.Payload == "high"
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("OnlyWhileLeader", func(t *testing.T) {
+		b, r := setup(t)
+
+		leadership := &fakeLeadership{}
+		require.NoError(t, r.SetLeadership(leadership))
+
+		th := &thing{state: On}
+		require.NoError(t, r.AddAction("test/plug/state/set", nil, th.on, th.off, Off, "test/plug/state/get"))
+		require.NoError(t, r.Reconcile("test/plug/state/set", th.read, ReconcileOptions{Interval: interval}))
+
+		time.Sleep(interval * 3)
+		require.Equal(t, 0, th.getReads())
+		b.RequireNotPublished(t, "test/plug/state/get")
+	})
+
+	t.Run("StopsOnTeardown", func(t *testing.T) {
+		_, r := setup(t)
+
+		th := &thing{}
+		require.NoError(t, r.AddAction("test/plug/state/set", nil, th.on, th.off, Off, "test/plug/state/get"))
+		require.NoError(t, r.Reconcile("test/plug/state/set", th.read, ReconcileOptions{Interval: interval}))
+		require.Eventually(t, func() bool { return th.getReads() >= 1 }, time.Second, time.Millisecond*10)
+
+		require.NoError(t, r.RemoveAllActions())
+		time.Sleep(interval)
+
+		reads := th.getReads()
+		time.Sleep(interval * 3)
+		require.Equal(t, reads, th.getReads())
+	})
+}
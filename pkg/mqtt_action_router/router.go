@@ -3,10 +3,12 @@ package mqtt_action_router
 import (
 	"fmt"
 	"log"
-	"strconv"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/initialed85/mqtt_things/pkg/leader_election"
 	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
 )
 
@@ -18,41 +20,79 @@ const (
 	On      State = 1
 )
 
+// Leadership is satisfied by (e.g.) *leader_election.Elector
+type Leadership interface {
+	IsLeader() bool
+	Token() uint64 // fencing token; 0 unless leading
+	AddObserver(observer func(leading bool)) func()
+}
+
 type action struct {
-	setTopic  string
-	arguments interface{}
-	on        func(interface{}) error
-	off       func(interface{}) error
-	baseState State
-	debounce  time.Duration
-	client    mqtt.Client
-	getTopic  string
-	mutex     sync.Mutex
-}
-
-func parseBinaryState(payload string) (State, error) {
-	state, err := strconv.ParseInt(payload, 10, 64)
-	if err != nil {
-		return Unknown, err
-	}
+	setTopic    string
+	arguments   interface{}
+	spec        ValueSpec
+	apply       func(arguments interface{}, value interface{}) error
+	basePayload string
+	format      *PayloadFormat // nil for anything but binary actions
+	timer       *timer         // nil unless timed actions are enabled (and only for binary actions)
+	interlocks  []*interlockGroup
+	statusTopic string
+	reconciler  *reconciler // nil unless Router.Reconcile has been called; guarded by stateMutex
+	debounce    time.Duration
+	client      mqtt.Client
+	getTopic    string
+	leadership  Leadership
+	fence       leader_election.Fence // the highest fencing token seen on the get topic
+	mutex       sync.Mutex
+	serialMutex *sync.Mutex // the router's actionsMutex, unless concurrent actions are allowed
+	stateMutex  sync.Mutex
+	lastPayload string
+}
 
-	if state != 0 && state != 1 {
-		return Unknown, fmt.Errorf("failed to parse payload of %v to binary state", payload)
+// getStatePayload is "" (i.e. leave it alone) for Unknown
+func getStatePayload(state State) string {
+	if state == Unknown {
+		return ""
 	}
 
-	return State(state), nil
+	return fmt.Sprintf("%v", state)
+}
+
+// getBinaryApply adapts the on / off funcs of a binary action to an apply func
+func getBinaryApply(on func(interface{}) error, off func(interface{}) error) func(interface{}, interface{}) error {
+	return func(arguments interface{}, value interface{}) error {
+		if value == int64(On) {
+			return on(arguments)
+		}
+
+		return off(arguments)
+	}
 }
 
-func newAction(setTopic string, arguments interface{}, on func(interface{}) error, off func(interface{}) error, debounce time.Duration, client mqtt.Client, baseState State, getTopic string) *action {
+func newAction(setTopic string, arguments interface{}, spec ValueSpec, apply func(interface{}, interface{}) error, format *PayloadFormat, debounce time.Duration, client mqtt.Client, basePayload string, getTopic string, leadership Leadership) (*action, error) {
+	err := spec.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if basePayload != "" {
+		_, basePayload, err = spec.Parse(basePayload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base value for %v because: %v", setTopic, err)
+		}
+	}
+
 	action := &action{
-		setTopic:  setTopic,
-		arguments: arguments,
-		on:        on,
-		off:       off,
-		baseState: baseState,
-		debounce:  debounce,
-		client:    client,
-		getTopic:  getTopic,
+		setTopic:    setTopic,
+		arguments:   arguments,
+		spec:        spec,
+		apply:       apply,
+		basePayload: basePayload,
+		format:      format,
+		debounce:    debounce,
+		client:      client,
+		getTopic:    getTopic,
+		leadership:  leadership,
 	}
 
 	if setTopic == getTopic {
@@ -61,39 +101,154 @@ func newAction(setTopic string, arguments interface{}, on func(interface{}) erro
 
 	log.Printf("created action %+v", action)
 
-	return action
+	return action, nil
+}
+
+// decode turns a payload in any accepted dialect into a canonical one (i.e. "0" / "1" for a binary action)
+func (a *action) decode(payload string) (string, error) {
+	if a.format == nil {
+		return payload, nil
+	}
+
+	state, err := a.format.Parse(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return getStatePayload(state), nil
+}
+
+// encode turns a canonical payload into the output dialect
+func (a *action) encode(payload string) (string, error) {
+	if a.format == nil {
+		return payload, nil
+	}
+
+	value, _, err := binarySpec.Parse(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return a.format.Format(State(value.(int64)))
+}
+
+func (a *action) isLeader() bool {
+	return a.leadership == nil || a.leadership.IsLeader()
+}
+
+func (a *action) getToken() uint64 {
+	if a.leadership == nil {
+		return 0
+	}
+
+	return a.leadership.Token()
+}
+
+// checkToken errors if we're no longer the leader that token was taken as (or a newer leader has published since)
+func (a *action) checkToken(token uint64) error {
+	if a.leadership == nil {
+		return nil
+	}
+
+	if a.leadership.Token() != token || !a.fence.Check(token) {
+		return fmt.Errorf("lost leadership (token %v) of %v", token, a.setTopic)
+	}
+
+	return nil
+}
+
+// publishGet publishes (encoded) payload to the get topic; the fencing token goes with it (if the client can do
+// properties) so that followers can turn away a deposed leader
+func (a *action) publishGet(outgoingPayload string, token uint64) error {
+	if a.leadership == nil {
+		return a.client.Publish(a.getTopic, mqtt.ExactlyOnce, true, outgoingPayload)
+	}
+
+	propertiesClient, ok := a.client.(mqtt.PropertiesClient)
+	if !ok || !propertiesClient.SupportsProperties() {
+		return a.client.Publish(a.getTopic, mqtt.ExactlyOnce, true, outgoingPayload)
+	}
+
+	return propertiesClient.PublishWithProperties(a.getTopic, mqtt.ExactlyOnce, true, outgoingPayload, leader_election.GetFencingProperties(token))
+}
+
+func (a *action) getLastPayload() string {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	return a.lastPayload
+}
+
+func (a *action) setLastPayload(payload string) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+
+	a.lastPayload = payload
+}
+
+// noteState records the state we've just actuated and, if it's not on, lets the interlock groups move on
+func (a *action) noteState(payload string) {
+	a.setLastPayload(payload)
+
+	if payload == getStatePayload(On) {
+		return
+	}
+
+	for _, g := range a.interlocks {
+		go g.release()
+	}
 }
 
-func (a *action) actuate(state State) error {
-	log.Printf("actuate called with state %+v; grabbing lock", state)
+// actuate applies payload (which is validated against the spec) and publishes it (canonicalised) to the get topic
+func (a *action) actuate(payload string) error {
+	log.Printf("actuate called with payload %#+v; grabbing lock", payload)
 
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	var actuate func(interface{}) error
+	if a.serialMutex != nil {
+		a.serialMutex.Lock()
+		defer a.serialMutex.Unlock()
+	}
 
-	if state == Off {
-		actuate = a.off
-	} else if state == On {
-		actuate = a.on
-	} else if state == Unknown {
+	if payload == "" {
 		log.Printf("asked to acutate unknown state; assuming this is fine and skipping.")
 		return nil
-	} else {
-		return fmt.Errorf("expected state of 0 or 1 but got %v", state)
+	}
+
+	value, payload, err := a.spec.Parse(payload)
+	if err != nil {
+		return err
+	}
+
+	// standbys keep track of what the state should be (so they can pick up where the leader left off) but leave the
+	// actuating and publishing to the leader
+	if !a.isLeader() {
+		log.Printf("not the leader; noting state %+v for %v without actuating", payload, a.setTopic)
+		a.noteState(payload)
+
+		return nil
+	}
+
+	// a deposed leader that doesn't know it yet (e.g. it's been partitioned off) mustn't touch anything
+	token := a.getToken()
+
+	err = a.checkToken(token)
+	if err != nil {
+		return err
 	}
 
 	//
 	// 4 attempts to actuate on failure
 	//
 
-	log.Printf("calling actuate with %+v", a.arguments)
+	log.Printf("calling actuate with %+v and %+v", a.arguments, value)
 	var actuateErr error
 	for i := 0; i < 4; i++ {
-		actuateErr = actuate(a.arguments)
+		actuateErr = a.apply(a.arguments, value)
 		if actuateErr != nil {
-			log.Printf("failed to actuate with %+v because %v; retry %v",
-				a.arguments, actuateErr, i,
+			log.Printf("failed to actuate with %+v and %+v because %v; retry %v",
+				a.arguments, value, actuateErr, i,
 			)
 
 			time.Sleep(time.Second)
@@ -110,18 +265,28 @@ func (a *action) actuate(state State) error {
 		return actuateErr
 	}
 
+	// the retries above can take a while; if someone else has taken over in the meantime, what they publish stands
+	err = a.checkToken(token)
+	if err != nil {
+		return err
+	}
+
 	//
 	// 4 attempts to publish on failure
 	//
 
-	payload := fmt.Sprintf("%v", state)
-	log.Printf("publishing %v to %v ", payload, a.getTopic)
+	outgoingPayload, err := a.encode(payload)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("publishing %v to %v ", outgoingPayload, a.getTopic)
 	var publishErr error
 	for i := 0; i < 4; i++ {
-		publishErr = a.client.Publish(a.getTopic, mqtt.ExactlyOnce, true, payload)
+		publishErr = a.publishGet(outgoingPayload, token)
 		if publishErr != nil {
 			log.Printf("failed to publish %v to %q because %v; retry %v",
-				payload, a.getTopic, publishErr, i,
+				outgoingPayload, a.getTopic, publishErr, i,
 			)
 
 			//
@@ -161,6 +326,8 @@ func (a *action) actuate(state State) error {
 		return publishErr
 	}
 
+	a.noteState(payload)
+
 	log.Printf("actuated and published, debouncing for %+v, lock will be released", a.debounce)
 	time.Sleep(a.debounce)
 
@@ -168,46 +335,142 @@ func (a *action) actuate(state State) error {
 }
 
 func (a *action) setup() error {
-	log.Printf("setup called for %v, establishing base state of %v", a.setTopic, a.baseState)
-	err := a.actuate(a.baseState)
+	payload := a.basePayload
+
+	var deadline time.Time
+	resumed := false
+	if a.timer != nil {
+		payload, deadline, resumed = a.resume()
+		if !resumed {
+			payload = a.basePayload
+		}
+	}
+
+	log.Printf("setup called for %v, establishing base state of %#+v", a.setTopic, payload)
+	err := a.actuate(payload)
 	if err != nil {
 		return err
 	}
 
+	if resumed {
+		a.arm(payload, deadline)
+	} else if a.timer != nil {
+		a.publishRemaining(0)
+	}
+
+	if a.leadership != nil {
+		log.Printf("subscribing to %v to follow the leader", a.getTopic)
+		err = a.client.Subscribe(a.getTopic, mqtt.ExactlyOnce, a.getCallback)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Printf("subscribing to %v", a.setTopic)
 	err = a.client.Subscribe(a.setTopic, mqtt.ExactlyOnce, a.callback)
 	if err != nil {
 		return err
 	}
 
+	if a.timer != nil {
+		log.Printf("subscribing to %v", a.timer.durationTopic)
+		err = a.client.Subscribe(a.timer.durationTopic, mqtt.ExactlyOnce, a.durationCallback)
+		if err != nil {
+			return err
+		}
+	}
+
 	return err
 }
 
-func (a *action) handleBinaryState(incomingPayload string) error {
-	state, err := parseBinaryState(incomingPayload)
+func (a *action) callback(message mqtt.Message) {
+	log.Printf("callback for %v called with %+v", a.setTopic, message)
+
+	if strings.TrimSpace(message.Payload) == "" {
+		log.Printf("ignoring empty payload for %v", a.setTopic)
+		return
+	}
+
+	rawPayload, duration, timed := message.Payload, time.Duration(0), false
+	if a.timer != nil {
+		rawPayload, duration, timed = splitTimedPayload(message.Payload)
+	}
+
+	if timed && duration <= 0 {
+		log.Printf("ignoring %+v for %v because duration %v not positive", message.Payload, a.setTopic, duration)
+		return
+	}
+
+	payload, err := a.decode(rawPayload)
 	if err != nil {
-		return err
+		log.Printf("decode for %+v caused %+v", message, err)
+		return
 	}
 
-	return a.actuate(state)
+	err = a.request(payload, duration)
+	if err != nil {
+		log.Printf("actuate for %+v caused %+v", message, err)
+	}
 }
 
-func (a *action) callback(message mqtt.Message) {
-	log.Printf("callback for %v called with %+v", a.setTopic, message)
+// getCallback keeps lastPayload up to date with whatever the leader has published
+func (a *action) getCallback(message mqtt.Message) {
+	token, ok := leader_election.GetFencingToken(message)
+	if ok && !a.fence.Check(token) {
+		log.Printf("ignoring %+v on %v because it's from a deposed leader (token %v)", message.Payload, a.getTopic, token)
+		return
+	}
 
-	err := a.handleBinaryState(message.Payload)
+	payload, err := a.decode(message.Payload)
+	if err == nil {
+		_, payload, err = a.spec.Parse(payload)
+	}
 	if err != nil {
-		log.Printf("handleBinaryState for %+v caused %+v", message, err)
+		log.Printf("ignoring %+v on %v because: %v", message.Payload, a.getTopic, err)
+		return
 	}
+
+	a.setLastPayload(payload)
+}
+
+// takeOver re-asserts the last known state (or the base state, if there isn't one) on becoming the leader
+func (a *action) takeOver() error {
+	payload := a.getLastPayload()
+	if payload == "" {
+		payload = a.basePayload
+	}
+
+	log.Printf("taking over %v with state %#+v", a.setTopic, payload)
+
+	return a.actuate(payload)
 }
 
 func (a *action) teardown() error {
-	log.Printf("teardown called for %v, establishing base state of %v", a.setTopic, a.baseState)
-	actuateErr := a.actuate(a.baseState)
+	a.stopReconciler()
+
+	// a deadline is kept so that it's picked up again after a restart
+	a.disarm(true)
+
+	log.Printf("teardown called for %v, establishing base state of %#+v", a.setTopic, a.basePayload)
+	actuateErr := a.actuate(a.basePayload)
 
 	log.Printf("unsubscribing from %v", a.setTopic)
 	mqttErr := a.client.Unsubscribe(a.setTopic)
 
+	if a.timer != nil {
+		err := a.client.Unsubscribe(a.timer.durationTopic)
+		if mqttErr == nil {
+			mqttErr = err
+		}
+	}
+
+	if a.leadership != nil {
+		err := a.client.Unsubscribe(a.getTopic)
+		if mqttErr == nil {
+			mqttErr = err
+		}
+	}
+
 	if actuateErr != nil && mqttErr != nil {
 		return fmt.Errorf("actuate caused %+v and unsubscribe caused %+v", actuateErr, mqttErr)
 	} else if actuateErr != nil {
@@ -226,6 +489,12 @@ type Router struct {
 	actionsMapMutex sync.Mutex
 	actionsMutex    sync.Mutex
 	useActionsMutex bool
+	leadership      Leadership
+	payloadFormat   PayloadFormat
+	timedOptions    *TimedActionOptions
+	deadlineStore   *deadlineStore
+	interlocks      map[string]*interlockGroup
+	statusTopic     string
 }
 
 func New(client mqtt.Client, debounce time.Duration, allowConcurrentActions bool) *Router {
@@ -234,6 +503,8 @@ func New(client mqtt.Client, debounce time.Duration, allowConcurrentActions bool
 		debounce:        debounce,
 		useActionsMutex: !allowConcurrentActions,
 		actions:         make(map[string]*action),
+		payloadFormat:   DefaultPayloadFormat,
+		interlocks:      make(map[string]*interlockGroup),
 	}
 
 	log.Printf("created router %v", &router)
@@ -241,6 +512,136 @@ func New(client mqtt.Client, debounce time.Duration, allowConcurrentActions bool
 	return &router
 }
 
+// SetLeadership makes the router only actuate while leadership says it's the leader (standbys just track the state
+// and re-assert it when they take over); it must be called before any actions are added
+func (a *Router) SetLeadership(leadership Leadership) error {
+	a.actionsMapMutex.Lock()
+	defer a.actionsMapMutex.Unlock()
+
+	if len(a.actions) > 0 {
+		return fmt.Errorf("cannot set leadership after actions have been added")
+	}
+
+	a.leadership = leadership
+	leadership.AddObserver(a.handleLeadership)
+
+	return nil
+}
+
+// EnableTimedActions lets binary actions be turned on for a while (see TimedActionOptions); like SetLeadership it must
+// be called before any actions are added
+func (a *Router) EnableTimedActions(options TimedActionOptions) error {
+	a.actionsMapMutex.Lock()
+	defer a.actionsMapMutex.Unlock()
+
+	if len(a.actions) > 0 {
+		return fmt.Errorf("cannot enable timed actions after actions have been added")
+	}
+
+	store, err := newDeadlineStore(options.StatePath)
+	if err != nil {
+		return err
+	}
+
+	a.timedOptions = &options
+	a.deadlineStore = store
+
+	return nil
+}
+
+// AddInterlockGroup stops the actions for setTopics being on at the same time (e.g. sprinkler banks sharing a water
+// supply); policy decides what happens to a request that'd break that. Like SetLeadership it must be called before any
+// actions are added, and only binary actions can be in a group (but an action can be in more than one)
+func (a *Router) AddInterlockGroup(name string, policy InterlockPolicy, setTopics ...string) error {
+	a.actionsMapMutex.Lock()
+	defer a.actionsMapMutex.Unlock()
+
+	if len(a.actions) > 0 {
+		return fmt.Errorf("cannot add interlock group %v after actions have been added", name)
+	}
+
+	_, ok := a.interlocks[name]
+	if ok {
+		return fmt.Errorf("interlock group %v already exists", name)
+	}
+
+	a.interlocks[name] = newInterlockGroup(name, policy, setTopics)
+
+	return nil
+}
+
+// AddInterlockWatch makes something outside this router (e.g. a fan looked after by another process) count as a
+// member of the named interlock group while getTopic (which can have wildcards) says it's on; as it can't be turned
+// off from here, it's only ever waited for (InterlockQueue) or a reason to reject
+func (a *Router) AddInterlockWatch(name string, getTopic string, format PayloadFormat) error {
+	return a.AddInterlockWatchFunc(name, getTopic, func(payload string) (bool, error) {
+		state, err := format.Parse(payload)
+
+		return state == On, err
+	})
+}
+
+// AddInterlockWatchFunc is AddInterlockWatch for things that aren't just on / off (e.g. an aircon, which is only in the
+// way of a heater while its mode is heat); isActive decides from what's published to getTopic
+func (a *Router) AddInterlockWatchFunc(name string, getTopic string, isActive func(payload string) (bool, error)) error {
+	a.actionsMapMutex.Lock()
+	g, ok := a.interlocks[name]
+	a.actionsMapMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no interlock group %v", name)
+	}
+
+	log.Printf("subscribing to %v for interlock group %v", getTopic, name)
+
+	return a.client.Subscribe(getTopic, mqtt.ExactlyOnce, g.watchCallback(isActive))
+}
+
+// SetStatusTopic is where the reasons for requests being rejected (or queued, or turning something else off) by an
+// interlock group are published; it must be called before any actions are added
+func (a *Router) SetStatusTopic(statusTopic string) error {
+	a.actionsMapMutex.Lock()
+	defer a.actionsMapMutex.Unlock()
+
+	if len(a.actions) > 0 {
+		return fmt.Errorf("cannot set status topic after actions have been added")
+	}
+
+	a.statusTopic = statusTopic
+
+	return nil
+}
+
+// SetPayloadFormat changes the payload format of the binary actions added after it's called (see AddActionWithFormat)
+func (a *Router) SetPayloadFormat(format PayloadFormat) {
+	a.actionsMapMutex.Lock()
+	defer a.actionsMapMutex.Unlock()
+
+	a.payloadFormat = format
+}
+
+func (a *Router) handleLeadership(leading bool) {
+	if !leading {
+		return
+	}
+
+	a.actionsMapMutex.Lock()
+	actions := make([]*action, 0, len(a.actions))
+	for _, action := range a.actions {
+		actions = append(actions, action)
+	}
+	a.actionsMapMutex.Unlock()
+
+	for _, existingAction := range actions {
+		go func(existingAction *action) {
+			err := existingAction.takeOver()
+			if err != nil {
+				log.Printf("failed to take over %v because: %v", existingAction.setTopic, err)
+			}
+		}(existingAction)
+	}
+}
+
 func (a *Router) RemoveAction(setTopic string) error {
 	log.Printf("removing action for %v", setTopic)
 
@@ -249,6 +650,10 @@ func (a *Router) RemoveAction(setTopic string) error {
 
 	action, ok := a.actions[setTopic]
 	if ok {
+		for _, g := range action.interlocks {
+			g.dequeue(action)
+		}
+
 		err := action.teardown()
 		if err != nil {
 			return err
@@ -266,6 +671,11 @@ func (a *Router) RemoveAllActions() error {
 	a.actionsMapMutex.Lock()
 	defer a.actionsMapMutex.Unlock()
 
+	// nothing that's waiting should start while everything's being torn down
+	for _, g := range a.interlocks {
+		g.clearQueue()
+	}
+
 	var errors []error
 	for _, action := range a.actions {
 		err := action.teardown()
@@ -284,8 +694,58 @@ func (a *Router) RemoveAllActions() error {
 }
 
 func (a *Router) AddAction(setTopic string, arguments interface{}, on func(interface{}) error, off func(interface{}) error, baseState State, getTopic string) error {
-	log.Printf("adding action for %v, arguments are %+v, on func is %p, off func is %p", setTopic, arguments, on, off)
+	a.actionsMapMutex.Lock()
+	format := a.payloadFormat
+	a.actionsMapMutex.Unlock()
+
+	return a.AddActionWithFormat(setTopic, arguments, on, off, baseState, getTopic, format)
+}
+
+// AddActionWithFormat is AddAction with a payload format other than the router's (see SetPayloadFormat)
+func (a *Router) AddActionWithFormat(setTopic string, arguments interface{}, on func(interface{}) error, off func(interface{}) error, baseState State, getTopic string, format PayloadFormat) error {
+	log.Printf("adding action for %v, arguments are %+v, on func is %p, off func is %p, output is %v", setTopic, arguments, on, off, format.Output.Name)
+
+	return a.addAction(setTopic, arguments, binarySpec, getBinaryApply(on, off), &format, getStatePayload(baseState), getTopic)
+}
+
+// Reconcile has the router read the actual state of the action for setTopic every so often (see ReconcileOptions), so
+// that something changed behind its back (e.g. by a button on the thing itself or by some other app) is noticed; read is
+// given the action's arguments and can return anything that formats (as %v) to a payload for the action's spec (e.g.
+// a client's own State for a binary action)
+func (a *Router) Reconcile(setTopic string, read func(arguments interface{}) (interface{}, error), options ReconcileOptions) error {
+	a.actionsMapMutex.Lock()
+	defer a.actionsMapMutex.Unlock()
+
+	action, ok := a.actions[setTopic]
+	if !ok {
+		return fmt.Errorf("no action for topic %v", setTopic)
+	}
+
+	return action.startReconciler(read, options)
+}
+
+// GetDriftCounts returns (by set topic) how many times reconciliation has found an action's thing not as it was left
+func (a *Router) GetDriftCounts() map[string]uint64 {
+	a.actionsMapMutex.Lock()
+	defer a.actionsMapMutex.Unlock()
+
+	driftCountBySetTopic := make(map[string]uint64)
+	for setTopic, action := range a.actions {
+		driftCountBySetTopic[setTopic] = action.getDriftCount()
+	}
+
+	return driftCountBySetTopic
+}
+
+// AddValueAction is AddAction for anything that isn't just on / off (e.g. a dimmer level or a fan speed); apply is
+// called with a value parsed by spec (see ValueSpec.Parse) and basePayload can be empty to leave things as they are
+func (a *Router) AddValueAction(setTopic string, arguments interface{}, spec ValueSpec, apply func(arguments interface{}, value interface{}) error, basePayload string, getTopic string) error {
+	log.Printf("adding action for %v, arguments are %+v, spec is %v, apply func is %p", setTopic, arguments, spec, apply)
+
+	return a.addAction(setTopic, arguments, spec, apply, nil, basePayload, getTopic)
+}
 
+func (a *Router) addAction(setTopic string, arguments interface{}, spec ValueSpec, apply func(interface{}, interface{}) error, format *PayloadFormat, basePayload string, getTopic string) error {
 	a.actionsMapMutex.Lock()
 	defer a.actionsMapMutex.Unlock()
 
@@ -294,13 +754,57 @@ func (a *Router) AddAction(setTopic string, arguments interface{}, on func(inter
 		return fmt.Errorf("action for topic %v already exists", setTopic)
 	}
 
-	action := newAction(setTopic, arguments, on, off, a.debounce, a.client, baseState, getTopic)
+	action, err := newAction(setTopic, arguments, spec, apply, format, a.debounce, a.client, basePayload, getTopic, a.leadership)
+	if err != nil {
+		return err
+	}
+
+	if a.timedOptions != nil && format != nil {
+		revertPayload := action.basePayload
+		if revertPayload == "" {
+			revertPayload = getStatePayload(Off)
+		}
+
+		action.timer = newTimer(setTopic, revertPayload, *a.timedOptions, a.deadlineStore)
+	}
 
-	err := action.setup()
+	if a.useActionsMutex {
+		action.serialMutex = &a.actionsMutex
+	}
+
+	names := make([]string, 0, len(a.interlocks))
+	for name := range a.interlocks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		g := a.interlocks[name]
+		if !g.setTopics[setTopic] {
+			continue
+		}
+
+		if format == nil {
+			return fmt.Errorf("%v can't be in interlock group %v as it's not a binary action", setTopic, name)
+		}
+
+		action.interlocks = append(action.interlocks, g)
+	}
+
+	action.statusTopic = a.statusTopic
+
+	err = action.setup()
 	if err != nil {
 		return err
 	}
 
+	for _, g := range action.interlocks {
+		g.mu.Lock()
+		g.members = append(g.members, action)
+		g.mu.Unlock()
+	}
+
 	a.actions[setTopic] = action
 
 	return nil
@@ -0,0 +1,292 @@
+package mqtt_action_router
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/initialed85/mqtt_things/pkg/leader_election"
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	calls []string
+	err   error
+}
+
+func (r *recorder) on(arguments interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, fmt.Sprintf("on(%v)", arguments))
+
+	return r.err
+}
+
+func (r *recorder) off(arguments interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, fmt.Sprintf("off(%v)", arguments))
+
+	return r.err
+}
+
+func (r *recorder) getCalls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string{}, r.calls...)
+}
+
+type fakeLeadership struct {
+	mu        sync.Mutex
+	leading   bool
+	token     uint64
+	observers []func(leading bool)
+}
+
+func (l *fakeLeadership) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.leading
+}
+
+func (l *fakeLeadership) Token() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.leading {
+		return 0
+	}
+
+	return l.token
+}
+
+func (l *fakeLeadership) AddObserver(observer func(leading bool)) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.observers = append(l.observers, observer)
+
+	return func() {}
+}
+
+func (l *fakeLeadership) setLeading(leading bool) {
+	l.mu.Lock()
+	l.leading = leading
+	if leading {
+		l.token++
+	}
+	observers := append([]func(leading bool){}, l.observers...)
+	l.mu.Unlock()
+
+	for _, observer := range observers {
+		observer(leading)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	setup := func(t *testing.T) (*mqtttest.Broker, *Router, *recorder) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		return b, New(c, time.Millisecond, true), &recorder{}
+	}
+
+	t.Run("AddActionEstablishesBaseState", func(t *testing.T) {
+		b, r, rec := setup(t)
+
+		require.NoError(t, r.AddAction("test/heater/state/set", "some-arg", rec.on, rec.off, Off, "test/heater/state/get"))
+
+		require.Equal(t, []string{"off(some-arg)"}, rec.getCalls())
+		b.RequireRetained(t, "test/heater/state/get", "0")
+	})
+
+	t.Run("AddActionTwice", func(t *testing.T) {
+		_, r, rec := setup(t)
+
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+		require.Error(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+	})
+
+	t.Run("SetTopicActuates", func(t *testing.T) {
+		b, r, rec := setup(t)
+
+		require.NoError(t, r.AddAction("test/heater/state/set", "some-arg", rec.on, rec.off, Unknown, "test/heater/state/get"))
+		require.Empty(t, rec.getCalls())
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "0")
+
+		require.Equal(t, []string{"on(some-arg)", "off(some-arg)"}, rec.getCalls())
+		b.RequirePublishedSequence(t, "test/heater/state/get", "1", "0")
+	})
+
+	t.Run("InvalidPayloadIgnored", func(t *testing.T) {
+		b, r, rec := setup(t)
+
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Unknown, "test/heater/state/get"))
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "2")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "banana")
+
+		require.Empty(t, rec.getCalls())
+		b.RequireNotPublished(t, "test/heater/state/get")
+	})
+
+	t.Run("PayloadFormat", func(t *testing.T) {
+		b, r, rec := setup(t)
+
+		r.SetPayloadFormat(PayloadFormat{Accept: GetDialects(), Output: OnOff})
+		require.NoError(t, r.AddAction("test/switch/state/set", nil, rec.on, rec.off, Off, "test/switch/state/get"))
+		require.NoError(t, r.AddActionWithFormat("test/light/state/set", "light", rec.on, rec.off, Unknown, "test/light/state/get", PayloadFormat{Output: JSON}))
+
+		b.Inject("test/switch/state/set", mqtt.ExactlyOnce, false, "true")
+		b.Inject("test/switch/state/set", mqtt.ExactlyOnce, false, `{"state":"OFF"}`)
+		b.Inject("test/switch/state/set", mqtt.ExactlyOnce, false, "1")
+		b.Inject("test/switch/state/set", mqtt.ExactlyOnce, false, "maybe")
+
+		// just JSON, as that's the output
+		b.Inject("test/light/state/set", mqtt.ExactlyOnce, false, `{"state":"ON"}`)
+		b.Inject("test/light/state/set", mqtt.ExactlyOnce, false, "ON")
+
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)", "off(<nil>)", "on(<nil>)", "on(light)"}, rec.getCalls())
+		b.RequirePublishedSequence(t, "test/switch/state/get", "OFF", "ON", "OFF", "ON")
+		b.RequirePublishedSequence(t, "test/light/state/get", `{"state":"ON"}`)
+	})
+
+	t.Run("PayloadFormatWhileStandby", func(t *testing.T) {
+		b, r, rec := setup(t)
+
+		l := &fakeLeadership{}
+		require.NoError(t, r.SetLeadership(l))
+		r.SetPayloadFormat(PayloadFormat{Output: OnOff})
+
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+		b.Inject("test/heater/state/get", mqtt.ExactlyOnce, true, "ON")
+
+		l.setLeading(true)
+		require.Eventually(t, func() bool { return len(rec.getCalls()) == 1 }, time.Second, time.Millisecond*10)
+		require.Equal(t, []string{"on(<nil>)"}, rec.getCalls())
+	})
+
+	t.Run("ValueAction", func(t *testing.T) {
+		b, r, _ := setup(t)
+
+		mu := sync.Mutex{}
+		applied := make([]interface{}, 0)
+		apply := func(arguments interface{}, value interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			applied = append(applied, value)
+
+			return nil
+		}
+
+		require.NoError(t, r.AddValueAction("test/fan/speed/set", nil, Enum("low", "medium", "high"), apply, "low", "test/fan/speed/get"))
+		require.NoError(t, r.AddValueAction("test/valve/position/set", nil, FloatRange(0, 100, 2.5), apply, "", "test/valve/position/get"))
+
+		b.Inject("test/fan/speed/set", mqtt.ExactlyOnce, false, "high")
+		b.Inject("test/fan/speed/set", mqtt.ExactlyOnce, false, "turbo")
+		b.Inject("test/valve/position/set", mqtt.ExactlyOnce, false, "37.50")
+		b.Inject("test/valve/position/set", mqtt.ExactlyOnce, false, "101")
+
+		require.Equal(t, []interface{}{"low", "high", 37.5}, applied)
+		b.RequirePublishedSequence(t, "test/fan/speed/get", "low", "high")
+		b.RequirePublishedSequence(t, "test/valve/position/get", "37.5")
+
+		require.Error(t, r.AddValueAction("test/dimmer/level/set", nil, IntegerRange(0, 100), apply, "150", "test/dimmer/level/get"))
+		require.Error(t, r.AddValueAction("test/dimmer/level/set", nil, IntegerRange(100, 0), apply, "", "test/dimmer/level/get"))
+	})
+
+	t.Run("RemoveAllActionsRestoresBaseState", func(t *testing.T) {
+		b, r, rec := setup(t)
+
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.NoError(t, r.RemoveAllActions())
+
+		b.RequirePublishedSequence(t, "test/heater/state/get", "0", "1", "0")
+
+		// unsubscribed, so this should do nothing
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)", "off(<nil>)"}, rec.getCalls())
+	})
+	t.Run("OnlyActuatesWhileLeader", func(t *testing.T) {
+		b, r, rec := setup(t)
+
+		l := &fakeLeadership{}
+		require.NoError(t, r.SetLeadership(l))
+
+		// as a standby, nothing happens but the state is tracked (from the leader's /get and from /set)
+		require.NoError(t, r.AddAction("test/heater/state/set", "some-arg", rec.on, rec.off, Off, "test/heater/state/get"))
+		b.Inject("test/heater/state/get", mqtt.ExactlyOnce, true, "1")
+		require.Empty(t, rec.getCalls())
+		b.RequireRetained(t, "test/heater/state/get", "1")
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "0")
+		b.Inject("test/heater/state/get", mqtt.ExactlyOnce, true, "0")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Empty(t, rec.getCalls())
+
+		// on taking over, the last known state is re-asserted
+		l.setLeading(true)
+		require.Eventually(t, func() bool { return len(rec.getCalls()) == 1 }, time.Second, time.Millisecond*10)
+		require.Equal(t, []string{"on(some-arg)"}, rec.getCalls())
+		b.WaitForPublished(t, "test/heater/state/get", "1", time.Second)
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "0")
+		require.Equal(t, []string{"on(some-arg)", "off(some-arg)"}, rec.getCalls())
+
+		l.setLeading(false)
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+		require.Len(t, rec.getCalls(), 2)
+
+		require.Error(t, r.SetLeadership(l))
+	})
+
+	t.Run("FencesOutDeposedLeaders", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		c.EnableProperties()
+		require.NoError(t, c.Connect())
+
+		r, rec := New(c, time.Millisecond, true), &recorder{}
+
+		l := &fakeLeadership{}
+		require.NoError(t, r.SetLeadership(l))
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+
+		l.setLeading(true)
+		require.Eventually(t, func() bool { return len(rec.getCalls()) == 1 }, time.Second, time.Millisecond*10)
+		b.WaitForPublished(t, "test/heater/state/get", "0", time.Second)
+
+		publishedMessage, ok := b.LastPublishedTo("test/heater/state/get")
+		require.True(t, ok)
+		token, ok := leader_election.GetFencingToken(mqtt.Message{Payload: publishedMessage.Payload, Properties: publishedMessage.Properties})
+		require.True(t, ok)
+		require.Equal(t, uint64(1), token)
+
+		// a newer leader took over while we weren't looking; we mustn't touch anything any more, nor listen to anyone
+		// older than it
+		other := b.NewClient(nil)
+		other.EnableProperties()
+		require.NoError(t, other.Connect())
+		require.NoError(t, other.PublishWithProperties("test/heater/state/get", mqtt.ExactlyOnce, true, "1", leader_election.GetFencingProperties(5)))
+		require.NoError(t, other.PublishWithProperties("test/heater/state/get", mqtt.ExactlyOnce, true, "0", leader_election.GetFencingProperties(3)))
+		require.Equal(t, "1", r.actions["test/heater/state/set"].getLastPayload())
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "0")
+		require.Equal(t, []string{"off(<nil>)"}, rec.getCalls())
+		require.Len(t, b.PublishedTo("test/heater/state/get"), 3)
+	})
+}
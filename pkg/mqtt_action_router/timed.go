@@ -0,0 +1,403 @@
+package mqtt_action_router
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+const DefaultRemainingInterval = time.Second * 10
+
+// TimedActionOptions enables (for binary actions) set payloads like "1:1200" (or "1:20m") and a sibling duration topic
+// (e.g. some/thing/state/duration/set for some/thing/state/set) that take the action out of its base state for a
+// while; the time left is published to a sibling remaining topic (e.g. some/thing/state/remaining/get)
+type TimedActionOptions struct {
+	StatePath         string        // optional; deadlines are persisted here so that a restart still honours them
+	MaxDuration       time.Duration // 0 means no limit
+	RemainingInterval time.Duration // how often to publish the time remaining; 0 means DefaultRemainingInterval
+}
+
+// AddTimedActionFlags adds -timedActionStatePath, -timedActionMaxDuration and -timedActionRemainingInterval to
+// flagSet; call the returned func after parsing
+func AddTimedActionFlags(flagSet *flag.FlagSet) func() TimedActionOptions {
+	statePathPtr := flagSet.String("timedActionStatePath", "", "file to persist timed action deadlines to, so they survive a restart (optional)")
+	maxDurationPtr := flagSet.Duration("timedActionMaxDuration", 0, "longest a timed action can run for (0 for no limit)")
+	remainingIntervalPtr := flagSet.Duration("timedActionRemainingInterval", DefaultRemainingInterval, "how often to publish the time remaining for a timed action")
+
+	return func() TimedActionOptions {
+		return TimedActionOptions{
+			StatePath:         *statePathPtr,
+			MaxDuration:       *maxDurationPtr,
+			RemainingInterval: *remainingIntervalPtr,
+		}
+	}
+}
+
+// getTimedTopics returns the duration and remaining topics that sit alongside setTopic
+func getTimedTopics(setTopic string) (string, string) {
+	prefix := strings.TrimSuffix(setTopic, "/set")
+
+	return prefix + "/duration/set", prefix + "/remaining/get"
+}
+
+// parseDuration takes seconds (e.g. "1200") or a Go duration (e.g. "20m")
+func parseDuration(rawDuration string) (time.Duration, error) {
+	rawDuration = strings.TrimSpace(rawDuration)
+
+	seconds, err := strconv.ParseFloat(rawDuration, 64)
+	if err == nil {
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return 0, fmt.Errorf("%#+v not a duration", rawDuration)
+		}
+
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	duration, err := time.ParseDuration(rawDuration)
+	if err != nil {
+		return 0, fmt.Errorf("%#+v not seconds or a duration", rawDuration)
+	}
+
+	return duration, nil
+}
+
+// splitTimedPayload splits "1:1200" into "1" and 20 minutes; anything without a duration after the last colon (e.g.
+// a plain "1" or {"state":"ON"}) isn't timed
+func splitTimedPayload(payload string) (string, time.Duration, bool) {
+	i := strings.LastIndex(payload, ":")
+	if i < 0 {
+		return payload, 0, false
+	}
+
+	duration, err := parseDuration(payload[i+1:])
+	if err != nil {
+		return payload, 0, false
+	}
+
+	return payload[:i], duration, true
+}
+
+type persistedDeadline struct {
+	Payload  string    `json:"payload"`
+	Deadline time.Time `json:"deadline"`
+}
+
+type deadlineStore struct {
+	mu                 sync.Mutex
+	path               string
+	deadlineBySetTopic map[string]persistedDeadline
+}
+
+func newDeadlineStore(path string) (*deadlineStore, error) {
+	s := &deadlineStore{
+		path:               path,
+		deadlineBySetTopic: make(map[string]persistedDeadline),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+
+		return nil, fmt.Errorf("failed to read timed action state %#+v because: %v", path, err)
+	}
+
+	if len(data) == 0 {
+		return s, nil
+	}
+
+	err = json.Unmarshal(data, &s.deadlineBySetTopic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timed action state %#+v because: %v", path, err)
+	}
+
+	log.Printf("loaded %v timed action deadlines from %v", len(s.deadlineBySetTopic), path)
+
+	return s, nil
+}
+
+// save must be called with the lock held; it writes a temp file and renames it so a crash can't leave a torn file
+func (s *deadlineStore) save() {
+	if s.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(s.deadlineBySetTopic)
+	if err != nil {
+		log.Printf("warning: failed to serialize timed action state because: %v", err)
+		return
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		log.Printf("warning: failed to create temp file for timed action state because: %v", err)
+		return
+	}
+
+	_, err = tempFile.Write(data)
+	closeErr := tempFile.Close()
+	if err != nil || closeErr != nil {
+		_ = os.Remove(tempFile.Name())
+		log.Printf("warning: failed to write timed action state because: %v / %v", err, closeErr)
+		return
+	}
+
+	err = os.Rename(tempFile.Name(), s.path)
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		log.Printf("warning: failed to replace timed action state because: %v", err)
+	}
+}
+
+func (s *deadlineStore) get(setTopic string) (persistedDeadline, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline, ok := s.deadlineBySetTopic[setTopic]
+
+	return deadline, ok
+}
+
+func (s *deadlineStore) set(setTopic string, deadline persistedDeadline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deadlineBySetTopic[setTopic] = deadline
+	s.save()
+}
+
+func (s *deadlineStore) clear(setTopic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.deadlineBySetTopic[setTopic]; !ok {
+		return
+	}
+
+	delete(s.deadlineBySetTopic, setTopic)
+	s.save()
+}
+
+type timer struct {
+	options        TimedActionOptions
+	store          *deadlineStore
+	durationTopic  string
+	remainingTopic string
+	revertPayload  string
+	mu             sync.Mutex
+	generation     uint64
+	stop           chan struct{}
+}
+
+func newTimer(setTopic string, revertPayload string, options TimedActionOptions, store *deadlineStore) *timer {
+	if options.RemainingInterval <= 0 {
+		options.RemainingInterval = DefaultRemainingInterval
+	}
+
+	durationTopic, remainingTopic := getTimedTopics(setTopic)
+
+	return &timer{
+		options:        options,
+		store:          store,
+		durationTopic:  durationTopic,
+		remainingTopic: remainingTopic,
+		revertPayload:  revertPayload,
+	}
+}
+
+// publishRemaining is called with the timer lock held (once there's a timer running) so that a stale countdown can't
+// publish over a newer one
+func (a *action) publishRemaining(remaining time.Duration) {
+	if !a.isLeader() {
+		return
+	}
+
+	payload := fmt.Sprintf("%v", int64(math.Ceil(math.Max(0, remaining.Seconds()))))
+
+	err := a.client.Publish(a.timer.remainingTopic, mqtt.ExactlyOnce, true, payload, true)
+	if err != nil {
+		log.Printf("warning: failed to publish %v to %v because: %v", payload, a.timer.remainingTopic, err)
+	}
+}
+
+// arm (re)starts the countdown to reverting; payload is what we're reverting from
+func (a *action) arm(payload string, deadline time.Time) {
+	t := a.timer
+
+	t.mu.Lock()
+	if t.stop != nil {
+		close(t.stop)
+	}
+
+	t.generation++
+	generation := t.generation
+	stop := make(chan struct{})
+	t.stop = stop
+	t.store.set(a.setTopic, persistedDeadline{Payload: payload, Deadline: deadline})
+	a.publishRemaining(time.Until(deadline))
+	t.mu.Unlock()
+
+	log.Printf("%v will revert to %v at %v", a.setTopic, t.revertPayload, deadline)
+
+	go a.runTimer(generation, stop, deadline)
+}
+
+// disarm stops the countdown (if there is one) and forgets the deadline unless keep is true
+func (a *action) disarm(keep bool) {
+	t := a.timer
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	armed := t.stop != nil
+	if armed {
+		close(t.stop)
+		t.stop = nil
+	}
+
+	t.generation++
+
+	if armed && !keep {
+		t.store.clear(a.setTopic)
+		a.publishRemaining(0)
+	}
+	t.mu.Unlock()
+}
+
+func (a *action) runTimer(generation uint64, stop chan struct{}, deadline time.Time) {
+	t := a.timer
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		wait := t.options.RemainingInterval
+		if remaining < wait {
+			wait = remaining
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		t.mu.Lock()
+		if t.generation != generation {
+			t.mu.Unlock()
+			return
+		}
+
+		if time.Until(deadline) > 0 {
+			a.publishRemaining(time.Until(deadline))
+		}
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	if t.generation != generation {
+		t.mu.Unlock()
+		return
+	}
+
+	t.stop = nil
+	t.generation++
+	t.store.clear(a.setTopic)
+	a.publishRemaining(0)
+	t.mu.Unlock()
+
+	log.Printf("time's up for %v; reverting to %v", a.setTopic, t.revertPayload)
+
+	// by way of the interlock groups, as reverting to a base state of On is as much a request to turn on as any
+	err := a.request(t.revertPayload, 0)
+	if err != nil {
+		log.Printf("failed to revert %v because: %v", a.setTopic, err)
+	}
+}
+
+// actuateFor actuates (canonical) payload and arranges for it to be reverted after duration
+func (a *action) actuateFor(payload string, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("duration %v not positive", duration)
+	}
+
+	if a.timer.options.MaxDuration > 0 && duration > a.timer.options.MaxDuration {
+		return fmt.Errorf("duration %v longer than %v", duration, a.timer.options.MaxDuration)
+	}
+
+	_, payload, err := a.spec.Parse(payload)
+	if err != nil {
+		return err
+	}
+
+	if payload == a.timer.revertPayload {
+		return fmt.Errorf("can't time %v as that's what it reverts to", payload)
+	}
+
+	err = a.actuate(payload)
+	if err != nil {
+		return err
+	}
+
+	a.arm(payload, time.Now().Add(duration))
+
+	return nil
+}
+
+// durationCallback turns the action to On for the duration in the payload (or reverts it now for 0)
+func (a *action) durationCallback(message mqtt.Message) {
+	log.Printf("duration callback for %v called with %+v", a.setTopic, message)
+
+	duration, err := parseDuration(message.Payload)
+	if err != nil {
+		log.Printf("ignoring %+v on %v because: %v", message.Payload, a.timer.durationTopic, err)
+		return
+	}
+
+	if duration <= 0 {
+		err = a.request(a.timer.revertPayload, 0)
+	} else {
+		err = a.request(getStatePayload(On), duration)
+	}
+
+	if err != nil {
+		log.Printf("actuate for %+v caused %+v", message, err)
+	}
+}
+
+// resume picks up a deadline persisted before a restart, returning the payload to start with
+func (a *action) resume() (string, time.Time, bool) {
+	deadline, ok := a.timer.store.get(a.setTopic)
+	if !ok {
+		return "", time.Time{}, false
+	}
+
+	if time.Now().After(deadline.Deadline) {
+		log.Printf("deadline %v for %v passed while we were away", deadline.Deadline, a.setTopic)
+		a.timer.store.clear(a.setTopic)
+
+		return "", time.Time{}, false
+	}
+
+	log.Printf("resuming %v with %v until %v", a.setTopic, deadline.Payload, deadline.Deadline)
+
+	return deadline.Payload, deadline.Deadline, true
+}
@@ -0,0 +1,133 @@
+package mqtt_action_router
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+func TestTimedActions(t *testing.T) {
+	setup := func(t *testing.T, options TimedActionOptions) (*mqtttest.Broker, *Router, *recorder) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		r := New(c, time.Millisecond, true)
+		require.NoError(t, r.EnableTimedActions(options))
+
+		return b, r, &recorder{}
+	}
+
+	t.Run("SplitTimedPayload", func(t *testing.T) {
+		for payload, expected := range map[string]time.Duration{
+			"1:1200":         time.Minute * 20,
+			"ON:20m":         time.Minute * 20,
+			"1:0.5":          time.Millisecond * 500,
+			`{"state":"ON"}`: 0,
+			"1":              0,
+			"1:banana":       0,
+		} {
+			_, duration, timed := splitTimedPayload(payload)
+			require.Equal(t, expected != 0, timed, payload)
+			require.Equal(t, expected, duration, payload)
+		}
+
+		durationTopic, remainingTopic := getTimedTopics("test/heater/state/set")
+		require.Equal(t, "test/heater/state/duration/set", durationTopic)
+		require.Equal(t, "test/heater/state/remaining/get", remainingTopic)
+	})
+
+	t.Run("RevertsWhenTimeIsUp", func(t *testing.T) {
+		b, r, rec := setup(t, TimedActionOptions{RemainingInterval: time.Millisecond * 50})
+		r.SetPayloadFormat(PayloadFormat{Accept: GetDialects(), Output: Numeric})
+
+		require.NoError(t, r.AddAction("test/heater/state/set", "some-arg", rec.on, rec.off, Off, "test/heater/state/get"))
+		b.RequireRetained(t, "test/heater/state/remaining/get", "0")
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "ON:0.2")
+		require.Equal(t, []string{"off(some-arg)", "on(some-arg)"}, rec.getCalls())
+		b.RequirePublished(t, "test/heater/state/remaining/get", "1")
+
+		require.Eventually(t, func() bool { return len(rec.getCalls()) == 3 }, time.Second, time.Millisecond*10)
+		require.Equal(t, "off(some-arg)", rec.getCalls()[2])
+		b.RequirePublishedSequence(t, "test/heater/state/get", "0", "1", "0")
+		require.Eventually(t, func() bool {
+			publishedMessage, ok := b.Retained("test/heater/state/remaining/get")
+			return ok && publishedMessage.Payload == "0"
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("PlainSetCancels", func(t *testing.T) {
+		b, r, rec := setup(t, TimedActionOptions{})
+
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1:0.1")
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1")
+
+		time.Sleep(time.Millisecond * 200)
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)", "on(<nil>)"}, rec.getCalls())
+		b.RequireRetained(t, "test/heater/state/remaining/get", "0")
+	})
+
+	t.Run("DurationTopic", func(t *testing.T) {
+		b, r, rec := setup(t, TimedActionOptions{MaxDuration: time.Hour})
+
+		require.NoError(t, r.AddAction("test/sprinklers/bank/1/state/set", nil, rec.on, rec.off, Off, "test/sprinklers/bank/1/state/get"))
+
+		b.Inject("test/sprinklers/bank/1/state/duration/set", mqtt.ExactlyOnce, false, "20m")
+		b.RequireRetained(t, "test/sprinklers/bank/1/state/remaining/get", "1200")
+
+		// too long, not a duration and can't time the state it reverts to
+		b.Inject("test/sprinklers/bank/1/state/duration/set", mqtt.ExactlyOnce, false, "2h")
+		b.Inject("test/sprinklers/bank/1/state/duration/set", mqtt.ExactlyOnce, false, "banana")
+		b.Inject("test/sprinklers/bank/1/state/set", mqtt.ExactlyOnce, false, "0:60")
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)"}, rec.getCalls())
+
+		b.Inject("test/sprinklers/bank/1/state/duration/set", mqtt.ExactlyOnce, false, "0")
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)", "off(<nil>)"}, rec.getCalls())
+		b.RequireRetained(t, "test/sprinklers/bank/1/state/remaining/get", "0")
+	})
+
+	t.Run("DeadlineSurvivesRestart", func(t *testing.T) {
+		statePath := filepath.Join(t.TempDir(), "timed.json")
+
+		b, r, rec := setup(t, TimedActionOptions{StatePath: statePath})
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "1:600")
+		require.NoError(t, r.RemoveAllActions())
+		require.Equal(t, []string{"off(<nil>)", "on(<nil>)", "off(<nil>)"}, rec.getCalls())
+
+		// picks up where it left off rather than establishing the base state
+		b, r, rec = setup(t, TimedActionOptions{StatePath: statePath})
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+		require.Equal(t, []string{"on(<nil>)"}, rec.getCalls())
+		b.RequireRetained(t, "test/heater/state/get", "1")
+
+		publishedMessage, ok := b.Retained("test/heater/state/remaining/get")
+		require.True(t, ok)
+		require.Contains(t, []string{"599", "600"}, publishedMessage.Payload)
+
+		// a cancelled deadline isn't picked up
+		b.Inject("test/heater/state/set", mqtt.ExactlyOnce, false, "0")
+		require.NoError(t, r.RemoveAllActions())
+
+		_, r, rec = setup(t, TimedActionOptions{StatePath: statePath})
+		require.NoError(t, r.AddAction("test/heater/state/set", nil, rec.on, rec.off, Off, "test/heater/state/get"))
+		require.Equal(t, []string{"off(<nil>)"}, rec.getCalls())
+	})
+
+	t.Run("ValueActionsAreNotTimed", func(t *testing.T) {
+		b, r, _ := setup(t, TimedActionOptions{})
+
+		require.NoError(t, r.AddValueAction("test/fan/speed/set", nil, Enum("low", "high"), func(interface{}, interface{}) error { return nil }, "low", "test/fan/speed/get"))
+		b.RequireNotPublished(t, "test/fan/speed/remaining/get")
+
+		require.Error(t, r.EnableTimedActions(TimedActionOptions{}))
+	})
+}
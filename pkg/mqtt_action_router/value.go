@@ -0,0 +1,169 @@
+package mqtt_action_router
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type ValueKind int
+
+const (
+	EnumValue ValueKind = iota
+	IntegerValue
+	FloatValue
+	StringValue
+)
+
+func (k ValueKind) String() string {
+	switch k {
+	case EnumValue:
+		return "enum"
+	case IntegerValue:
+		return "integer"
+	case FloatValue:
+		return "float"
+	case StringValue:
+		return "string"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(k))
+	}
+}
+
+// stepTolerance is how far (as a fraction of Step) a float can be from a step and still be on it
+const stepTolerance = 1e-9
+
+// ValueSpec describes the values an action accepts; Parse turns a payload into what the apply callback gets (a string
+// for EnumValue and StringValue, an int64 for IntegerValue and a float64 for FloatValue)
+type ValueSpec struct {
+	Kind    ValueKind
+	Options []string // EnumValue only
+	Min     float64  // IntegerValue and FloatValue only (inclusive)
+	Max     float64  // IntegerValue and FloatValue only (inclusive)
+	Step    float64  // FloatValue only; values must be a whole number of steps from Min (0 means any value)
+}
+
+func Enum(options ...string) ValueSpec {
+	return ValueSpec{Kind: EnumValue, Options: options}
+}
+
+func IntegerRange(min int64, max int64) ValueSpec {
+	return ValueSpec{Kind: IntegerValue, Min: float64(min), Max: float64(max)}
+}
+
+func FloatRange(min float64, max float64, step float64) ValueSpec {
+	return ValueSpec{Kind: FloatValue, Min: min, Max: max, Step: step}
+}
+
+func AnyString() ValueSpec {
+	return ValueSpec{Kind: StringValue}
+}
+
+// binarySpec is what the on / off actions have always accepted
+var binarySpec = IntegerRange(int64(Off), int64(On))
+
+func (s ValueSpec) String() string {
+	switch s.Kind {
+	case EnumValue:
+		return fmt.Sprintf("%v%v", s.Kind, s.Options)
+	case IntegerValue:
+		return fmt.Sprintf("%v[%v..%v]", s.Kind, s.Min, s.Max)
+	case FloatValue:
+		return fmt.Sprintf("%v[%v..%v/%v]", s.Kind, s.Min, s.Max, s.Step)
+	default:
+		return s.Kind.String()
+	}
+}
+
+func (s ValueSpec) Validate() error {
+	switch s.Kind {
+	case EnumValue:
+		if len(s.Options) == 0 {
+			return fmt.Errorf("%v has no options", s)
+		}
+
+		seen := make(map[string]struct{})
+		for _, option := range s.Options {
+			if strings.TrimSpace(option) == "" {
+				return fmt.Errorf("%v has an empty option", s)
+			}
+
+			if _, ok := seen[option]; ok {
+				return fmt.Errorf("%v has %#+v more than once", s, option)
+			}
+
+			seen[option] = struct{}{}
+		}
+	case IntegerValue, FloatValue:
+		if math.IsNaN(s.Min) || math.IsNaN(s.Max) || s.Max < s.Min {
+			return fmt.Errorf("%v has an invalid range", s)
+		}
+
+		if s.Kind == IntegerValue && (s.Min != math.Trunc(s.Min) || s.Max != math.Trunc(s.Max)) {
+			return fmt.Errorf("%v has a range that isn't whole numbers", s)
+		}
+
+		if s.Step < 0 || math.IsNaN(s.Step) || math.IsInf(s.Step, 0) {
+			return fmt.Errorf("%v has an invalid step", s)
+		}
+	case StringValue:
+	default:
+		return fmt.Errorf("unknown value kind %v", s.Kind)
+	}
+
+	return nil
+}
+
+// Parse returns the value for payload and the canonical payload for that value (which is what gets published to the
+// get topic)
+func (s ValueSpec) Parse(payload string) (interface{}, string, error) {
+	payload = strings.TrimSpace(payload)
+	if payload == "" {
+		return nil, "", fmt.Errorf("empty payload for %v", s)
+	}
+
+	switch s.Kind {
+	case EnumValue:
+		for _, option := range s.Options {
+			if payload == option {
+				return option, option, nil
+			}
+		}
+
+		return nil, "", fmt.Errorf("%#+v not one of %v", payload, strings.Join(s.Options, ", "))
+	case IntegerValue:
+		value, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to parse %#+v as an integer because: %v", payload, err)
+		}
+
+		if float64(value) < s.Min || float64(value) > s.Max {
+			return nil, "", fmt.Errorf("%v outside of %v to %v", value, s.Min, s.Max)
+		}
+
+		return value, strconv.FormatInt(value, 10), nil
+	case FloatValue:
+		value, err := strconv.ParseFloat(payload, 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, "", fmt.Errorf("failed to parse %#+v as a float", payload)
+		}
+
+		if value < s.Min || value > s.Max {
+			return nil, "", fmt.Errorf("%v outside of %v to %v", value, s.Min, s.Max)
+		}
+
+		if s.Step > 0 {
+			steps := (value - s.Min) / s.Step
+			if math.Abs(steps-math.Round(steps)) > stepTolerance*math.Max(1, math.Abs(steps)) {
+				return nil, "", fmt.Errorf("%v not a multiple of %v from %v", value, s.Step, s.Min)
+			}
+		}
+
+		return value, strconv.FormatFloat(value, 'f', -1, 64), nil
+	case StringValue:
+		return payload, payload, nil
+	default:
+		return nil, "", fmt.Errorf("unknown value kind %v", s.Kind)
+	}
+}
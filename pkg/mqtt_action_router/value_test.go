@@ -0,0 +1,68 @@
+package mqtt_action_router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueSpec(t *testing.T) {
+	t.Run("Parse", func(t *testing.T) {
+		for _, testCase := range []struct {
+			spec    ValueSpec
+			payload string
+			value   interface{}
+			output  string
+		}{
+			{binarySpec, "1", int64(1), "1"},
+			{Enum("low", "medium", "high"), " medium ", "medium", "medium"},
+			{IntegerRange(0, 100), "42", int64(42), "42"},
+			{IntegerRange(-10, 10), "-10", int64(-10), "-10"},
+			{FloatRange(16, 30, 0.5), "21.50", 21.5, "21.5"},
+			{FloatRange(0, 1, 0.1), "0.3", 0.3, "0.3"},
+			{FloatRange(0, 1, 0), "0.123", 0.123, "0.123"},
+			{AnyString(), "some scene", "some scene", "some scene"},
+		} {
+			value, output, err := testCase.spec.Parse(testCase.payload)
+			require.NoError(t, err, "%v %#+v", testCase.spec, testCase.payload)
+			require.Equal(t, testCase.value, value)
+			require.Equal(t, testCase.output, output)
+		}
+
+		for _, testCase := range []struct {
+			spec    ValueSpec
+			payload string
+		}{
+			{binarySpec, "2"},
+			{binarySpec, "banana"},
+			{Enum("low", "medium", "high"), "HIGH"},
+			{IntegerRange(0, 100), "101"},
+			{IntegerRange(0, 100), "50.5"},
+			{FloatRange(16, 30, 0.5), "21.3"},
+			{FloatRange(16, 30, 0.5), "NaN"},
+			{FloatRange(16, 30, 0.5), "15.5"},
+			{AnyString(), " "},
+		} {
+			_, _, err := testCase.spec.Parse(testCase.payload)
+			require.Error(t, err, "%v %#+v", testCase.spec, testCase.payload)
+		}
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		for _, spec := range []ValueSpec{binarySpec, Enum("a", "b"), IntegerRange(0, 255), FloatRange(0, 1, 0.01), AnyString()} {
+			require.NoError(t, spec.Validate(), "%v", spec)
+		}
+
+		for _, spec := range []ValueSpec{
+			Enum(),
+			Enum("a", "a"),
+			Enum("a", ""),
+			IntegerRange(10, 0),
+			{Kind: IntegerValue, Min: 0.5, Max: 1},
+			FloatRange(0, 1, -0.1),
+			{Kind: ValueKind(42)},
+		} {
+			require.Error(t, spec.Validate(), "%v", spec)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package mqtt_client
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	SchemeTCP = "tcp"
+	SchemeSSL = "ssl"
+	SchemeWS  = "ws"
+	SchemeWSS = "wss"
+)
+
+var schemeAliases = map[string]string{
+	"tcp":   SchemeTCP,
+	"mqtt":  SchemeTCP,
+	"ssl":   SchemeSSL,
+	"tls":   SchemeSSL,
+	"mqtts": SchemeSSL,
+	"ws":    SchemeWS,
+	"wss":   SchemeWSS,
+}
+
+var defaultPortByScheme = map[string]int{
+	SchemeTCP: 1883,
+	SchemeSSL: 8883,
+	SchemeWS:  80,
+	SchemeWSS: 443,
+}
+
+type BrokerURL struct {
+	Scheme string
+	Host   string
+	Port   int
+	Path   string
+}
+
+// ParseBrokerURL accepts a bare host, a host:port or a full URL (e.g. wss://broker.example.com:8443/mqtt); TLS
+// connection options upgrade tcp / ws to ssl / wss
+func ParseBrokerURL(rawURL string, options ConnectionOptions) (BrokerURL, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return BrokerURL{}, fmt.Errorf("broker URL empty")
+	}
+
+	if !strings.Contains(rawURL, "://") {
+		rawURL = fmt.Sprintf("%v://%v", SchemeTCP, rawURL)
+	}
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return BrokerURL{}, fmt.Errorf("failed to parse broker URL %#+v because: %v", rawURL, err)
+	}
+
+	scheme, ok := schemeAliases[strings.ToLower(parsedURL.Scheme)]
+	if !ok {
+		return BrokerURL{}, fmt.Errorf("unsupported scheme %#+v in broker URL %#+v", parsedURL.Scheme, rawURL)
+	}
+
+	if options.IsTLS() {
+		if scheme == SchemeTCP {
+			scheme = SchemeSSL
+		} else if scheme == SchemeWS {
+			scheme = SchemeWSS
+		}
+	}
+
+	host := parsedURL.Hostname()
+	if host == "" {
+		return BrokerURL{}, fmt.Errorf("no host in broker URL %#+v", rawURL)
+	}
+
+	port := defaultPortByScheme[scheme]
+	if parsedURL.Port() != "" {
+		possiblePort, err := strconv.ParseInt(parsedURL.Port(), 10, 64)
+		if err != nil || possiblePort <= 0 || possiblePort > 65535 {
+			return BrokerURL{}, fmt.Errorf("invalid port %#+v in broker URL %#+v", parsedURL.Port(), rawURL)
+		}
+
+		port = int(possiblePort)
+	}
+
+	path := parsedURL.Path
+	if path != "" && scheme != SchemeWS && scheme != SchemeWSS {
+		return BrokerURL{}, fmt.Errorf("path %#+v in broker URL %#+v only makes sense for WebSocket transports", path, rawURL)
+	}
+
+	return BrokerURL{
+		Scheme: scheme,
+		Host:   host,
+		Port:   port,
+		Path:   path,
+	}, nil
+}
+
+func (u BrokerURL) IsTLS() bool {
+	return u.Scheme == SchemeSSL || u.Scheme == SchemeWSS
+}
+
+func (u BrokerURL) IsWebSocket() bool {
+	return u.Scheme == SchemeWS || u.Scheme == SchemeWSS
+}
+
+func (u BrokerURL) Address() string {
+	return net.JoinHostPort(u.Host, strconv.FormatInt(int64(u.Port), 10))
+}
+
+func (u BrokerURL) String() string {
+	return fmt.Sprintf("%v://%v%v", u.Scheme, u.Address(), u.Path)
+}
+
+func (u BrokerURL) checkSupportedBy(provider string, schemes ...string) error {
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v doesn't support the %v transport (of %v); supported transports are %v", provider, u.Scheme, u.String(), strings.Join(schemes, ", "))
+}
@@ -0,0 +1,61 @@
+package mqtt_client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBrokerURL(t *testing.T) {
+	t.Run("BareHost", func(t *testing.T) {
+		brokerURL, err := ParseBrokerURL("localhost", ConnectionOptions{})
+		require.NoError(t, err)
+		require.Equal(t, BrokerURL{Scheme: SchemeTCP, Host: "localhost", Port: 1883}, brokerURL)
+		require.Equal(t, "tcp://localhost:1883", brokerURL.String())
+	})
+
+	t.Run("HostAndPort", func(t *testing.T) {
+		brokerURL, err := ParseBrokerURL("localhost:1884", ConnectionOptions{})
+		require.NoError(t, err)
+		require.Equal(t, BrokerURL{Scheme: SchemeTCP, Host: "localhost", Port: 1884}, brokerURL)
+	})
+
+	t.Run("TLSOptionsUpgradeScheme", func(t *testing.T) {
+		brokerURL, err := ParseBrokerURL("localhost", ConnectionOptions{TLS: true})
+		require.NoError(t, err)
+		require.Equal(t, BrokerURL{Scheme: SchemeSSL, Host: "localhost", Port: 8883}, brokerURL)
+
+		brokerURL, err = ParseBrokerURL("ws://localhost:9001/mqtt", ConnectionOptions{CAFile: "/some/ca.pem"})
+		require.NoError(t, err)
+		require.Equal(t, BrokerURL{Scheme: SchemeWSS, Host: "localhost", Port: 9001, Path: "/mqtt"}, brokerURL)
+	})
+
+	t.Run("Aliases", func(t *testing.T) {
+		brokerURL, err := ParseBrokerURL("mqtts://broker.example.com", ConnectionOptions{})
+		require.NoError(t, err)
+		require.Equal(t, BrokerURL{Scheme: SchemeSSL, Host: "broker.example.com", Port: 8883}, brokerURL)
+		require.True(t, brokerURL.IsTLS())
+		require.False(t, brokerURL.IsWebSocket())
+	})
+
+	t.Run("WebSocket", func(t *testing.T) {
+		brokerURL, err := ParseBrokerURL("wss://broker.example.com/mqtt", ConnectionOptions{})
+		require.NoError(t, err)
+		require.Equal(t, BrokerURL{Scheme: SchemeWSS, Host: "broker.example.com", Port: 443, Path: "/mqtt"}, brokerURL)
+		require.Equal(t, "wss://broker.example.com:443/mqtt", brokerURL.String())
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, rawURL := range []string{"", "http://localhost", "tcp://localhost:0", "tcp://localhost:99999", "tcp://localhost/path", "tcp://:1883"} {
+			_, err := ParseBrokerURL(rawURL, ConnectionOptions{})
+			require.Error(t, err, rawURL)
+		}
+	})
+
+	t.Run("CheckSupportedBy", func(t *testing.T) {
+		brokerURL, err := ParseBrokerURL("ws://localhost", ConnectionOptions{})
+		require.NoError(t, err)
+		require.Error(t, brokerURL.checkSupportedBy("GMQ", SchemeTCP, SchemeSSL))
+		require.NoError(t, brokerURL.checkSupportedBy("Paho", SchemeTCP, SchemeSSL, SchemeWS, SchemeWSS))
+	})
+}
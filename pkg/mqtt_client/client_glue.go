@@ -1,96 +1,597 @@
 package mqtt_client
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/initialed85/glue/pkg/endpoint"
+	"github.com/initialed85/glue/pkg/helpers"
+	"github.com/initialed85/glue/pkg/network"
 	"github.com/initialed85/glue/pkg/topics"
+	"github.com/initialed85/glue/pkg/types"
+	"github.com/segmentio/ksuid"
 )
 
+const (
+	SchemeGlue                  = "glue"
+	DefaultGlueDiscoveryAddress = "239.192.137.1:27320"
+	defaultGlueDiscoveryPort    = 27320
+	glueWatchdogInterval        = time.Second * 5
+	glueMessageExpiry           = time.Second
+	GlueSecretEnvVar            = "GLUE_SECRET"
+
+	// as endpoint.NewManagerSimple has them (overridden by GLUE_DISCOVERY_RATE_MILLISECONDS and
+	// GLUE_DISCOVERY_RATE_TIMEOUT_MULTIPLIER)
+	DefaultGlueDiscoveryRate                  = time.Second
+	DefaultGlueDiscoveryRateTimeoutMultiplier = 2.0
+)
+
+func init() {
+	RegisterProvider("glue", func(config Config, errorHandler func(Client, error)) (Client, error) {
+		return getGlueClientForBrokerURL(config.URL, config.Username, config.Password, config.ConnectionOptions, errorHandler)
+	})
+}
+
+// GlueOptions is everything that scopes who a GlueClient talks to
+type GlueOptions struct {
+	NetworkID              int64
+	EndpointName           string       // empty means "Endpoint_<endpoint ID>"
+	ListenInterface        string       // empty means the interface with the default route
+	DiscoveryListenAddress *net.UDPAddr // where we listen for announcements
+	DiscoveryTargetAddress *net.UDPAddr // where we send announcements (a multicast group or a single peer)
+	SharedSecret           string       // if set, payloads are encrypted and authenticated (peers without it are ignored)
+
+	DiscoveryRate                  time.Duration // how often we announce ourselves; 0 means DefaultGlueDiscoveryRate
+	DiscoveryRateTimeoutMultiplier float64       // how many announcements a peer can miss; 0 means the default
+}
+
+// ParseGlueOptions starts with the GLUE_* env vars (as endpoint.NewManagerSimple does, plus GLUE_SECRET for the shared
+// secret) and then applies host if it's a glue:// URL, e.g.
+// glue://239.192.137.2:27321?interface=eth0&network=2&name=kitchen&secret=...; the host part is a multicast group
+// (announced to and listened on) or a unicast peer (announced to) and can be left out. Anything else in host is
+// ignored (the CLIs' -host has always been an MQTT broker, even with Glue as the provider). A username and password
+// (if there's a password) are the shared secret too, so they can't disagree with GLUE_SECRET or the URL.
+func ParseGlueOptions(host, username, password string) (GlueOptions, error) {
+	options, err := parseGlueHost(host)
+	if err != nil || password == "" {
+		return options, err
+	}
+
+	sharedSecret := fmt.Sprintf("%v:%v", username, password)
+	if options.SharedSecret != "" && options.SharedSecret != sharedSecret {
+		return options, fmt.Errorf("username / password and %v (or a secret in the %v:// URL) disagree about the shared secret", GlueSecretEnvVar, SchemeGlue)
+	}
+
+	options.SharedSecret = sharedSecret
+
+	return options, nil
+}
+
+func parseGlueHost(host string) (GlueOptions, error) {
+	options := GlueOptions{
+		NetworkID:                      1,
+		DiscoveryRate:                  DefaultGlueDiscoveryRate,
+		DiscoveryRateTimeoutMultiplier: DefaultGlueDiscoveryRateTimeoutMultiplier,
+	}
+
+	if discoveryRate, err := helpers.GetDiscoveryRateFromEnv(); err == nil {
+		options.DiscoveryRate = discoveryRate
+	}
+
+	if discoveryRateTimeoutMultiplier, err := helpers.GetDiscoveryRateTimeoutMultiplierFromEnv(); err == nil {
+		options.DiscoveryRateTimeoutMultiplier = discoveryRateTimeoutMultiplier
+	}
+
+	if networkID, err := helpers.GetNetworkIDFromEnv(); err == nil {
+		options.NetworkID = networkID
+	}
+
+	if endpointName, err := helpers.GetEndpointNameFromEnv(); err == nil {
+		options.EndpointName = endpointName
+	}
+
+	if listenInterface, err := helpers.GetListenInterfaceFromEnv(); err == nil {
+		options.ListenInterface = listenInterface
+	}
+
+	options.DiscoveryListenAddress, _ = net.ResolveUDPAddr("udp4", DefaultGlueDiscoveryAddress)
+	if discoveryListenAddress, err := helpers.GetDiscoveryListenAddressFromEnv(); err == nil {
+		options.DiscoveryListenAddress = discoveryListenAddress
+	}
+
+	options.DiscoveryTargetAddress, _ = net.ResolveUDPAddr("udp4", DefaultGlueDiscoveryAddress)
+	if discoveryTargetAddress, err := helpers.GetDiscoveryTargetAddressFromEnv(); err == nil {
+		options.DiscoveryTargetAddress = discoveryTargetAddress
+	}
+
+	options.SharedSecret = os.Getenv(GlueSecretEnvVar)
+
+	host = strings.TrimSpace(host)
+	if !strings.HasPrefix(strings.ToLower(host), SchemeGlue+"://") {
+		if host != "" {
+			log.Printf("ignoring host %#+v for Glue (it's brokerless; use a %v:// URL to scope discovery)", host, SchemeGlue)
+		}
+
+		return options, nil
+	}
+
+	parsedURL, err := url.Parse(host)
+	if err != nil {
+		return options, fmt.Errorf("failed to parse Glue URL %#+v because: %v", host, err)
+	}
+
+	if parsedURL.Hostname() != "" {
+		port := defaultGlueDiscoveryPort
+		if parsedURL.Port() != "" {
+			possiblePort, err := strconv.ParseInt(parsedURL.Port(), 10, 64)
+			if err != nil || possiblePort <= 0 || possiblePort > 65535 {
+				return options, fmt.Errorf("invalid port %#+v in Glue URL %#+v", parsedURL.Port(), host)
+			}
+
+			port = int(possiblePort)
+		}
+
+		discoveryAddress, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(parsedURL.Hostname(), strconv.Itoa(port)))
+		if err != nil {
+			return options, fmt.Errorf("failed to resolve discovery address in Glue URL %#+v because: %v", host, err)
+		}
+
+		options.DiscoveryTargetAddress = discoveryAddress
+		if discoveryAddress.IP.IsMulticast() {
+			options.DiscoveryListenAddress = discoveryAddress
+		} else {
+			// a unicast peer answers with everything it knows about, so we need to be listening on that port too
+			options.DiscoveryListenAddress = &net.UDPAddr{IP: net.IPv4zero, Port: port}
+		}
+	}
+
+	query := parsedURL.Query()
+
+	if rawNetworkID := query.Get("network"); rawNetworkID != "" {
+		options.NetworkID, err = strconv.ParseInt(rawNetworkID, 10, 64)
+		if err != nil {
+			return options, fmt.Errorf("failed to parse network %#+v in Glue URL %#+v because: %v", rawNetworkID, host, err)
+		}
+	}
+
+	if endpointName := query.Get("name"); endpointName != "" {
+		options.EndpointName = endpointName
+	}
+
+	if listenInterface := query.Get("interface"); listenInterface != "" {
+		options.ListenInterface = listenInterface
+	}
+
+	if sharedSecret := query.Get("secret"); sharedSecret != "" {
+		options.SharedSecret = sharedSecret
+	}
+
+	return options, nil
+}
+
+// glueSealer encrypts payloads with AES-GCM (using a key derived from the shared secret), with the topic as
+// additional data so that a payload can't be replayed onto another topic; topic names themselves are in the clear
+type glueSealer struct {
+	aead cipher.AEAD
+}
+
+func newGlueSealer(sharedSecret string) (*glueSealer, error) {
+	key := sha256.Sum256([]byte("mqtt_things/glue/" + sharedSecret))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &glueSealer{aead: aead}, nil
+}
+
+func (s *glueSealer) seal(topic string, payload []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(payload)+s.aead.Overhead())
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce because: %v", err)
+	}
+
+	return s.aead.Seal(nonce, nonce, payload, []byte(topic)), nil
+}
+
+func (s *glueSealer) open(topic string, sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize()+s.aead.Overhead() {
+		return nil, fmt.Errorf("sealed payload too short (%v bytes)", len(sealed))
+	}
+
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+
+	return s.aead.Open(nil, nonce, ciphertext, []byte(topic))
+}
+
+// GlueClient does its own routing because Glue only knows exact topics and "#" (and a topic with an exact subscription
+// is never offered to "#")
 type GlueClient struct {
-	endpointManager *endpoint.Manager
+	mu                   sync.Mutex
+	options              GlueOptions
+	endpointID           ksuid.KSUID
+	sealer               *glueSealer
+	errorHandler         func(Client, error)
+	endpointManager      *endpoint.Manager
+	stopWatchdog         chan struct{}
+	callbackByFilter     map[string]func(message Message)
+	subscribedGlueTopics map[string]struct{}
+	lastPeerObserverID   uint64
+	peerObserverByID     map[uint64]func(peer string, added bool)
 }
 
 func NewGlueClient(host, username, password string, errorHandler func(Client, error)) (*GlueClient, error) {
-	_ = host
-	_ = username
-	_ = password
-	_ = errorHandler
-
-	endpointManager, err := endpoint.NewManagerSimple()
+	options, err := ParseGlueOptions(host, username, password)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewGlueClientWithOptions(options, errorHandler)
+}
+
+// NewGlueClientWithOptions keeps the same endpoint ID across reconnects, so that peers see us come back rather than
+// a new endpoint turning up (and the old one lingering until it times out)
+func NewGlueClientWithOptions(options GlueOptions, errorHandler func(Client, error)) (*GlueClient, error) {
 	c := GlueClient{
-		endpointManager: endpointManager,
+		options:              options,
+		endpointID:           ksuid.New(),
+		errorHandler:         errorHandler,
+		callbackByFilter:     make(map[string]func(message Message)),
+		subscribedGlueTopics: make(map[string]struct{}),
+		peerObserverByID:     make(map[uint64]func(peer string, added bool)),
+	}
+
+	if endpointID, err := helpers.GetEndpointIDFromEnv(); err == nil {
+		c.endpointID = endpointID
+	}
+
+	if options.SharedSecret != "" {
+		sealer, err := newGlueSealer(options.SharedSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up shared secret because: %v", err)
+		}
+
+		c.sealer = sealer
 	}
 
 	return &c, nil
 }
 
+func (c *GlueClient) String() string {
+	return fmt.Sprintf("GlueClient{%v}", c.endpointID)
+}
+
+// EndpointID is what Message.Origin is set to for messages we published
+func (c *GlueClient) EndpointID() string {
+	return c.endpointID.String()
+}
+
+// AddPeerObserver registers observer to be called (on a goroutine of its own) whenever a peer (named by its endpoint
+// name) turns up or goes away; call the returned func to remove it
+func (c *GlueClient) AddPeerObserver(observer func(peer string, added bool)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastPeerObserverID++
+	id := c.lastPeerObserverID
+
+	c.peerObserverByID[id] = observer
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.peerObserverByID, id)
+	}
+}
+
+func (c *GlueClient) handlePeer(container *types.Container, added bool) {
+	c.mu.Lock()
+	observers := make([]func(peer string, added bool), 0, len(c.peerObserverByID))
+	for _, observer := range c.peerObserverByID {
+		observers = append(observers, observer)
+	}
+	c.mu.Unlock()
+
+	for _, observer := range observers {
+		go observer(container.SourceEndpointName, added)
+	}
+}
+
+func (c *GlueClient) SetWill(topic string, qos byte, retained bool, payload interface{}) error {
+	// Glue is brokerless, so there's nothing that could deliver a will on our behalf
+	return nil
+}
+
+func (c *GlueClient) getEndpointManager() (*endpoint.Manager, string, error) {
+	listenInterface := c.options.ListenInterface
+	if listenInterface == "" {
+		defaultInterfaceName, err := network.GetDefaultInterfaceName()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to find the default interface because: %v", err)
+		}
+
+		listenInterface = defaultInterfaceName
+	}
+
+	err := checkInterfaceUp(listenInterface)
+	if err != nil {
+		return nil, "", err
+	}
+
+	listenAddress, err := helpers.GetListenAddressFromEnv()
+	if err != nil {
+		listenPort, err := network.GetFreePort()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to find a free port because: %v", err)
+		}
+
+		listenAddress = &net.UDPAddr{IP: net.IPv4zero, Port: listenPort}
+	}
+
+	endpointName := c.options.EndpointName
+	if endpointName == "" {
+		endpointName = fmt.Sprintf("Endpoint_%v", c.endpointID)
+	}
+
+	discoveryRate := c.options.DiscoveryRate
+	if discoveryRate <= 0 {
+		discoveryRate = DefaultGlueDiscoveryRate
+	}
+
+	discoveryRateTimeoutMultiplier := c.options.DiscoveryRateTimeoutMultiplier
+	if discoveryRateTimeoutMultiplier <= 0 {
+		discoveryRateTimeoutMultiplier = DefaultGlueDiscoveryRateTimeoutMultiplier
+	}
+
+	endpointManager := endpoint.NewManager(
+		c.options.NetworkID,
+		c.endpointID,
+		endpointName,
+		listenAddress,
+		c.options.DiscoveryListenAddress,
+		c.options.DiscoveryTargetAddress,
+		listenInterface,
+		discoveryRate,
+		discoveryRateTimeoutMultiplier,
+		func(container *types.Container) {
+			c.handlePeer(container, true)
+		},
+		func(container *types.Container) {
+			c.handlePeer(container, false)
+		},
+	)
+
+	return endpointManager, listenInterface, nil
+}
+
+func checkInterfaceUp(interfaceName string) error {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to find interface %#+v because: %v", interfaceName, err)
+	}
+
+	if iface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("interface %#+v is down", interfaceName)
+	}
+
+	return nil
+}
+
+// watchdog stands in for the connection loss that a broker-based client would see; there's no connection to lose, but
+// if our interface goes away then so do all our peers
+func (c *GlueClient) watchdog(listenInterface string, stop chan struct{}) {
+	ticker := time.NewTicker(glueWatchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := checkInterfaceUp(listenInterface)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("%+v caught; firing %p", err, c.errorHandler)
+
+		go c.errorHandler(c, err)
+
+		return
+	}
+}
+
 func (c *GlueClient) Connect() error {
-	endpointManager, err := endpoint.NewManagerSimple()
+	// a Connect without a Disconnect (e.g. a retry) mustn't leave the old endpoint running
+	c.stop()
+
+	endpointManager, listenInterface, err := c.getEndpointManager()
 	if err != nil {
 		return err
 	}
 
+	endpointManager.Start()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.endpointManager = endpointManager
-	c.endpointManager.Start()
+	c.subscribedGlueTopics = make(map[string]struct{})
+
+	if c.errorHandler != nil {
+		c.stopWatchdog = make(chan struct{})
+		go c.watchdog(listenInterface, c.stopWatchdog)
+	}
 
 	return nil
 }
 
 func (c *GlueClient) Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error {
-	stringPayload := payload.(string)
-	bytePayload := []byte(stringPayload)
+	c.mu.Lock()
+	endpointManager := c.endpointManager
+	c.mu.Unlock()
+
+	if endpointManager == nil {
+		return fmt.Errorf("endpointManager is nil (probably not connected)")
+	}
 
-	return c.endpointManager.Publish(
+	payloadBytes := getPayloadBytes(payload)
+
+	if c.sealer != nil {
+		sealed, err := c.sealer.seal(topic, payloadBytes)
+		if err != nil {
+			return err
+		}
+
+		payloadBytes = sealed
+	}
+
+	return endpointManager.Publish(
 		topic,
 		"bytes",
-		time.Second,
-		bytePayload,
+		glueMessageExpiry,
+		payloadBytes,
 	)
 }
 
+func (c *GlueClient) handleReceive(topicsMessage *topics.Message) {
+	payload := topicsMessage.Payload
+
+	if c.sealer != nil {
+		opened, err := c.sealer.open(topicsMessage.TopicName, payload)
+		if err != nil {
+			log.Printf("warning: ignoring message on %v from %v because it couldn't be opened with our shared secret: %v", topicsMessage.TopicName, topicsMessage.EndpointName, err)
+			return
+		}
+
+		payload = opened
+	}
+
+	// Glue has no notion of QoS or retained messages
+	message := Message{
+		Received:   topicsMessage.Timestamp,
+		Topic:      topicsMessage.TopicName,
+		MessageID:  uint16(topicsMessage.SequenceNumber),
+		QoS:        AtMostOnce,
+		Payload:    string(payload),
+		RawPayload: payload,
+		Origin:     topicsMessage.EndpointID.String(),
+	}
+
+	callbacks := make([]func(message Message), 0)
+
+	c.mu.Lock()
+	for filter, callback := range c.callbackByFilter {
+		if !TopicMatches(filter, message.Topic) {
+			continue
+		}
+
+		callbacks = append(callbacks, callback)
+	}
+	c.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(message)
+	}
+}
+
 func (c *GlueClient) Subscribe(topic string, qos byte, callback func(message Message)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.endpointManager == nil {
 		return fmt.Errorf("endpointManager is nil (probably not connected)")
 	}
 
-	return c.endpointManager.Subscribe(
-		topic,
-		"bytes",
-		func(topicsMessage *topics.Message) {
-			message := Message{
-				Received:  topicsMessage.Timestamp,
-				Topic:     topicsMessage.TopicName,
-				MessageID: uint16(topicsMessage.SequenceNumber),
-				Payload:   string(topicsMessage.Payload),
-			}
+	if IsSharedSubscription(topic) {
+		return fmt.Errorf("Glue doesn't support shared subscriptions (%v)", topic)
+	}
 
-			callback(message)
-		},
-	)
+	glueTopic := topic
+	if IsTopicFilter(topic) {
+		glueTopic = "#"
+	}
+
+	if _, ok := c.subscribedGlueTopics[glueTopic]; !ok {
+		err := c.endpointManager.Subscribe(
+			glueTopic,
+			"bytes",
+			c.handleReceive,
+		)
+		if err != nil {
+			return err
+		}
+
+		c.subscribedGlueTopics[glueTopic] = struct{}{}
+	}
+
+	c.callbackByFilter[topic] = callback
+
+	return nil
 }
 
+// Unsubscribe only forgets the callback; Glue's Unsubscribe leaves a nil subscription behind that breaks a later
+// Subscribe to the same topic, so the Glue subscription lives until the next Connect
 func (c *GlueClient) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.endpointManager == nil {
 		return fmt.Errorf("endpointManager is nil (probably not connected)")
 	}
 
-	return c.endpointManager.Unsubscribe(topic)
+	delete(c.callbackByFilter, topic)
+
+	return nil
+}
+
+// stop stops the endpoint (if there is one) without holding the lock, as it may be waiting on handleReceive; it returns
+// false if there was nothing to stop
+func (c *GlueClient) stop() bool {
+	c.mu.Lock()
+	endpointManager, stopWatchdog := c.endpointManager, c.stopWatchdog
+	c.endpointManager, c.stopWatchdog = nil, nil
+	c.mu.Unlock()
+
+	if stopWatchdog != nil {
+		close(stopWatchdog)
+	}
+
+	if endpointManager == nil {
+		return false
+	}
+
+	endpointManager.Stop()
+
+	return true
 }
 
 func (c *GlueClient) Disconnect() error {
-	if c.endpointManager == nil {
+	if !c.stop() {
 		return fmt.Errorf("endpointManager is nil (probably not connected)")
 	}
 
-	c.endpointManager.Stop()
-
-	c.endpointManager = nil
-
 	return nil
 }
@@ -0,0 +1,176 @@
+package mqtt_client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/initialed85/glue/pkg/topics"
+	"github.com/initialed85/glue/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlueClient(t *testing.T) {
+	t.Run("ParseGlueOptions", func(t *testing.T) {
+		defaultAddress, err := net.ResolveUDPAddr("udp4", DefaultGlueDiscoveryAddress)
+		require.NoError(t, err)
+
+		// a broker host is ignored, as it always has been
+		options, err := ParseGlueOptions("some-broker:1883", "", "")
+		require.NoError(t, err)
+		require.Equal(t, GlueOptions{
+			NetworkID:                      1,
+			DiscoveryListenAddress:         defaultAddress,
+			DiscoveryTargetAddress:         defaultAddress,
+			DiscoveryRate:                  DefaultGlueDiscoveryRate,
+			DiscoveryRateTimeoutMultiplier: DefaultGlueDiscoveryRateTimeoutMultiplier,
+		}, options)
+
+		options, err = ParseGlueOptions("glue://239.192.137.2?interface=eth1&network=2&name=kitchen&secret=some-secret", "", "")
+		require.NoError(t, err)
+		require.Equal(t, int64(2), options.NetworkID)
+		require.Equal(t, "kitchen", options.EndpointName)
+		require.Equal(t, "eth1", options.ListenInterface)
+		require.Equal(t, "239.192.137.2:27320", options.DiscoveryListenAddress.String())
+		require.Equal(t, "239.192.137.2:27320", options.DiscoveryTargetAddress.String())
+		require.Equal(t, "some-secret", options.SharedSecret)
+
+		options, err = ParseGlueOptions("glue://192.168.1.2:27321", "", "")
+		require.NoError(t, err)
+		require.Equal(t, "0.0.0.0:27321", options.DiscoveryListenAddress.String())
+		require.Equal(t, "192.168.1.2:27321", options.DiscoveryTargetAddress.String())
+		require.Equal(t, "", options.SharedSecret)
+
+		options, err = ParseGlueOptions("glue://?interface=eth1", "", "")
+		require.NoError(t, err)
+		require.Equal(t, "eth1", options.ListenInterface)
+		require.Equal(t, defaultAddress, options.DiscoveryTargetAddress)
+
+		_, err = ParseGlueOptions("glue://239.192.137.2:0", "", "")
+		require.Error(t, err)
+
+		_, err = ParseGlueOptions("glue://?network=lots", "", "")
+		require.Error(t, err)
+
+		// the shared secret comes from its own env var (never the MQTT credentials), and the URL wins over it
+		t.Setenv(GlueSecretEnvVar, "some-env-secret")
+
+		options, err = ParseGlueOptions("some-broker:1883", "", "")
+		require.NoError(t, err)
+		require.Equal(t, "some-env-secret", options.SharedSecret)
+
+		options, err = ParseGlueOptions("glue://?secret=some-secret", "", "")
+		require.NoError(t, err)
+		require.Equal(t, "some-secret", options.SharedSecret)
+
+		// credentials are the shared secret too, as long as they don't disagree with the env or the URL
+		t.Setenv(GlueSecretEnvVar, "")
+
+		options, err = ParseGlueOptions("some-broker:1883", "some-user", "some-password")
+		require.NoError(t, err)
+		require.Equal(t, "some-user:some-password", options.SharedSecret)
+
+		_, err = ParseGlueOptions("glue://?secret=some-secret", "some-user", "some-password")
+		require.Error(t, err)
+
+		options, err = ParseGlueOptions("glue://?secret=some-user:some-password", "some-user", "some-password")
+		require.NoError(t, err)
+		require.Equal(t, "some-user:some-password", options.SharedSecret)
+
+		t.Setenv("GLUE_DISCOVERY_RATE_MILLISECONDS", "250")
+		t.Setenv("GLUE_DISCOVERY_RATE_TIMEOUT_MULTIPLIER", "4")
+
+		options, err = ParseGlueOptions("", "", "")
+		require.NoError(t, err)
+		require.Equal(t, time.Millisecond*250, options.DiscoveryRate)
+		require.Equal(t, 4.0, options.DiscoveryRateTimeoutMultiplier)
+	})
+
+	t.Run("ProviderRejectsTLS", func(t *testing.T) {
+		_, err := getGlueClientForBrokerURL("ssl://some-broker", "", "", ConnectionOptions{}, nil)
+		require.Error(t, err)
+
+		_, err = getGlueClientForBrokerURL("glue://", "", "", ConnectionOptions{CAFile: "/some/ca.pem"}, nil)
+		require.Error(t, err)
+
+		_, err = getGlueClientForBrokerURL("glue://", "", "", ConnectionOptions{}, nil)
+		require.NoError(t, err)
+	})
+
+	t.Run("SharedSecret", func(t *testing.T) {
+		sealer, err := newGlueSealer("some-secret")
+		require.NoError(t, err)
+
+		sealed, err := sealer.seal("home/a/get", []byte("1"))
+		require.NoError(t, err)
+		require.NotContains(t, string(sealed), "1")
+
+		opened, err := sealer.open("home/a/get", sealed)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), opened)
+
+		// bound to the topic
+		_, err = sealer.open("home/b/get", sealed)
+		require.Error(t, err)
+
+		otherSealer, err := newGlueSealer("some-other-secret")
+		require.NoError(t, err)
+
+		_, err = otherSealer.open("home/a/get", sealed)
+		require.Error(t, err)
+
+		_, err = sealer.open("home/a/get", []byte("1"))
+		require.Error(t, err)
+	})
+
+	t.Run("HandleReceiveDropsUnauthenticated", func(t *testing.T) {
+		c, err := NewGlueClient("glue://", "some-user", "some-password", nil)
+		require.NoError(t, err)
+
+		received := make([]string, 0)
+		c.callbackByFilter["home/+/get"] = func(message Message) {
+			received = append(received, message.Payload)
+		}
+
+		sealed, err := c.sealer.seal("home/a/get", []byte("1"))
+		require.NoError(t, err)
+
+		for _, payload := range [][]byte{sealed, []byte("2")} {
+			c.handleReceive(&topics.Message{
+				Timestamp: time.Now(),
+				TopicName: "home/a/get",
+				Payload:   payload,
+			})
+		}
+
+		require.Equal(t, []string{"1"}, received)
+	})
+
+	t.Run("PeerObserversDontBlock", func(t *testing.T) {
+		c, err := NewGlueClient("", "", "", nil)
+		require.NoError(t, err)
+
+		peers := make(chan string, 1)
+		release := make(chan struct{})
+		removeObserver := c.AddPeerObserver(func(peer string, added bool) {
+			peers <- peer
+			<-release
+		})
+
+		// Glue calls this from its own goroutine, which mustn't be held up by (e.g.) a resync
+		c.handlePeer(&types.Container{SourceEndpointName: "some-peer"}, true)
+		close(release)
+		require.Equal(t, "some-peer", <-peers)
+
+		removeObserver()
+	})
+
+	t.Run("NotConnected", func(t *testing.T) {
+		c, err := NewGlueClient("", "", "", nil)
+		require.NoError(t, err)
+
+		require.Error(t, c.Publish("home/a/get", AtMostOnce, false, "1"))
+		require.Error(t, c.Subscribe("home/a/get", AtMostOnce, func(message Message) {}))
+		require.Error(t, c.Disconnect())
+	})
+}
@@ -1,11 +1,8 @@
 package mqtt_client
 
 import (
-	"crypto/tls"
 	"fmt"
 	"log"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/yosssi/gmq/mqtt/client"
@@ -19,49 +16,87 @@ func EnableGMQTestMode(host string) {
 	GMQTestHost = host
 }
 
+func init() {
+	RegisterProvider("gmq", func(config Config, errorHandler func(Client, error)) (Client, error) {
+		c, err := NewGMQClientFromConfig(config, errorHandler)
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	})
+}
+
 type GMQClient struct {
-	connectOptions client.ConnectOptions
-	options        client.Options
-	client         *client.Client
-	errorHandler   func(Client, error)
+	brokerURL         BrokerURL
+	connectionOptions ConnectionOptions
+	connectOptions    client.ConnectOptions
+	options           client.Options
+	client            *client.Client
+	errorHandler      func(Client, error)
 }
 
 func NewGMQClient(host, username, password string, errorHandler func(Client, error)) (c *GMQClient) {
-	port := 1883
-
-	if strings.Contains(host, ":") {
-		parts := strings.Split(host, ":")
-		rawPort := parts[1]
-		possiblePort, _ := strconv.ParseInt(rawPort, 10, 64)
-		if possiblePort > 0 {
-			host = parts[0]
-			port = int(possiblePort)
-		}
+	c, err := NewGMQClientWithOptions(host, username, password, ConnectionOptions{}, errorHandler)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return c
+}
+
+func NewGMQClientWithOptions(host, username, password string, options ConnectionOptions, errorHandler func(Client, error)) (c *GMQClient, err error) {
+	return NewGMQClientFromConfig(
+		Config{URL: host, Username: username, Password: password, ConnectionOptions: options},
+		errorHandler,
+	)
+}
+
+// NewGMQClientFromConfig ignores Config.WriteTimeout as GMQ has no such thing
+func NewGMQClientFromConfig(config Config, errorHandler func(Client, error)) (c *GMQClient, err error) {
+	brokerURL, err := ParseBrokerURL(config.URL, config.ConnectionOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = brokerURL.checkSupportedBy("GMQ", SchemeTCP, SchemeSSL)
+	if err != nil {
+		return nil, err
+	}
+
+	// historically a bare host:8883 implied TLS for GMQ
+	if brokerURL.Scheme == SchemeTCP && brokerURL.Port == 8883 {
+		brokerURL.Scheme = SchemeSSL
 	}
 
 	if GMQTestMode {
-		host = GMQTestHost
+		brokerURL.Host = GMQTestHost
 	}
 
-	clientID := getClientID("gmq")
+	clientID := config.getClientID("gmq")
 
 	c = &GMQClient{
-		errorHandler: errorHandler,
+		brokerURL:         brokerURL,
+		connectionOptions: config.ConnectionOptions,
+		errorHandler:      errorHandler,
 	}
 
 	c.connectOptions = client.ConnectOptions{
-		Network: "tcp",
-		Address: fmt.Sprintf("%v:%v", host, port),
-		// CONNACKTimeout:  time.Second * 10,
-		// PINGRESPTimeout: time.Second * 10,
+		Network:  "tcp",
+		Address:  brokerURL.Address(),
 		ClientID: []byte(clientID),
-		UserName: []byte(username),
-		Password: []byte(password),
-		// KeepAlive:       5,
+		UserName: []byte(config.Username),
+		Password: []byte(config.Password),
+	}
+
+	// left alone these fall back to GMQ's own defaults
+	if config.ConnectTimeout > 0 {
+		c.connectOptions.CONNACKTimeout = config.ConnectTimeout
+		c.connectOptions.PINGRESPTimeout = config.ConnectTimeout
 	}
 
-	if port == 8883 {
-		c.connectOptions.TLSConfig = &tls.Config{}
+	if config.Keepalive > 0 {
+		c.connectOptions.KeepAlive = getSecondsOrDefault(config.Keepalive, 0)
 	}
 
 	c.options = client.Options{
@@ -76,10 +111,28 @@ func NewGMQClient(host, username, password string, errorHandler func(Client, err
 		},
 	}
 
-	return c
+	return c, nil
+}
+
+func (c *GMQClient) SetWill(topic string, qos byte, retained bool, payload interface{}) error {
+	c.connectOptions.WillTopic = []byte(topic)
+	c.connectOptions.WillMessage = getPayloadBytes(payload)
+	c.connectOptions.WillQoS = qos
+	c.connectOptions.WillRetain = retained
+
+	return nil
 }
 
 func (c *GMQClient) Connect() error {
+	if c.brokerURL.IsTLS() {
+		tlsConfig, err := c.connectionOptions.GetTLSConfig()
+		if err != nil {
+			return err
+		}
+
+		c.connectOptions.TLSConfig = tlsConfig
+	}
+
 	c.client = client.New(&c.options)
 
 	return c.client.Connect(&c.connectOptions)
@@ -95,21 +148,36 @@ func (c *GMQClient) Publish(topic string, qos byte, retained bool, payload inter
 			QoS:       qos,
 			Retain:    retained,
 			TopicName: []byte(topic),
-			Message:   []byte(fmt.Sprintf("%v", payload)),
+			Message:   getPayloadBytes(payload),
 		},
 	)
 }
 
+// ReportsRetained is false because GMQ only hands us the topic and the payload (see Subscribe)
+func (c *GMQClient) ReportsRetained() bool {
+	return false
+}
+
 func (c *GMQClient) Subscribe(topic string, qos byte, callback func(message Message)) error {
 	if c.client == nil {
 		return fmt.Errorf("client is nil (probably not connected)")
 	}
+
+	// GMQ matches incoming topics against the filter as given, so a $share/... filter would never fire
+	if IsSharedSubscription(topic) {
+		return fmt.Errorf("GMQ doesn't support shared subscriptions (%v)", topic)
+	}
+
+	// GMQ only hands us the topic and the payload, so the best we can do for QoS is what we asked for (and we can't
+	// know about retained / duplicate at all)
 	wrappedCallback := func(topicName, message []byte) {
 		callback(Message{
-			Received:  time.Now(),
-			Topic:     string(topicName),
-			MessageID: 0,
-			Payload:   string(message),
+			Received:   time.Now(),
+			Topic:      string(topicName),
+			MessageID:  0,
+			QoS:        qos,
+			Payload:    string(message),
+			RawPayload: message,
 		})
 	}
 
@@ -2,6 +2,7 @@ package mqtt_client
 
 import (
 	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -28,34 +29,241 @@ func getQosLevel(qos byte) (libmqtt.QosLevel, error) {
 	}
 }
 
+type libMQTTPacketHandler func(client libmqtt.Client, p *libmqtt.PublishPacket)
+
+// libMQTTRouter stands in for libmqtt's default TextRouter, which only does exact matches (so handlers for wildcard
+// subscriptions never fired); it also hands the whole packet over so we can get at the retained / duplicate flags
+type libMQTTRouter struct {
+	mu              sync.Mutex
+	handlerByFilter map[string]libMQTTPacketHandler
+}
+
+func newLibMQTTRouter() *libMQTTRouter {
+	return &libMQTTRouter{
+		handlerByFilter: make(map[string]libMQTTPacketHandler),
+	}
+}
+
+func (r *libMQTTRouter) Name() string {
+	return "libMQTTRouter"
+}
+
+func (r *libMQTTRouter) Handle(topic string, h libmqtt.TopicHandleFunc) {
+	r.handlePacket(topic, func(client libmqtt.Client, p *libmqtt.PublishPacket) {
+		h(client, p.TopicName, p.Qos, p.Payload)
+	})
+}
+
+func (r *libMQTTRouter) handlePacket(topic string, h libMQTTPacketHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlerByFilter[topic] = h
+}
+
+func (r *libMQTTRouter) remove(topic string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.handlerByFilter, topic)
+}
+
+func (r *libMQTTRouter) Dispatch(client libmqtt.Client, p *libmqtt.PublishPacket) {
+	handlers := make([]libMQTTPacketHandler, 0)
+
+	r.mu.Lock()
+	for filter, h := range r.handlerByFilter {
+		if !TopicMatches(filter, p.TopicName) {
+			continue
+		}
+
+		handlers = append(handlers, h)
+	}
+	r.mu.Unlock()
+
+	for _, h := range handlers {
+		h(client, p)
+	}
+}
+
+func init() {
+	RegisterProvider("libmqtt", func(config Config, errorHandler func(Client, error)) (Client, error) {
+		c, err := NewLibMQTTClientFromConfig(config, errorHandler)
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	})
+
+	RegisterProvider("libmqtt5", func(config Config, errorHandler func(Client, error)) (Client, error) {
+		c, err := NewLibMQTT5ClientFromConfig(config, errorHandler)
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	})
+}
+
+func getLibMQTTPublishProps(properties Properties) *libmqtt.PublishProps {
+	props := &libmqtt.PublishProps{
+		RespTopic:             properties.ResponseTopic,
+		CorrelationData:       properties.CorrelationData,
+		ContentType:           properties.ContentType,
+		MessageExpiryInterval: uint32(properties.MessageExpiry.Round(time.Second) / time.Second),
+	}
+
+	if len(properties.UserProperties) > 0 {
+		props.UserProps = make(libmqtt.UserProps)
+		for k, v := range properties.UserProperties {
+			props.UserProps.Set(k, v)
+		}
+	}
+
+	return props
+}
+
+func getPropertiesFromLibMQTT(props *libmqtt.PublishProps) *Properties {
+	if props == nil {
+		return &Properties{}
+	}
+
+	properties := &Properties{
+		ResponseTopic:   props.RespTopic,
+		CorrelationData: props.CorrelationData,
+		ContentType:     props.ContentType,
+		MessageExpiry:   time.Duration(props.MessageExpiryInterval) * time.Second,
+	}
+
+	if len(props.UserProps) > 0 {
+		// we only expose the first value for each key (MQTT 5 permits repeats)
+		properties.UserProperties = make(map[string]string)
+		for k := range props.UserProps {
+			v, _ := props.UserProps.Get(k)
+			properties.UserProperties[k] = v
+		}
+	}
+
+	return properties
+}
+
 type LibMQTTClient struct {
-	clientID, host, username, password string
-	client                             libmqtt.Client
-	errorHandler                       func(Client, error)
+	clientID, username, password string
+	brokerURL                    BrokerURL
+	connectionOptions            ConnectionOptions
+	keepalive, dialTimeout       uint16
+	protocolVersion              libmqtt.ProtoVersion
+	willOption                   libmqtt.Option
+	router                       *libMQTTRouter
+	client                       libmqtt.Client
+	errorHandler                 func(Client, error)
 }
 
 func NewLibMQTTClient(host, username, password string, errorHandler func(Client, error)) (c *LibMQTTClient) {
+	c, err := NewLibMQTTClientWithOptions(host, username, password, ConnectionOptions{}, errorHandler)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return c
+}
+
+func NewLibMQTTClientWithOptions(host, username, password string, options ConnectionOptions, errorHandler func(Client, error)) (c *LibMQTTClient, err error) {
+	return NewLibMQTTClientFromConfig(
+		Config{URL: host, Username: username, Password: password, ConnectionOptions: options},
+		errorHandler,
+	)
+}
+
+// NewLibMQTTClientFromConfig ignores Config.WriteTimeout as libmqtt has no such thing
+func NewLibMQTTClientFromConfig(config Config, errorHandler func(Client, error)) (c *LibMQTTClient, err error) {
+	host := config.URL
 	if LibMQTTTestMode {
 		host = LibMQTTTestHost
 	}
 
-	clientID := getClientID("libmqtt")
+	brokerURL, err := ParseBrokerURL(host, config.ConnectionOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = brokerURL.checkSupportedBy("LibMQTT", SchemeTCP, SchemeSSL, SchemeWS, SchemeWSS)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID := config.getClientID("libmqtt")
 
 	return &LibMQTTClient{
-		clientID:     clientID,
-		host:         host,
-		username:     username,
-		password:     password,
-		errorHandler: errorHandler,
+		clientID:          clientID,
+		brokerURL:         brokerURL,
+		username:          config.Username,
+		password:          config.Password,
+		keepalive:         getSecondsOrDefault(config.Keepalive, 5),
+		dialTimeout:       getSecondsOrDefault(config.ConnectTimeout, 5),
+		connectionOptions: config.ConnectionOptions,
+		protocolVersion:   libmqtt.V311,
+		router:            newLibMQTTRouter(),
+		errorHandler:      errorHandler,
+	}, nil
+}
+
+// NewLibMQTT5ClientFromConfig is NewLibMQTTClientFromConfig but speaking MQTT 5 (so it supports properties); there's
+// no falling back to 3.1.1 if the broker doesn't
+func NewLibMQTT5ClientFromConfig(config Config, errorHandler func(Client, error)) (c *LibMQTTClient, err error) {
+	c, err = NewLibMQTTClientFromConfig(config, errorHandler)
+	if err != nil {
+		return nil, err
 	}
+
+	c.clientID = config.getClientID("libmqtt5")
+	c.protocolVersion = libmqtt.V5
+
+	return c, nil
+}
+
+func (c *LibMQTTClient) SetWill(topic string, qos byte, retained bool, payload interface{}) error {
+	qosLevel, err := getQosLevel(qos)
+	if err != nil {
+		return err
+	}
+
+	c.willOption = libmqtt.WithWill(topic, qosLevel, retained, getPayloadBytes(payload))
+
+	return nil
 }
 
 func (c *LibMQTTClient) Connect() error {
+	server := c.brokerURL.Address()
+	var connOptions []libmqtt.Option
+
+	if c.brokerURL.IsTLS() {
+		tlsConfig, err := c.connectionOptions.GetTLSConfig()
+		if err != nil {
+			return err
+		}
+
+		connOptions = append(connOptions, libmqtt.WithCustomTLS(tlsConfig))
+	}
+
+	if c.willOption != nil {
+		connOptions = append(connOptions, c.willOption)
+	}
+
+	if c.brokerURL.IsWebSocket() {
+		// libmqtt prepends ws:// or wss:// depending on whether or not there's a TLS config
+		server = c.brokerURL.Address() + c.brokerURL.Path
+		connOptions = append(connOptions, libmqtt.WithWebSocketConnector(time.Duration(c.dialTimeout)*time.Second, nil))
+	}
+
 	newClient, err := libmqtt.NewClient(
-		libmqtt.WithDialTimeout(5),
+		libmqtt.WithDialTimeout(c.dialTimeout),
 		libmqtt.WithClientID(c.clientID),
+		libmqtt.WithVersion(c.protocolVersion, false),
 		libmqtt.WithIdentity(c.username, c.password),
-		libmqtt.WithKeepalive(5, 1.2),
+		libmqtt.WithKeepalive(c.keepalive, 1.2),
+		libmqtt.WithRouter(c.router),
 		libmqtt.WithNetHandleFunc(func(_ libmqtt.Client, _ string, err error) {
 			go func() {
 				time.Sleep(time.Second)
@@ -86,9 +294,11 @@ func (c *LibMQTTClient) Connect() error {
 
 	wg.Add(1)
 
+	connOptions = append(connOptions, libmqtt.WithConnHandleFunc(connHandleFunc))
+
 	err = c.client.ConnectServer(
-		fmt.Sprintf("%v:1883", c.host),
-		libmqtt.WithConnHandleFunc(connHandleFunc),
+		server,
+		connOptions...,
 	)
 
 	if err != nil {
@@ -101,6 +311,22 @@ func (c *LibMQTTClient) Connect() error {
 }
 
 func (c *LibMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error {
+	return c.publish(topic, qos, retained, payload, nil)
+}
+
+func (c *LibMQTTClient) SupportsProperties() bool {
+	return c.protocolVersion == libmqtt.V5
+}
+
+func (c *LibMQTTClient) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties Properties, quiet ...bool) error {
+	if !c.SupportsProperties() {
+		return fmt.Errorf("properties need MQTT 5 (use the libmqtt5 provider)")
+	}
+
+	return c.publish(topic, qos, retained, payload, getLibMQTTPublishProps(properties))
+}
+
+func (c *LibMQTTClient) publish(topic string, qos byte, retained bool, payload interface{}, props *libmqtt.PublishProps) error {
 	if c.client == nil {
 		return fmt.Errorf("client is nil (probably not connected)")
 	}
@@ -115,7 +341,8 @@ func (c *LibMQTTClient) Publish(topic string, qos byte, retained bool, payload i
 			TopicName: topic,
 			Qos:       qosLevel,
 			IsRetain:  retained,
-			Payload:   []byte(fmt.Sprintf("%v", payload)),
+			Payload:   getPayloadBytes(payload),
+			Props:     props,
 		},
 	)
 
@@ -132,17 +359,24 @@ func (c *LibMQTTClient) Subscribe(topic string, qos byte, callback func(message
 		return err
 	}
 
-	topicHandleFunc := func(client libmqtt.Client, topic string, qos libmqtt.QosLevel, msg []byte) {
-		callback(
-			Message{
-				Received:  time.Now(),
-				Topic:     topic,
-				MessageID: 0,
-				Payload:   string(msg),
-			})
-	}
+	c.router.handlePacket(topic, func(client libmqtt.Client, p *libmqtt.PublishPacket) {
+		message := Message{
+			Received:   time.Now(),
+			Topic:      p.TopicName,
+			MessageID:  p.PacketID,
+			QoS:        p.Qos,
+			Retained:   p.IsRetain,
+			Duplicate:  p.IsDup,
+			Payload:    string(p.Payload),
+			RawPayload: p.Payload,
+		}
+
+		if c.SupportsProperties() {
+			message.Properties = getPropertiesFromLibMQTT(p.Props)
+		}
 
-	c.client.HandleTopic(topic, topicHandleFunc)
+		callback(message)
+	})
 
 	c.client.Subscribe(&libmqtt.Topic{
 		Name: topic,
@@ -157,6 +391,8 @@ func (c *LibMQTTClient) Unsubscribe(topic string) error {
 		return fmt.Errorf("client is nil (probably not connected)")
 	}
 
+	c.router.remove(topic)
+
 	c.client.Unsubscribe(topic)
 
 	return nil
@@ -0,0 +1,37 @@
+package mqtt_client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibMQTTClient(t *testing.T) {
+	t.Run("Properties", func(t *testing.T) {
+		properties := Properties{
+			ResponseTopic:   "rpc/responses/a",
+			CorrelationData: []byte("some-id"),
+			ContentType:     "application/json",
+			UserProperties:  map[string]string{"origin": "some-daemon"},
+			MessageExpiry:   time.Second * 30,
+		}
+
+		props := getLibMQTTPublishProps(properties)
+		require.Equal(t, uint32(30), props.MessageExpiryInterval)
+		require.Equal(t, properties, *getPropertiesFromLibMQTT(props))
+
+		require.Equal(t, &Properties{}, getPropertiesFromLibMQTT(nil))
+	})
+
+	t.Run("SupportsProperties", func(t *testing.T) {
+		c, err := NewLibMQTTClientFromConfig(Config{URL: "some-host"}, nil)
+		require.NoError(t, err)
+		require.False(t, c.SupportsProperties())
+		require.Error(t, c.PublishWithProperties("a", AtMostOnce, false, "1", Properties{}))
+
+		c, err = NewLibMQTT5ClientFromConfig(Config{URL: "some-host"}, nil)
+		require.NoError(t, err)
+		require.True(t, c.SupportsProperties())
+	})
+}
@@ -2,6 +2,7 @@ package mqtt_client
 
 import (
 	"fmt"
+	"log"
 	"time"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
@@ -15,33 +16,76 @@ func EnablePahoTestMode(host string) {
 	PahoTestHost = host
 }
 
+func init() {
+	RegisterProvider("paho", func(config Config, errorHandler func(Client, error)) (Client, error) {
+		c, err := NewPahoClientFromConfig(config, errorHandler)
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	})
+}
+
 type PahoClient struct {
-	clientOptions *paho.ClientOptions
-	connectToken  paho.Token
-	client        paho.Client
-	errorHandler  func(Client, error)
+	brokerURL         BrokerURL
+	connectionOptions ConnectionOptions
+	clientOptions     *paho.ClientOptions
+	connectToken      paho.Token
+	client            paho.Client
+	errorHandler      func(Client, error)
 }
 
 func NewPahoClient(host, username, password string, errorHandler func(Client, error)) (c *PahoClient) {
+	c, err := NewPahoClientWithOptions(host, username, password, ConnectionOptions{}, errorHandler)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return c
+}
+
+func NewPahoClientWithOptions(host, username, password string, options ConnectionOptions, errorHandler func(Client, error)) (c *PahoClient, err error) {
+	return NewPahoClientFromConfig(
+		Config{URL: host, Username: username, Password: password, ConnectionOptions: options},
+		errorHandler,
+	)
+}
+
+func NewPahoClientFromConfig(config Config, errorHandler func(Client, error)) (c *PahoClient, err error) {
+	host := config.URL
 	if PahoTestMode {
 		host = PahoTestHost
 	}
 
-	clientID := getClientID("paho")
+	brokerURL, err := ParseBrokerURL(host, config.ConnectionOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = brokerURL.checkSupportedBy("Paho", SchemeTCP, SchemeSSL, SchemeWS, SchemeWSS)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID := config.getClientID("paho")
+	connectTimeout := getDurationOrDefault(config.ConnectTimeout, time.Second*2)
 
 	c = &PahoClient{
-		errorHandler: errorHandler,
+		brokerURL:         brokerURL,
+		connectionOptions: config.ConnectionOptions,
+		errorHandler:      errorHandler,
 	}
 
 	c.clientOptions = paho.NewClientOptions()
-	c.clientOptions.AddBroker(fmt.Sprintf("tcp://%v:1883", host))
+	c.clientOptions.AddBroker(brokerURL.String())
 	c.clientOptions.SetClientID(clientID)
-	c.clientOptions.SetUsername(username)
-	c.clientOptions.SetPassword(password)
-	c.clientOptions.SetKeepAlive(time.Second * 2)
-	c.clientOptions.SetPingTimeout(time.Second * 2)
-	c.clientOptions.SetConnectTimeout(time.Second * 2)
-	c.clientOptions.SetWriteTimeout(time.Second * 2)
+	c.clientOptions.SetUsername(config.Username)
+	c.clientOptions.SetPassword(config.Password)
+	c.clientOptions.SetKeepAlive(getDurationOrDefault(config.Keepalive, time.Second*2))
+	c.clientOptions.SetPingTimeout(connectTimeout)
+	c.clientOptions.SetConnectTimeout(connectTimeout)
+	c.clientOptions.SetWriteTimeout(getDurationOrDefault(config.WriteTimeout, time.Second*2))
 	c.clientOptions.SetMaxReconnectInterval(time.Second * 4)
 	c.clientOptions.SetAutoReconnect(true)
 	c.clientOptions.SetResumeSubs(true)
@@ -53,10 +97,25 @@ func NewPahoClient(host, username, password string, errorHandler func(Client, er
 		}()
 	}
 
-	return c
+	return c, nil
+}
+
+func (c *PahoClient) SetWill(topic string, qos byte, retained bool, payload interface{}) error {
+	c.clientOptions.SetBinaryWill(topic, getPayloadBytes(payload), qos, retained)
+
+	return nil
 }
 
 func (c *PahoClient) Connect() error {
+	if c.brokerURL.IsTLS() {
+		tlsConfig, err := c.connectionOptions.GetTLSConfig()
+		if err != nil {
+			return err
+		}
+
+		c.clientOptions.SetTLSConfig(tlsConfig)
+	}
+
 	c.client = paho.NewClient(c.clientOptions)
 
 	c.connectToken = c.client.Connect()
@@ -76,7 +135,8 @@ func (c *PahoClient) Publish(topic string, qos byte, retained bool, payload inte
 		return fmt.Errorf("client is nil (probably not connected)")
 	}
 
-	token := c.client.Publish(topic, qos, retained, payload)
+	// Paho only takes string / []byte / bytes.Buffer
+	token := c.client.Publish(topic, qos, retained, getPayloadBytes(payload))
 	if token == nil {
 		return fmt.Errorf("nil token while publishing (%v, %v, %v, %v)", topic, qos, retained, payload)
 	}
@@ -95,10 +155,14 @@ func (c *PahoClient) Subscribe(topic string, qos byte, callback func(message Mes
 
 	wrappedCallback := func(client paho.Client, message paho.Message) {
 		callback(Message{
-			Received:  time.Now(),
-			Topic:     message.Topic(),
-			MessageID: message.MessageID(),
-			Payload:   string(message.Payload()),
+			Received:   time.Now(),
+			Topic:      message.Topic(),
+			MessageID:  message.MessageID(),
+			QoS:        message.Qos(),
+			Retained:   message.Retained(),
+			Duplicate:  message.Duplicate(),
+			Payload:    string(message.Payload()),
+			RawPayload: message.Payload(),
 		})
 	}
 
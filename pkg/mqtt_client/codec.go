@@ -0,0 +1,178 @@
+package mqtt_client
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type Codec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+var (
+	ScalarCodec  Codec = scalarCodec{}
+	JSONCodec    Codec = jsonCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// scalarCodec is the plain text format every CLI has always used (e.g. "1", "21.50", "some string")
+type scalarCodec struct{}
+
+func (scalarCodec) Marshal(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case encoding.TextMarshaler:
+		return v.MarshalText()
+	}
+
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return []byte(fmt.Sprintf("%v", value)), nil
+	}
+
+	return nil, fmt.Errorf("scalar codec can't marshal %T", value)
+}
+
+func (scalarCodec) Unmarshal(data []byte, value interface{}) error {
+	switch v := value.(type) {
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	case encoding.TextUnmarshaler:
+		return v.UnmarshalText(data)
+	}
+
+	pointer := reflect.ValueOf(value)
+	if pointer.Kind() != reflect.Pointer || pointer.IsNil() {
+		return fmt.Errorf("scalar codec needs a non-nil pointer; got %T", value)
+	}
+
+	target := pointer.Elem()
+	raw := strings.TrimSpace(string(data))
+
+	switch target.Kind() {
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		target.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(raw, 10, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetFloat(parsed)
+	default:
+		return fmt.Errorf("scalar codec can't unmarshal into %T", value)
+	}
+
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	return msgpack.Unmarshal(data, value)
+}
+
+func PublishTyped[T any](client Client, codec Codec, topic string, qos byte, retained bool, value T, quiet ...bool) error {
+	payload, err := codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %#+v for %v because: %v", value, topic, err)
+	}
+
+	return client.Publish(topic, qos, retained, payload, quiet...)
+}
+
+func PublishJSON[T any](client Client, topic string, qos byte, retained bool, value T, quiet ...bool) error {
+	return PublishTyped(client, JSONCodec, topic, qos, retained, value, quiet...)
+}
+
+// SubscribeTyped decodes every message into a T before calling callback; messages that fail to decode go to
+// errorCallback instead (or are logged if errorCallback is nil)
+func SubscribeTyped[T any](
+	client Client,
+	codec Codec,
+	topic string,
+	qos byte,
+	callback func(message Message, value T),
+	errorCallback func(message Message, err error),
+) error {
+	return client.Subscribe(topic, qos, func(message Message) {
+		var value T
+
+		data := message.RawPayload
+		if data == nil {
+			data = []byte(message.Payload)
+		}
+
+		err := codec.Unmarshal(data, &value)
+		if err != nil {
+			err = fmt.Errorf("failed to unmarshal %#+v from %v as %T because: %v", message.Payload, message.Topic, value, err)
+
+			if errorCallback == nil {
+				log.Printf("warning: %v", err)
+				return
+			}
+
+			errorCallback(message, err)
+			return
+		}
+
+		callback(message, value)
+	})
+}
+
+func SubscribeJSON[T any](
+	client Client,
+	topic string,
+	qos byte,
+	callback func(message Message, value T),
+	errorCallback func(message Message, err error),
+) error {
+	return SubscribeTyped(client, JSONCodec, topic, qos, callback, errorCallback)
+}
@@ -0,0 +1,103 @@
+package mqtt_client_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+type reading struct {
+	Name  string  `json:"name" msgpack:"name"`
+	Value float64 `json:"value" msgpack:"value"`
+}
+
+func TestCodec(t *testing.T) {
+	t.Run("Scalar", func(t *testing.T) {
+		for expected, value := range map[string]interface{}{
+			"some string": "some string",
+			"true":        true,
+			"1":           1,
+			"-2":          int64(-2),
+			"3":           uint8(3),
+			"21.5":        21.5,
+		} {
+			data, err := mqtt.ScalarCodec.Marshal(value)
+			require.NoError(t, err)
+			require.Equal(t, expected, string(data))
+		}
+
+		var f float64
+		require.NoError(t, mqtt.ScalarCodec.Unmarshal([]byte(" 21.50\n"), &f))
+		require.Equal(t, 21.5, f)
+
+		var b bool
+		require.NoError(t, mqtt.ScalarCodec.Unmarshal([]byte("1"), &b))
+		require.True(t, b)
+
+		var i8 int8
+		require.Error(t, mqtt.ScalarCodec.Unmarshal([]byte("1000"), &i8))
+
+		_, err := mqtt.ScalarCodec.Marshal(reading{})
+		require.Error(t, err)
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		for name, codec := range map[string]mqtt.Codec{"json": mqtt.JSONCodec, "msgpack": mqtt.MsgpackCodec} {
+			t.Run(name, func(t *testing.T) {
+				data, err := codec.Marshal(reading{Name: "temperature", Value: 21.5})
+				require.NoError(t, err)
+
+				var r reading
+				require.NoError(t, codec.Unmarshal(data, &r))
+				require.Equal(t, reading{Name: "temperature", Value: 21.5}, r)
+			})
+		}
+	})
+
+	t.Run("PublishAndSubscribeTyped", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		readings := make([]reading, 0)
+		errs := make([]error, 0)
+		require.NoError(t, mqtt.SubscribeJSON(
+			c,
+			"test/+/get",
+			mqtt.AtMostOnce,
+			func(message mqtt.Message, value reading) {
+				readings = append(readings, value)
+			},
+			func(message mqtt.Message, err error) {
+				errs = append(errs, err)
+			},
+		))
+
+		require.NoError(t, mqtt.PublishJSON(c, "test/a/get", mqtt.AtMostOnce, false, reading{Name: "a", Value: 1}))
+		b.RequirePublished(t, "test/a/get", `{"name":"a","value":1}`)
+
+		b.Inject("test/b/get", mqtt.AtMostOnce, false, "not json")
+
+		require.Equal(t, []reading{{Name: "a", Value: 1}}, readings)
+		require.Len(t, errs, 1)
+
+		values := make([]float64, 0)
+		require.NoError(t, mqtt.SubscribeTyped(
+			c,
+			mqtt.ScalarCodec,
+			"test/c/get",
+			mqtt.AtMostOnce,
+			func(message mqtt.Message, value float64) {
+				values = append(values, value)
+			},
+			nil,
+		))
+
+		require.NoError(t, mqtt.PublishTyped(c, mqtt.ScalarCodec, "test/c/get", mqtt.AtMostOnce, false, 21.5))
+		b.Inject("test/c/get", mqtt.AtMostOnce, false, "not a float")
+		require.Equal(t, []float64{21.5}, values)
+	})
+}
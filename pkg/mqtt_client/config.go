@@ -0,0 +1,108 @@
+package mqtt_client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const DefaultProvider = "glue"
+
+// Config is everything needed to build a client; zero values mean "whatever the provider has always used"
+type Config struct {
+	Provider          string // see GetProviderNames; empty means DefaultProvider
+	URL               string // a bare host or a broker URL (see ParseBrokerURL)
+	Username          string
+	Password          string
+	ClientIDPrefix    string // empty means the provider name
+	Keepalive         time.Duration
+	ConnectTimeout    time.Duration
+	WriteTimeout      time.Duration
+	ConnectionOptions ConnectionOptions
+}
+
+func getDurationFromEnv(key string) (time.Duration, bool, error) {
+	rawValue := strings.TrimSpace(os.Getenv(key))
+	if rawValue == "" {
+		return 0, false, nil
+	}
+
+	value, err := time.ParseDuration(rawValue)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to parse %v=%#+v as a duration because: %v", key, rawValue, err)
+	}
+
+	return value, true, nil
+}
+
+// WithEnvOverrides returns a copy of the Config with anything set in the MQTT_* env vars taking precedence (so that
+// existing deployments keep working)
+func (c Config) WithEnvOverrides() (Config, error) {
+	provider := strings.TrimSpace(os.Getenv("MQTT_CLIENT_PROVIDER"))
+	if provider != "" {
+		c.Provider = provider
+	}
+
+	clientIDPrefix := strings.TrimSpace(os.Getenv("MQTT_CLIENT_ID_PREFIX"))
+	if clientIDPrefix != "" {
+		c.ClientIDPrefix = clientIDPrefix
+	}
+
+	for key, value := range map[string]*time.Duration{
+		"MQTT_KEEPALIVE":       &c.Keepalive,
+		"MQTT_CONNECT_TIMEOUT": &c.ConnectTimeout,
+		"MQTT_WRITE_TIMEOUT":   &c.WriteTimeout,
+	} {
+		duration, ok, err := getDurationFromEnv(key)
+		if err != nil {
+			return c, err
+		}
+
+		if ok {
+			*value = duration
+		}
+	}
+
+	// the TLS env vars only make sense as a set, so if any are present they replace the options wholesale
+	connectionOptions := GetConnectionOptionsFromEnv()
+	if connectionOptions.IsTLS() {
+		c.ConnectionOptions = connectionOptions
+	}
+
+	return c, nil
+}
+
+func (c Config) getProvider() string {
+	provider := strings.ToLower(strings.TrimSpace(c.Provider))
+	if provider == "" {
+		return DefaultProvider
+	}
+
+	return provider
+}
+
+func (c Config) getClientID(provider string) string {
+	if c.ClientIDPrefix != "" {
+		return getClientID(c.ClientIDPrefix)
+	}
+
+	return getClientID(provider)
+}
+
+func getDurationOrDefault(value time.Duration, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+
+	return value
+}
+
+// getSecondsOrDefault is for providers that take whole seconds (rounding up so that 500ms doesn't become "disabled")
+func getSecondsOrDefault(value time.Duration, defaultValue uint16) uint16 {
+	if value <= 0 {
+		return defaultValue
+	}
+
+	return uint16(min((value+time.Second-1)/time.Second, 65535))
+}
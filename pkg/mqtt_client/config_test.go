@@ -0,0 +1,61 @@
+package mqtt_client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+func TestConfig(t *testing.T) {
+	t.Run("WithEnvOverrides", func(t *testing.T) {
+		t.Setenv("MQTT_CLIENT_PROVIDER", "paho")
+		t.Setenv("MQTT_CLIENT_ID_PREFIX", "some-daemon")
+		t.Setenv("MQTT_KEEPALIVE", "10s")
+		t.Setenv("MQTT_CONNECT_TIMEOUT", "")
+		t.Setenv("MQTT_CA_FILE", "/some/ca.pem")
+
+		config, err := mqtt.Config{
+			Provider:       "glue",
+			URL:            "some-host",
+			ConnectTimeout: time.Second * 3,
+		}.WithEnvOverrides()
+		require.NoError(t, err)
+		require.Equal(t, "paho", config.Provider)
+		require.Equal(t, "some-daemon", config.ClientIDPrefix)
+		require.Equal(t, time.Second*10, config.Keepalive)
+		require.Equal(t, time.Second*3, config.ConnectTimeout)
+		require.Equal(t, "/some/ca.pem", config.ConnectionOptions.CAFile)
+
+		t.Setenv("MQTT_WRITE_TIMEOUT", "soon")
+		_, err = mqtt.Config{}.WithEnvOverrides()
+		require.Error(t, err)
+	})
+
+	t.Run("Registry", func(t *testing.T) {
+		require.Subset(t, mqtt.GetProviderNames(), []string{"glue", "gmq", "libmqtt", "libmqtt5", "paho"})
+
+		_, err := mqtt.NewMQTTClient(mqtt.Config{Provider: "pahoo", URL: "some-host"})
+		require.Error(t, err)
+
+		require.Panics(t, func() {
+			mqtt.RegisterProvider("paho", func(config mqtt.Config, errorHandler func(mqtt.Client, error)) (mqtt.Client, error) {
+				return nil, nil
+			})
+		})
+
+		b := mqtttest.NewBroker()
+		mqtt.RegisterProvider("mqtttest", func(config mqtt.Config, errorHandler func(mqtt.Client, error)) (mqtt.Client, error) {
+			return b.NewClient(errorHandler), nil
+		})
+
+		p, err := mqtt.NewMQTTClient(mqtt.Config{Provider: "MQTTTest"})
+		require.NoError(t, err)
+		require.NoError(t, p.Connect())
+		require.NoError(t, p.Publish("test/a/get", mqtt.AtMostOnce, false, "1"))
+		b.RequirePublished(t, "test/a/get", "1")
+	})
+}
@@ -0,0 +1,156 @@
+package mqtt_client
+
+import (
+	"sync"
+)
+
+type handler struct {
+	id       uint64
+	qos      byte
+	callback func(message Message)
+}
+
+type filterEntry struct {
+	filter   string
+	qos      byte
+	handlers []handler
+}
+
+// dispatcher fans messages for a filter out to every handler registered against it; it does its own topic matching
+// so that a provider handing us a message for the wrong filter (or for an overlapping one) can't cause a misfire
+type dispatcher struct {
+	mu            sync.Mutex
+	lastID        uint64
+	entryByFilter map[string]*filterEntry
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		entryByFilter: make(map[string]*filterEntry),
+	}
+}
+
+// add returns the new handler's id and whether or not the provider needs to be (re)subscribed (i.e. it's a new filter
+// or the QoS went up)
+func (d *dispatcher) add(filter string, qos byte, callback func(message Message)) (uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastID++
+
+	entry, ok := d.entryByFilter[filter]
+	if !ok {
+		entry = &filterEntry{
+			filter:   filter,
+			qos:      qos,
+			handlers: make([]handler, 0),
+		}
+
+		d.entryByFilter[filter] = entry
+	}
+
+	needsSubscribe := !ok || qos > entry.qos
+	entry.qos = max(entry.qos, qos)
+
+	entry.handlers = append(entry.handlers, handler{id: d.lastID, qos: qos, callback: callback})
+
+	return d.lastID, needsSubscribe
+}
+
+// remove returns true if that was the last handler for the filter (i.e. the provider should be unsubscribed)
+func (d *dispatcher) remove(filter string, id uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.entryByFilter[filter]
+	if !ok {
+		return false
+	}
+
+	qos := AtMostOnce
+	handlers := make([]handler, 0, len(entry.handlers))
+	for _, h := range entry.handlers {
+		if h.id == id {
+			continue
+		}
+
+		qos = max(qos, h.qos)
+		handlers = append(handlers, h)
+	}
+
+	if len(handlers) == len(entry.handlers) {
+		return false
+	}
+
+	// the provider isn't downgraded straight away, but the next resubscribe will use the lower QoS
+	entry.qos = qos
+	entry.handlers = handlers
+
+	if len(entry.handlers) > 0 {
+		return false
+	}
+
+	delete(d.entryByFilter, filter)
+
+	return true
+}
+
+func (d *dispatcher) removeAll(filter string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.entryByFilter, filter)
+}
+
+func (d *dispatcher) getQoS(filter string) (byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.entryByFilter[filter]
+	if !ok {
+		return 0, false
+	}
+
+	return entry.qos, true
+}
+
+func (d *dispatcher) getFilters() map[string]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	qosByFilter := make(map[string]byte)
+	for filter, entry := range d.entryByFilter {
+		qosByFilter[filter] = entry.qos
+	}
+
+	return qosByFilter
+}
+
+func (d *dispatcher) dispatch(filter string, message Message) {
+	if !TopicMatches(filter, message.Topic) {
+		return
+	}
+
+	d.mu.Lock()
+	entry, ok := d.entryByFilter[filter]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+
+	// handlers are called without the lock so that they're free to subscribe / unsubscribe
+	handlers := make([]handler, len(entry.handlers))
+	copy(handlers, entry.handlers)
+	d.mu.Unlock()
+
+	for _, h := range handlers {
+		h.callback(message)
+	}
+}
+
+// getCallback returns the callback that's handed to the provider for a filter
+func (d *dispatcher) getCallback(filter string) func(message Message) {
+	return func(message Message) {
+		d.dispatch(filter, message)
+	}
+}
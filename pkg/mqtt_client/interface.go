@@ -1,9 +1,31 @@
 package mqtt_client
 
 type Client interface {
+	SetWill(topic string, qos byte, retained bool, payload interface{}) error
 	Connect() error
 	Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error
 	Subscribe(topic string, qos byte, callback func(message Message)) error
 	Unsubscribe(topic string) error
 	Disconnect() error
 }
+
+// PropertiesClient is implemented by clients that can carry MQTT 5 properties; SupportsProperties can be false if
+// (e.g.) a wrapper is sat in front of a client that can't
+type PropertiesClient interface {
+	Client
+	SupportsProperties() bool
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties Properties, quiet ...bool) error
+}
+
+// RetainedReporter is implemented by clients that might not be able to set Message.Retained on what they receive; a
+// client that doesn't implement it is assumed to (i.e. Retained can be relied on to tell a retained message from a
+// live one)
+type RetainedReporter interface {
+	ReportsRetained() bool
+}
+
+func ReportsRetained(client Client) bool {
+	retainedReporter, ok := client.(RetainedReporter)
+
+	return !ok || retainedReporter.ReportsRetained()
+}
@@ -0,0 +1,383 @@
+package mqtt_client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace           = "mqtt_client"
+	DefaultMetricsPrefixLevels = 3
+)
+
+var allConnectionStates = []ConnectionState{Disconnected, Connecting, Connected, Reconnecting}
+
+type Metrics struct {
+	registerer       prometheus.Registerer
+	prefixLevels     int
+	published        *prometheus.CounterVec
+	publishErrors    *prometheus.CounterVec
+	publishLatency   *prometheus.HistogramVec
+	subscribes       *prometheus.CounterVec
+	subscribeErrors  *prometheus.CounterVec
+	received         *prometheus.CounterVec
+	errors           *prometheus.CounterVec
+	reconnectAttempt prometheus.Counter
+	reconnects       prometheus.Counter
+	connectionState  *prometheus.GaugeVec
+}
+
+// NewMetrics registers the metrics with registerer; topics are labelled by their first prefixLevels levels (e.g.
+// "home/inside/lights" for 3) to keep the cardinality sane
+func NewMetrics(registerer prometheus.Registerer, prefixLevels int) (*Metrics, error) {
+	if prefixLevels <= 0 {
+		prefixLevels = DefaultMetricsPrefixLevels
+	}
+
+	m := &Metrics{
+		registerer:   registerer,
+		prefixLevels: prefixLevels,
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "published_total",
+			Help:      "Messages published, by topic prefix",
+		}, []string{"prefix"}),
+		publishErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_errors_total",
+			Help:      "Failed publishes, by topic prefix",
+		}, []string{"prefix"}),
+		publishLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_duration_seconds",
+			Help:      "Time taken for the provider to accept (or fail) a publish, by topic prefix",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+		}, []string{"prefix"}),
+		subscribes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscribes_total",
+			Help:      "Subscribe calls (including resubscribes), by topic prefix",
+		}, []string{"prefix"}),
+		subscribeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscribe_errors_total",
+			Help:      "Failed subscribes, by topic prefix",
+		}, []string{"prefix"}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "received_total",
+			Help:      "Messages received, by topic prefix",
+		}, []string{"prefix"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "errors_total",
+			Help:      "Errors from the provider, by operation",
+		}, []string{"operation"}),
+		reconnectAttempt: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconnect_attempts_total",
+			Help:      "Reconnect attempts",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconnects_total",
+			Help:      "Successful reconnects",
+		}),
+		connectionState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connection_state",
+			Help:      "1 for the current connection state, 0 for the others",
+		}, []string{"state"}),
+	}
+
+	for _, collector := range []prometheus.Collector{
+		m.published,
+		m.publishErrors,
+		m.publishLatency,
+		m.subscribes,
+		m.subscribeErrors,
+		m.received,
+		m.errors,
+		m.reconnectAttempt,
+		m.reconnects,
+		m.connectionState,
+	} {
+		err := registerer.Register(collector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register mqtt_client metrics because: %v", err)
+		}
+	}
+
+	m.setConnectionState(Disconnected)
+
+	return m, nil
+}
+
+func (m *Metrics) getPrefix(topic string) string {
+	_, filter, ok := ParseSharedSubscription(topic)
+	if ok {
+		topic = filter
+	}
+
+	parts := strings.SplitN(topic, "/", m.prefixLevels+1)
+	if len(parts) > m.prefixLevels {
+		parts = parts[:m.prefixLevels]
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func (m *Metrics) setConnectionState(state ConnectionState) {
+	for _, possibleState := range allConnectionStates {
+		value := 0.0
+		if possibleState == state {
+			value = 1.0
+		}
+
+		m.connectionState.WithLabelValues(possibleState.String()).Set(value)
+	}
+}
+
+func (m *Metrics) handleConnectionEvent(event ConnectionEvent) {
+	m.setConnectionState(event.State)
+
+	switch {
+	case event.State == Reconnecting:
+		m.reconnectAttempt.Inc()
+	case event.State == Connected && event.Previous == Reconnecting:
+		m.reconnects.Inc()
+	}
+}
+
+// InstrumentedClient wraps any Client and records what goes through it
+type InstrumentedClient struct {
+	client  Client
+	metrics *Metrics
+}
+
+func NewInstrumentedClient(client Client, metrics *Metrics) *InstrumentedClient {
+	return &InstrumentedClient{
+		client:  client,
+		metrics: metrics,
+	}
+}
+
+func (c *InstrumentedClient) String() string {
+	return fmt.Sprintf("InstrumentedClient{%v}", c.client)
+}
+
+func (c *InstrumentedClient) SetWill(topic string, qos byte, retained bool, payload interface{}) error {
+	return c.client.SetWill(topic, qos, retained, payload)
+}
+
+func (c *InstrumentedClient) Connect() error {
+	err := c.client.Connect()
+	if err != nil {
+		c.metrics.errors.WithLabelValues("connect").Inc()
+	}
+
+	return err
+}
+
+func (c *InstrumentedClient) Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error {
+	return c.observePublish(topic, func() error {
+		return c.client.Publish(topic, qos, retained, payload, quiet...)
+	})
+}
+
+func (c *InstrumentedClient) observePublish(topic string, publish func() error) error {
+	prefix := c.metrics.getPrefix(topic)
+
+	before := time.Now()
+	err := publish()
+	c.metrics.publishLatency.WithLabelValues(prefix).Observe(time.Since(before).Seconds())
+
+	if err != nil {
+		c.metrics.publishErrors.WithLabelValues(prefix).Inc()
+		c.metrics.errors.WithLabelValues("publish").Inc()
+
+		return err
+	}
+
+	c.metrics.published.WithLabelValues(prefix).Inc()
+
+	return nil
+}
+
+func (c *InstrumentedClient) ReportsRetained() bool {
+	return ReportsRetained(c.client)
+}
+
+func (c *InstrumentedClient) SupportsProperties() bool {
+	propertiesClient, ok := c.client.(PropertiesClient)
+
+	return ok && propertiesClient.SupportsProperties()
+}
+
+func (c *InstrumentedClient) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties Properties, quiet ...bool) error {
+	propertiesClient, ok := c.client.(PropertiesClient)
+	if !ok {
+		return fmt.Errorf("%T doesn't support properties", c.client)
+	}
+
+	return c.observePublish(topic, func() error {
+		return propertiesClient.PublishWithProperties(topic, qos, retained, payload, properties, quiet...)
+	})
+}
+
+func (c *InstrumentedClient) Subscribe(topic string, qos byte, callback func(message Message)) error {
+	prefix := c.metrics.getPrefix(topic)
+
+	c.metrics.subscribes.WithLabelValues(prefix).Inc()
+
+	err := c.client.Subscribe(topic, qos, func(message Message) {
+		c.metrics.received.WithLabelValues(c.metrics.getPrefix(message.Topic)).Inc()
+
+		callback(message)
+	})
+	if err != nil {
+		c.metrics.subscribeErrors.WithLabelValues(prefix).Inc()
+		c.metrics.errors.WithLabelValues("subscribe").Inc()
+	}
+
+	return err
+}
+
+func (c *InstrumentedClient) Unsubscribe(topic string) error {
+	err := c.client.Unsubscribe(topic)
+	if err != nil {
+		c.metrics.errors.WithLabelValues("unsubscribe").Inc()
+	}
+
+	return err
+}
+
+func (c *InstrumentedClient) Disconnect() error {
+	err := c.client.Disconnect()
+	if err != nil {
+		c.metrics.errors.WithLabelValues("disconnect").Inc()
+	}
+
+	return err
+}
+
+// InstrumentPersistentClient wraps the client underneath p (so must be called before Connect) and also tracks p's
+// connection state, publish queue and rate limiter
+func InstrumentPersistentClient(p *PersistentClient, metrics *Metrics) error {
+	queueCollectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_queue_depth",
+			Help:      "Messages waiting in the publish queue",
+		}, func() float64 {
+			publishQueue := p.GetPublishQueue()
+			if publishQueue == nil {
+				return 0
+			}
+
+			return float64(publishQueue.Len())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_queue_dropped_total",
+			Help:      "Messages dropped because the publish queue was full",
+		}, func() float64 {
+			publishQueue := p.GetPublishQueue()
+			if publishQueue == nil {
+				return 0
+			}
+
+			return float64(publishQueue.Dropped())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_rate_limit_dropped_total",
+			Help:      "Messages dropped because they were over the publish rate limit",
+		}, func() float64 {
+			rateLimiter := p.GetRateLimiter()
+			if rateLimiter == nil {
+				return 0
+			}
+
+			return float64(rateLimiter.Dropped())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_rate_limit_delayed_total",
+			Help:      "Messages held back because they were over the publish rate limit",
+		}, func() float64 {
+			rateLimiter := p.GetRateLimiter()
+			if rateLimiter == nil {
+				return 0
+			}
+
+			return float64(rateLimiter.Delayed())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_rate_limit_delay_seconds_total",
+			Help:      "Time spent holding back messages that were over the publish rate limit",
+		}, func() float64 {
+			rateLimiter := p.GetRateLimiter()
+			if rateLimiter == nil {
+				return 0
+			}
+
+			return rateLimiter.Delay().Seconds()
+		}),
+	}
+
+	for _, collector := range queueCollectors {
+		err := metrics.registerer.Register(collector)
+		if err != nil {
+			return fmt.Errorf("failed to register mqtt_client metrics because: %v", err)
+		}
+	}
+
+	p.SetClient(NewInstrumentedClient(p.GetClient(), metrics))
+
+	metrics.setConnectionState(p.State())
+	p.AddObserver(metrics.handleConnectionEvent)
+
+	return nil
+}
+
+// ServeMetrics instruments p (see InstrumentPersistentClient) with the default Prometheus registry and serves it on
+// addr at /metrics
+func ServeMetrics(p *PersistentClient, addr string) error {
+	metrics, err := NewMetrics(prometheus.DefaultRegisterer, DefaultMetricsPrefixLevels)
+	if err != nil {
+		return err
+	}
+
+	err = InstrumentPersistentClient(p, metrics)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %v because: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			log.Printf("warning: metrics server on %v stopped because: %v", addr, err)
+		}
+	}()
+
+	log.Printf("serving metrics on %v/metrics", listener.Addr())
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package mqtt_client_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+func gatherValues(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				name += fmt.Sprintf("{%v=%v}", label.GetName(), label.GetValue())
+			}
+
+			switch {
+			case metric.GetCounter() != nil:
+				values[name] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[name] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				values[name] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	t.Run("InstrumentPersistentClient", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		metrics, err := mqtt.NewMetrics(registry, 2)
+		require.NoError(t, err)
+
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		p.SetClient(c)
+		p.SetBackoff(mqtt.BackoffOptions{Initial: time.Millisecond * 10})
+		require.NoError(t, p.EnablePublishQueue(mqtt.PublishQueueOptions{MaxSize: 10}))
+
+		require.NoError(t, mqtt.InstrumentPersistentClient(p, metrics))
+		require.NoError(t, p.Connect())
+
+		require.NoError(t, p.Subscribe("home/inside/+/get", mqtt.AtMostOnce, func(message mqtt.Message) {}))
+		require.NoError(t, p.Publish("home/inside/a/get", mqtt.AtMostOnce, false, "1"))
+		require.NoError(t, p.Publish("home/outside/b/get", mqtt.AtMostOnce, false, "2"))
+
+		c.SetPublishError(fmt.Errorf("injected publish failure"))
+		require.NoError(t, p.Publish("home/inside/a/get", mqtt.AtMostOnce, false, "3"))
+		c.SetPublishError(nil)
+
+		require.Equal(t, 1.0, gatherValues(t, registry)["mqtt_client_publish_queue_depth"])
+
+		c.Drop(fmt.Errorf("injected connection loss"))
+		require.Eventually(t, func() bool { return p.State() == mqtt.Connected && c.ConnectCount() == 2 }, time.Second*5, time.Millisecond*10)
+		require.Eventually(t, func() bool { return p.GetPublishQueue().Len() == 0 }, time.Second*5, time.Millisecond*10)
+
+		values := gatherValues(t, registry)
+
+		// "3" failed once and then went through when the queue drained
+		require.Equal(t, 2.0, values["mqtt_client_published_total{prefix=home/inside}"])
+		require.Equal(t, 1.0, values["mqtt_client_published_total{prefix=home/outside}"])
+		require.Equal(t, 1.0, values["mqtt_client_publish_errors_total{prefix=home/inside}"])
+		require.Equal(t, 3.0, values["mqtt_client_publish_duration_seconds{prefix=home/inside}"])
+		require.Equal(t, 2.0, values["mqtt_client_subscribes_total{prefix=home/inside}"])
+		// the queue drains before the resubscribe, so we don't hear "3" ourselves
+		require.Equal(t, 1.0, values["mqtt_client_received_total{prefix=home/inside}"])
+		require.Equal(t, 1.0, values["mqtt_client_reconnect_attempts_total"])
+		require.Equal(t, 1.0, values["mqtt_client_reconnects_total"])
+		require.Equal(t, 1.0, values["mqtt_client_connection_state{state=connected}"])
+		require.Equal(t, 0.0, values["mqtt_client_connection_state{state=reconnecting}"])
+		require.Equal(t, 0.0, values["mqtt_client_publish_queue_depth"])
+	})
+}
@@ -0,0 +1,66 @@
+package mqtttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (b *Broker) payloadsPublishedTo(topicFilter string) []string {
+	payloads := make([]string, 0)
+	for _, publishedMessage := range b.PublishedTo(topicFilter) {
+		payloads = append(payloads, publishedMessage.Payload)
+	}
+
+	return payloads
+}
+
+// RequirePublished fails the test unless payload has been published on a topic matching topicFilter
+func (b *Broker) RequirePublished(t testing.TB, topicFilter string, payload string) {
+	t.Helper()
+
+	require.Contains(t, b.payloadsPublishedTo(topicFilter), payload, "expected %#+v to have been published to %#+v", payload, topicFilter)
+}
+
+// RequirePublishedSequence fails the test unless exactly payloads (in order) have been published on topics matching topicFilter
+func (b *Broker) RequirePublishedSequence(t testing.TB, topicFilter string, payloads ...string) {
+	t.Helper()
+
+	require.Equal(t, payloads, b.payloadsPublishedTo(topicFilter), "unexpected payloads published to %#+v", topicFilter)
+}
+
+func (b *Broker) RequireNotPublished(t testing.TB, topicFilter string) {
+	t.Helper()
+
+	require.Empty(t, b.PublishedTo(topicFilter), "expected nothing to have been published to %#+v", topicFilter)
+}
+
+func (b *Broker) RequireRetained(t testing.TB, topic string, payload string) {
+	t.Helper()
+
+	publishedMessage, ok := b.Retained(topic)
+	require.True(t, ok, "expected a retained message on %#+v", topic)
+	require.Equal(t, payload, publishedMessage.Payload, "unexpected retained payload on %#+v", topic)
+}
+
+// WaitForPublished is RequirePublished for things that publish from another goroutine
+func (b *Broker) WaitForPublished(t testing.TB, topicFilter string, payload string, timeout time.Duration) {
+	t.Helper()
+
+	require.Eventually(
+		t,
+		func() bool {
+			for _, possiblePayload := range b.payloadsPublishedTo(topicFilter) {
+				if possiblePayload == payload {
+					return true
+				}
+			}
+
+			return false
+		},
+		timeout,
+		time.Millisecond*10,
+		"expected %#+v to have been published to %#+v within %v", payload, topicFilter, timeout,
+	)
+}
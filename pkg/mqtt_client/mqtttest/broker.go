@@ -0,0 +1,316 @@
+package mqtttest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+type PublishedMessage struct {
+	ClientID   string
+	Topic      string
+	QoS        byte
+	Retained   bool
+	Payload    string
+	Properties *mqtt.Properties
+	Published  time.Time
+}
+
+func (p PublishedMessage) expired(now time.Time) bool {
+	if p.Properties == nil || p.Properties.MessageExpiry <= 0 {
+		return false
+	}
+
+	return now.Sub(p.Published) >= p.Properties.MessageExpiry
+}
+
+// Broker is an in-process stand-in for an MQTT broker; messages are delivered synchronously (on the publisher's
+// goroutine) so that tests can make assertions straight after a Publish without sleeping; shared subscriptions are
+// served round-robin (by client ID) within each group
+type Broker struct {
+	mu                         sync.Mutex
+	clients                    map[*Client]struct{}
+	retainedByTopic            map[string]PublishedMessage
+	published                  []PublishedMessage
+	lastMessageID              uint16
+	clientCount                int64
+	lastSharedIDBySubscription map[string]string
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		clients:                    make(map[*Client]struct{}),
+		retainedByTopic:            make(map[string]PublishedMessage),
+		lastSharedIDBySubscription: make(map[string]string),
+	}
+}
+
+func (b *Broker) NewClient(errorHandler func(mqtt.Client, error)) *Client {
+	b.mu.Lock()
+	b.clientCount++
+	clientID := fmt.Sprintf("mqtttest_%v", b.clientCount)
+	b.mu.Unlock()
+
+	return &Client{
+		broker:              b,
+		clientID:            clientID,
+		errorHandler:        errorHandler,
+		subscriptionByTopic: make(map[string]subscription),
+	}
+}
+
+func (b *Broker) addClient(client *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.clients[client] = struct{}{}
+}
+
+func (b *Broker) removeClient(client *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.clients, client)
+}
+
+func (b *Broker) getNextMessageID() uint16 {
+	b.lastMessageID++
+	if b.lastMessageID == 0 {
+		b.lastMessageID++
+	}
+
+	return b.lastMessageID
+}
+
+type delivery struct {
+	callback func(mqtt.Message)
+	message  mqtt.Message
+}
+
+func (b *Broker) publish(publishedMessage PublishedMessage) {
+	deliveries := make([]delivery, 0)
+	sharedDeliveriesBySubscription := make(map[string]map[string]delivery)
+
+	publishedMessage.Published = time.Now()
+
+	b.mu.Lock()
+
+	b.published = append(b.published, publishedMessage)
+
+	if publishedMessage.Retained {
+		// as per the spec, a retained empty payload clears the retained message
+		if publishedMessage.Payload == "" {
+			delete(b.retainedByTopic, publishedMessage.Topic)
+		} else {
+			b.retainedByTopic[publishedMessage.Topic] = publishedMessage
+		}
+	}
+
+	now := publishedMessage.Published
+
+	for client := range b.clients {
+		for _, subscription := range client.getSubscriptions() {
+			if !mqtt.TopicMatches(subscription.topic, publishedMessage.Topic) {
+				continue
+			}
+
+			var messageID uint16
+			if min(publishedMessage.QoS, subscription.qos) > mqtt.AtMostOnce {
+				messageID = b.getNextMessageID()
+			}
+
+			d := delivery{
+				callback: subscription.callback,
+				message: mqtt.Message{
+					Received:   now,
+					Topic:      publishedMessage.Topic,
+					MessageID:  messageID,
+					QoS:        min(publishedMessage.QoS, subscription.qos),
+					Retained:   false, // as per the spec, live messages are delivered with retain cleared
+					Payload:    publishedMessage.Payload,
+					RawPayload: []byte(publishedMessage.Payload),
+					Properties: client.getProperties(publishedMessage.Properties),
+				},
+			}
+
+			if mqtt.IsSharedSubscription(subscription.topic) {
+				if sharedDeliveriesBySubscription[subscription.topic] == nil {
+					sharedDeliveriesBySubscription[subscription.topic] = make(map[string]delivery)
+				}
+
+				sharedDeliveriesBySubscription[subscription.topic][client.clientID] = d
+
+				continue
+			}
+
+			deliveries = append(deliveries, d)
+		}
+	}
+
+	for topic, deliveryByClientID := range sharedDeliveriesBySubscription {
+		clientID := b.getNextSharedClientID(topic, deliveryByClientID)
+		deliveries = append(deliveries, deliveryByClientID[clientID])
+	}
+
+	b.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.callback(d.message)
+	}
+}
+
+// getNextSharedClientID picks the client after the one that got the last message for the shared subscription
+func (b *Broker) getNextSharedClientID(topic string, deliveryByClientID map[string]delivery) string {
+	clientIDs := make([]string, 0, len(deliveryByClientID))
+	for clientID := range deliveryByClientID {
+		clientIDs = append(clientIDs, clientID)
+	}
+
+	sort.Strings(clientIDs)
+
+	next := clientIDs[0]
+	for _, clientID := range clientIDs {
+		if clientID > b.lastSharedIDBySubscription[topic] {
+			next = clientID
+			break
+		}
+	}
+
+	b.lastSharedIDBySubscription[topic] = next
+
+	return next
+}
+
+// deliverRetained does nothing for shared subscriptions as (per the spec) they don't get retained messages
+func (b *Broker) deliverRetained(client *Client, topicFilter string, qos byte, callback func(mqtt.Message)) {
+	if mqtt.IsSharedSubscription(topicFilter) {
+		return
+	}
+
+	messages := make([]mqtt.Message, 0)
+
+	b.mu.Lock()
+	now := time.Now()
+	for topic, publishedMessage := range b.retainedByTopic {
+		if !mqtt.TopicMatches(topicFilter, topic) {
+			continue
+		}
+
+		if publishedMessage.expired(now) {
+			delete(b.retainedByTopic, topic)
+			continue
+		}
+
+		var messageID uint16
+		if min(publishedMessage.QoS, qos) > mqtt.AtMostOnce {
+			messageID = b.getNextMessageID()
+		}
+
+		messages = append(messages, mqtt.Message{
+			Received:   now,
+			Topic:      topic,
+			MessageID:  messageID,
+			QoS:        min(publishedMessage.QoS, qos),
+			Retained:   client.ReportsRetained(),
+			Payload:    publishedMessage.Payload,
+			RawPayload: []byte(publishedMessage.Payload),
+			Properties: client.getProperties(publishedMessage.Properties),
+		})
+	}
+	b.mu.Unlock()
+
+	for _, message := range messages {
+		callback(message)
+	}
+}
+
+func getPayloadString(payload interface{}) string {
+	switch v := payload.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprintf("%v", payload)
+	}
+}
+
+// Inject publishes a message as if it came from some other client connected to the broker
+func (b *Broker) Inject(topic string, qos byte, retained bool, payload interface{}) {
+	b.publish(PublishedMessage{
+		ClientID: "mqtttest_injected",
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  getPayloadString(payload),
+	})
+}
+
+// DropAll simulates the broker going away; every connected client gets err via its error handler
+func (b *Broker) DropAll(err error) {
+	b.mu.Lock()
+	clients := make([]*Client, 0)
+	for client := range b.clients {
+		clients = append(clients, client)
+	}
+	b.mu.Unlock()
+
+	for _, client := range clients {
+		client.Drop(err)
+	}
+}
+
+func (b *Broker) Published() []PublishedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	published := make([]PublishedMessage, len(b.published))
+	copy(published, b.published)
+
+	return published
+}
+
+// PublishedTo returns everything published on topics matching topicFilter, in order
+func (b *Broker) PublishedTo(topicFilter string) []PublishedMessage {
+	published := make([]PublishedMessage, 0)
+
+	for _, publishedMessage := range b.Published() {
+		if !mqtt.TopicMatches(topicFilter, publishedMessage.Topic) {
+			continue
+		}
+
+		published = append(published, publishedMessage)
+	}
+
+	return published
+}
+
+// LastPublishedTo returns the most recent message published on topics matching topicFilter
+func (b *Broker) LastPublishedTo(topicFilter string) (PublishedMessage, bool) {
+	published := b.PublishedTo(topicFilter)
+	if len(published) == 0 {
+		return PublishedMessage{}, false
+	}
+
+	return published[len(published)-1], true
+}
+
+func (b *Broker) Retained(topic string) (PublishedMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	publishedMessage, ok := b.retainedByTopic[topic]
+
+	return publishedMessage, ok
+}
+
+// ClearPublished forgets the publish history (but not the retained messages)
+func (b *Broker) ClearPublished() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.published = make([]PublishedMessage, 0)
+}
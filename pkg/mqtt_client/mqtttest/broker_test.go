@@ -0,0 +1,156 @@
+package mqtttest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+func TestBroker(t *testing.T) {
+	t.Run("Wildcards", func(t *testing.T) {
+		b := NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		received := make([]string, 0)
+		require.NoError(t, c.Subscribe("home/+/lights/#", mqtt.AtLeastOnce, func(message mqtt.Message) {
+			received = append(received, message.Topic)
+		}))
+
+		b.Inject("home/inside/lights/globe/state/get", mqtt.AtLeastOnce, false, "1")
+		b.Inject("home/outside/lights", mqtt.AtLeastOnce, false, "1")
+		b.Inject("home/inside/switches/globe/state/get", mqtt.AtLeastOnce, false, "1")
+
+		require.Equal(t, []string{"home/inside/lights/globe/state/get", "home/outside/lights"}, received)
+	})
+
+	t.Run("Retained", func(t *testing.T) {
+		b := NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		require.NoError(t, c.Publish("a/b/get", mqtt.ExactlyOnce, true, "1"))
+		require.NoError(t, c.Publish("a/c/get", mqtt.ExactlyOnce, false, "2"))
+		b.RequireRetained(t, "a/b/get", "1")
+
+		var received []mqtt.Message
+		require.NoError(t, c.Subscribe("a/+/get", mqtt.AtMostOnce, func(message mqtt.Message) {
+			received = append(received, message)
+		}))
+
+		require.Len(t, received, 1)
+		require.Equal(t, "1", received[0].Payload)
+		require.Equal(t, []byte("1"), received[0].RawPayload)
+		require.Equal(t, uint16(0), received[0].MessageID)
+		require.Equal(t, mqtt.AtMostOnce, received[0].QoS)
+		require.True(t, received[0].Retained)
+
+		// live messages don't carry the retain flag, even if they were published retained
+		require.NoError(t, c.Publish("a/b/get", mqtt.ExactlyOnce, true, []byte("3")))
+		require.Len(t, received, 2)
+		require.Equal(t, "3", received[1].Payload)
+		require.False(t, received[1].Retained)
+
+		require.NoError(t, c.Publish("a/b/get", mqtt.ExactlyOnce, true, ""))
+		_, ok := b.Retained("a/b/get")
+		require.False(t, ok)
+	})
+
+	t.Run("SharedSubscriptions", func(t *testing.T) {
+		b := NewBroker()
+		b.Inject("a/b/get", mqtt.AtMostOnce, true, "retained")
+
+		receivedByClientID := make(map[string][]string)
+		for i := 0; i < 2; i++ {
+			c := b.NewClient(nil)
+			require.NoError(t, c.Connect())
+			require.NoError(t, c.Subscribe(mqtt.SharedSubscription("some-group", "a/+/get"), mqtt.AtMostOnce, func(message mqtt.Message) {
+				receivedByClientID[c.ClientID()] = append(receivedByClientID[c.ClientID()], message.Payload)
+			}))
+		}
+
+		everything := make([]string, 0)
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+		require.NoError(t, c.Subscribe("a/+/get", mqtt.AtMostOnce, func(message mqtt.Message) {
+			everything = append(everything, message.Payload)
+		}))
+
+		for _, payload := range []string{"1", "2", "3", "4"} {
+			b.Inject("a/c/get", mqtt.AtMostOnce, false, payload)
+		}
+
+		// shared subscriptions don't get retained messages and the group splits the rest
+		require.Equal(t, map[string][]string{"mqtttest_1": {"1", "3"}, "mqtttest_2": {"2", "4"}}, receivedByClientID)
+		require.Equal(t, []string{"retained", "1", "2", "3", "4"}, everything)
+	})
+
+	t.Run("MessageExpiry", func(t *testing.T) {
+		b := NewBroker()
+		c := b.NewClient(nil)
+		c.EnableProperties()
+		require.NoError(t, c.Connect())
+
+		require.NoError(t, c.PublishWithProperties("a/b/get", mqtt.AtMostOnce, true, "1", mqtt.Properties{MessageExpiry: time.Millisecond * 50}))
+		require.NoError(t, c.PublishWithProperties("a/c/get", mqtt.AtMostOnce, true, "2", mqtt.Properties{ContentType: "text/plain"}))
+		time.Sleep(time.Millisecond * 100)
+
+		var received []mqtt.Message
+		require.NoError(t, c.Subscribe("a/+/get", mqtt.AtMostOnce, func(message mqtt.Message) {
+			received = append(received, message)
+		}))
+
+		require.Len(t, received, 1)
+		require.Equal(t, "2", received[0].Payload)
+		require.Equal(t, "text/plain", received[0].Properties.ContentType)
+		_, ok := b.Retained("a/b/get")
+		require.False(t, ok)
+	})
+
+	t.Run("WillAndDrop", func(t *testing.T) {
+		b := NewBroker()
+
+		errs := make(chan error, 1)
+		c := b.NewClient(func(_ mqtt.Client, err error) {
+			errs <- err
+		})
+		require.NoError(t, c.SetWill("some/availability", mqtt.AtLeastOnce, true, "offline"))
+		require.NoError(t, c.Connect())
+
+		c.Drop(fmt.Errorf("injected"))
+		require.False(t, c.IsConnected())
+		require.EqualError(t, <-errs, "injected")
+		b.RequireRetained(t, "some/availability", "offline")
+
+		require.Error(t, c.Publish("a", mqtt.AtMostOnce, false, "1"))
+	})
+
+	t.Run("CleanDisconnectDiscardsWill", func(t *testing.T) {
+		b := NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.SetWill("some/availability", mqtt.AtLeastOnce, true, "offline"))
+		require.NoError(t, c.Connect())
+		require.NoError(t, c.Disconnect())
+		b.RequireNotPublished(t, "some/availability")
+	})
+
+	t.Run("InjectedErrors", func(t *testing.T) {
+		b := NewBroker()
+		c := b.NewClient(nil)
+
+		c.FailConnects(fmt.Errorf("nope"))
+		require.EqualError(t, c.Connect(), "nope")
+		require.NoError(t, c.Connect())
+		require.Equal(t, 1, c.ConnectCount())
+
+		c.SetPublishError(fmt.Errorf("publish nope"))
+		require.EqualError(t, c.Publish("a", mqtt.AtMostOnce, false, "1"), "publish nope")
+		c.SetPublishError(nil)
+		require.NoError(t, c.Publish("a", mqtt.AtMostOnce, false, "1"))
+		b.RequirePublishedSequence(t, "#", "1")
+	})
+}
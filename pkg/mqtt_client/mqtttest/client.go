@@ -0,0 +1,294 @@
+package mqtttest
+
+import (
+	"fmt"
+	"sync"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+type subscription struct {
+	topic    string
+	qos      byte
+	callback func(message mqtt.Message)
+}
+
+type Client struct {
+	mu                  sync.Mutex
+	broker              *Broker
+	clientID            string
+	errorHandler        func(mqtt.Client, error)
+	connected           bool
+	connectCount        int
+	will                *PublishedMessage
+	subscriptionByTopic map[string]subscription
+	connectErrs         []error
+	publishErr          error
+	subscribeErr        error
+	propertiesEnabled   bool
+	retainedDisabled    bool
+}
+
+func (c *Client) ClientID() string {
+	return c.clientID
+}
+
+// String stops %+v (e.g. in PersistentClient's logging) from reading the struct (and racing on the mutex)
+func (c *Client) String() string {
+	return fmt.Sprintf("mqtttest.Client{%v}", c.clientID)
+}
+
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connected
+}
+
+func (c *Client) ConnectCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connectCount
+}
+
+// EnableProperties makes the client behave as if it spoke MQTT 5 (i.e. it implements mqtt.PropertiesClient)
+func (c *Client) EnableProperties() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.propertiesEnabled = true
+}
+
+func (c *Client) SupportsProperties() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.propertiesEnabled
+}
+
+// DisableRetained makes the client behave like one that can't tell retained messages from live ones (e.g. GMQ)
+func (c *Client) DisableRetained() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.retainedDisabled = true
+}
+
+func (c *Client) ReportsRetained() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return !c.retainedDisabled
+}
+
+// getProperties strips properties for clients that wouldn't have been able to receive them
+func (c *Client) getProperties(properties *mqtt.Properties) *mqtt.Properties {
+	if !c.SupportsProperties() {
+		return nil
+	}
+
+	return properties
+}
+
+// FailConnects causes the next len(errs) calls to Connect to return those errors (in order)
+func (c *Client) FailConnects(errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connectErrs = append(c.connectErrs, errs...)
+}
+
+// SetPublishError causes every Publish to return err until it's called again with nil
+func (c *Client) SetPublishError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.publishErr = err
+}
+
+// SetSubscribeError causes every Subscribe to return err until it's called again with nil
+func (c *Client) SetSubscribeError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.subscribeErr = err
+}
+
+// Drop simulates an unclean connection loss; the will (if any) is published and the error handler is fired
+// asynchronously (as the real providers do)
+func (c *Client) Drop(err error) {
+	c.mu.Lock()
+	if !c.connected {
+		c.mu.Unlock()
+		return
+	}
+
+	c.connected = false
+	c.subscriptionByTopic = make(map[string]subscription)
+	will := c.will
+	errorHandler := c.errorHandler
+	c.mu.Unlock()
+
+	c.broker.removeClient(c)
+
+	if will != nil {
+		c.broker.publish(*will)
+	}
+
+	if errorHandler != nil {
+		go errorHandler(c, err)
+	}
+}
+
+func (c *Client) getSubscriptions() []subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	subscriptions := make([]subscription, 0, len(c.subscriptionByTopic))
+	for _, s := range c.subscriptionByTopic {
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions
+}
+
+func (c *Client) SetWill(topic string, qos byte, retained bool, payload interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.will = &PublishedMessage{
+		ClientID: c.clientID,
+		Topic:    topic,
+		QoS:      qos,
+		Retained: retained,
+		Payload:  getPayloadString(payload),
+	}
+
+	return nil
+}
+
+func (c *Client) Connect() error {
+	c.mu.Lock()
+
+	if len(c.connectErrs) > 0 {
+		err := c.connectErrs[0]
+		c.connectErrs = c.connectErrs[1:]
+		c.mu.Unlock()
+
+		return err
+	}
+
+	c.connected = true
+	c.connectCount++
+	c.mu.Unlock()
+
+	c.broker.addClient(c)
+
+	return nil
+}
+
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error {
+	return c.publish(topic, qos, retained, payload, nil)
+}
+
+func (c *Client) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties mqtt.Properties, quiet ...bool) error {
+	if !c.SupportsProperties() {
+		return fmt.Errorf("properties not enabled")
+	}
+
+	return c.publish(topic, qos, retained, payload, &properties)
+}
+
+func (c *Client) publish(topic string, qos byte, retained bool, payload interface{}, properties *mqtt.Properties) error {
+	c.mu.Lock()
+	connected := c.connected
+	publishErr := c.publishErr
+	c.mu.Unlock()
+
+	if !connected {
+		return fmt.Errorf("not connected")
+	}
+
+	if publishErr != nil {
+		return publishErr
+	}
+
+	if qos > mqtt.ExactlyOnce {
+		return fmt.Errorf("invalid qos byte %+v", qos)
+	}
+
+	c.broker.publish(PublishedMessage{
+		ClientID:   c.clientID,
+		Topic:      topic,
+		QoS:        qos,
+		Retained:   retained,
+		Payload:    getPayloadString(payload),
+		Properties: properties,
+	})
+
+	return nil
+}
+
+func (c *Client) Subscribe(topic string, qos byte, callback func(message mqtt.Message)) error {
+	c.mu.Lock()
+
+	if !c.connected {
+		c.mu.Unlock()
+		return fmt.Errorf("not connected")
+	}
+
+	if c.subscribeErr != nil {
+		err := c.subscribeErr
+		c.mu.Unlock()
+		return err
+	}
+
+	if qos > mqtt.ExactlyOnce {
+		c.mu.Unlock()
+		return fmt.Errorf("invalid qos byte %+v", qos)
+	}
+
+	c.subscriptionByTopic[topic] = subscription{
+		topic:    topic,
+		qos:      qos,
+		callback: callback,
+	}
+
+	c.mu.Unlock()
+
+	c.broker.deliverRetained(c, topic, qos, callback)
+
+	return nil
+}
+
+func (c *Client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		return fmt.Errorf("not connected")
+	}
+
+	delete(c.subscriptionByTopic, topic)
+
+	return nil
+}
+
+func (c *Client) Disconnect() error {
+	c.mu.Lock()
+
+	if !c.connected {
+		c.mu.Unlock()
+		return fmt.Errorf("not connected")
+	}
+
+	// a clean disconnect discards the will
+	c.connected = false
+	c.subscriptionByTopic = make(map[string]subscription)
+	c.mu.Unlock()
+
+	c.broker.removeClient(c)
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package mqtt_client
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const DefaultTopicRoot = "home"
+
+// Namespace builds topics under <root>/<site>; the site is optional (and absent by default) so that the default
+// namespace gives the same "home/..." topics as ever
+type Namespace struct {
+	root string
+	site string
+}
+
+func checkTopicLevels(name string, value string) (string, error) {
+	value = strings.Trim(value, "/")
+
+	if strings.ContainsAny(value, "+#") || strings.HasPrefix(value, "$") {
+		return "", fmt.Errorf("%v %#+v can't contain wildcards or start with $", name, value)
+	}
+
+	return value, nil
+}
+
+func NewNamespace(root string, site string) (Namespace, error) {
+	root, err := checkTopicLevels("topic root", root)
+	if err != nil {
+		return Namespace{}, err
+	}
+
+	if root == "" {
+		return Namespace{}, fmt.Errorf("topic root can't be empty")
+	}
+
+	site, err = checkTopicLevels("site", site)
+	if err != nil {
+		return Namespace{}, err
+	}
+
+	return Namespace{root: root, site: site}, nil
+}
+
+func GetDefaultNamespace() Namespace {
+	return Namespace{root: DefaultTopicRoot}
+}
+
+// AddNamespaceFlags adds -topicRoot and -site (defaulting to MQTT_TOPIC_ROOT and MQTT_SITE if they're set) to
+// flagSet; the returned func gives the Namespace once flagSet has been parsed
+func AddNamespaceFlags(flagSet *flag.FlagSet) func() (Namespace, error) {
+	defaultRoot := strings.TrimSpace(os.Getenv("MQTT_TOPIC_ROOT"))
+	if defaultRoot == "" {
+		defaultRoot = DefaultTopicRoot
+	}
+
+	rootPtr := flagSet.String("topicRoot", defaultRoot, "first level of every topic")
+	sitePtr := flagSet.String("site", strings.TrimSpace(os.Getenv("MQTT_SITE")), "site name, inserted after the topic root (optional; for more than one site on the same broker)")
+
+	return func() (Namespace, error) {
+		return NewNamespace(*rootPtr, *sitePtr)
+	}
+}
+
+func (n Namespace) String() string {
+	return n.Prefix()
+}
+
+func (n Namespace) Root() string {
+	return n.root
+}
+
+func (n Namespace) Site() string {
+	return n.site
+}
+
+// Prefix is what every topic in the namespace starts with (without the trailing slash)
+func (n Namespace) Prefix() string {
+	if n.site == "" {
+		return n.root
+	}
+
+	return n.root + "/" + n.site
+}
+
+// Topic joins parts (which can themselves contain slashes, e.g. "inside/heater/state/get") onto the prefix
+func (n Namespace) Topic(parts ...string) string {
+	levels := []string{n.Prefix()}
+
+	for _, part := range parts {
+		part = strings.Trim(part, "/")
+		if part == "" {
+			continue
+		}
+
+		levels = append(levels, part)
+	}
+
+	return strings.Join(levels, "/")
+}
+
+// Topicf is Topic for a single part built with fmt.Sprintf
+func (n Namespace) Topicf(format string, a ...interface{}) string {
+	return n.Topic(fmt.Sprintf(format, a...))
+}
+
+// Relative strips the prefix from topic, returning false if topic isn't in the namespace
+func (n Namespace) Relative(topic string) (string, bool) {
+	prefix := n.Prefix() + "/"
+
+	if !strings.HasPrefix(topic, prefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(topic, prefix), true
+}
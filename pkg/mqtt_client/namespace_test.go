@@ -0,0 +1,56 @@
+package mqtt_client_test
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+func TestNamespace(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		n := mqtt.GetDefaultNamespace()
+		require.Equal(t, "home/inside/heater/state/get", n.Topic("inside/heater/state/get"))
+		require.Equal(t, "home/inside/lights/globe/kitchen/state/get", n.Topic("inside/lights", "globe/kitchen/state/get"))
+		require.Equal(t, "home/outside/sprinklers/bank/2/state/set", n.Topicf("outside/sprinklers/bank/%v/state/set", 2))
+		require.Equal(t, "home/#", n.Topic("#"))
+		require.Equal(t, "home", n.Topic())
+	})
+
+	t.Run("Site", func(t *testing.T) {
+		n, err := mqtt.NewNamespace("/staging/", "beach-house")
+		require.NoError(t, err)
+		require.Equal(t, "staging/beach-house", n.Prefix())
+		require.Equal(t, "staging/beach-house/inside/heater/state/get", n.Topic("/inside/heater/state/get"))
+
+		relative, ok := n.Relative("staging/beach-house/inside/heater/state/get")
+		require.True(t, ok)
+		require.Equal(t, "inside/heater/state/get", relative)
+
+		_, ok = n.Relative("home/inside/heater/state/get")
+		require.False(t, ok)
+		_, ok = n.Relative("staging/beach-house-2/inside/heater/state/get")
+		require.False(t, ok)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, rootAndSite := range [][2]string{{"", ""}, {"home/#", ""}, {"home", "+"}, {"$SYS", ""}} {
+			_, err := mqtt.NewNamespace(rootAndSite[0], rootAndSite[1])
+			require.Error(t, err, "%#+v", rootAndSite)
+		}
+	})
+
+	t.Run("Flags", func(t *testing.T) {
+		t.Setenv("MQTT_SITE", "beach-house")
+
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		getNamespace := mqtt.AddNamespaceFlags(flagSet)
+		require.NoError(t, flagSet.Parse([]string{"-topicRoot", "staging"}))
+
+		n, err := getNamespace()
+		require.NoError(t, err)
+		require.Equal(t, "staging/beach-house", n.Prefix())
+	})
+}
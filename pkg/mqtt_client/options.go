@@ -0,0 +1,86 @@
+package mqtt_client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-rootcerts"
+)
+
+type ConnectionOptions struct {
+	TLS                bool
+	CAFile             string
+	CAPath             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func getBoolFromEnv(key string) bool {
+	value, err := strconv.ParseBool(strings.TrimSpace(os.Getenv(key)))
+	if err != nil {
+		return false
+	}
+
+	return value
+}
+
+func GetConnectionOptionsFromEnv() ConnectionOptions {
+	return ConnectionOptions{
+		TLS:                getBoolFromEnv("MQTT_TLS"),
+		CAFile:             strings.TrimSpace(os.Getenv("MQTT_CA_FILE")),
+		CAPath:             strings.TrimSpace(os.Getenv("MQTT_CA_PATH")),
+		CertFile:           strings.TrimSpace(os.Getenv("MQTT_CERT_FILE")),
+		KeyFile:            strings.TrimSpace(os.Getenv("MQTT_KEY_FILE")),
+		ServerName:         strings.TrimSpace(os.Getenv("MQTT_SERVER_NAME")),
+		InsecureSkipVerify: getBoolFromEnv("MQTT_INSECURE_SKIP_VERIFY"),
+	}
+}
+
+// IsTLS is true if TLS was asked for explicitly or implied by any of the TLS-only fields
+func (o ConnectionOptions) IsTLS() bool {
+	return o.TLS ||
+		o.CAFile != "" ||
+		o.CAPath != "" ||
+		o.CertFile != "" ||
+		o.KeyFile != "" ||
+		o.ServerName != "" ||
+		o.InsecureSkipVerify
+}
+
+// GetTLSConfig reads the certificates from disk every time it's called so that reconnects pick up rotated certs
+func (o ConnectionOptions) GetTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" || o.CAPath != "" {
+		err := rootcerts.ConfigureTLS(tlsConfig, &rootcerts.Config{
+			CAFile: o.CAFile,
+			CAPath: o.CAPath,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA certs from %#+v / %#+v because: %v", o.CAFile, o.CAPath, err)
+		}
+	}
+
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("client cert %#+v and client key %#+v must be specified together", o.CertFile, o.KeyFile)
+		}
+
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert %#+v / key %#+v because: %v", o.CertFile, o.KeyFile, err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,168 @@
+package mqtt_client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a throwaway self-signed cert (which is its own CA) and its key to dir as <name>.pem / <name>-key.pem
+func writeCert(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0o600))
+
+	return certFile, keyFile
+}
+
+func TestConnectionOptions(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "client")
+	_, otherKeyFile := writeCert(t, dir, "other")
+
+	caDir := filepath.Join(dir, "ca")
+	require.NoError(t, os.Mkdir(caDir, 0o700))
+	caFile, caKeyFile := writeCert(t, caDir, "ca")
+	require.NoError(t, os.Remove(caKeyFile)) // a CA path should only have certs in it
+
+	garbageFile := filepath.Join(dir, "garbage.pem")
+	require.NoError(t, os.WriteFile(garbageFile, []byte("not a cert"), 0o600))
+
+	t.Run("IsTLS", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name    string
+			options ConnectionOptions
+			isTLS   bool
+		}{
+			{"Nothing", ConnectionOptions{}, false},
+			{"Explicit", ConnectionOptions{TLS: true}, true},
+			{"CAFile", ConnectionOptions{CAFile: certFile}, true},
+			{"CAPath", ConnectionOptions{CAPath: dir}, true},
+			{"CertFile", ConnectionOptions{CertFile: certFile}, true},
+			{"KeyFile", ConnectionOptions{KeyFile: keyFile}, true},
+			{"ServerName", ConnectionOptions{ServerName: "broker.example.com"}, true},
+			{"InsecureSkipVerify", ConnectionOptions{InsecureSkipVerify: true}, true},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				require.Equal(t, testCase.isTLS, testCase.options.IsTLS())
+			})
+		}
+	})
+
+	t.Run("GetTLSConfig", func(t *testing.T) {
+		for _, testCase := range []struct {
+			name    string
+			options ConnectionOptions
+			check   func(t *testing.T, tlsConfig *tls.Config)
+			isError bool
+		}{
+			{
+				name:    "Nothing",
+				options: ConnectionOptions{TLS: true},
+				check: func(t *testing.T, tlsConfig *tls.Config) {
+					require.Nil(t, tlsConfig.RootCAs)
+					require.Empty(t, tlsConfig.Certificates)
+					require.False(t, tlsConfig.InsecureSkipVerify)
+				},
+			},
+			{
+				name:    "CAFile",
+				options: ConnectionOptions{CAFile: caFile, ServerName: "broker.example.com"},
+				check: func(t *testing.T, tlsConfig *tls.Config) {
+					require.NotNil(t, tlsConfig.RootCAs)
+					require.Equal(t, "broker.example.com", tlsConfig.ServerName)
+				},
+			},
+			{
+				name:    "CAPath",
+				options: ConnectionOptions{CAPath: caDir},
+				check: func(t *testing.T, tlsConfig *tls.Config) {
+					require.NotNil(t, tlsConfig.RootCAs)
+				},
+			},
+			{
+				name:    "BadCAFile",
+				options: ConnectionOptions{CAFile: garbageFile},
+				isError: true,
+			},
+			{
+				name:    "MissingCAFile",
+				options: ConnectionOptions{CAFile: filepath.Join(dir, "missing.pem")},
+				isError: true,
+			},
+			{
+				name:    "ClientKeyPair",
+				options: ConnectionOptions{CertFile: certFile, KeyFile: keyFile},
+				check: func(t *testing.T, tlsConfig *tls.Config) {
+					require.Len(t, tlsConfig.Certificates, 1)
+				},
+			},
+			{
+				name:    "CertWithoutKey",
+				options: ConnectionOptions{CertFile: certFile},
+				isError: true,
+			},
+			{
+				name:    "KeyWithoutCert",
+				options: ConnectionOptions{KeyFile: keyFile},
+				isError: true,
+			},
+			{
+				name:    "CertKeyMismatch",
+				options: ConnectionOptions{CertFile: certFile, KeyFile: otherKeyFile},
+				isError: true,
+			},
+			{
+				name:    "InsecureSkipVerify",
+				options: ConnectionOptions{InsecureSkipVerify: true},
+				check: func(t *testing.T, tlsConfig *tls.Config) {
+					require.True(t, tlsConfig.InsecureSkipVerify)
+				},
+			},
+		} {
+			t.Run(testCase.name, func(t *testing.T) {
+				tlsConfig, err := testCase.options.GetTLSConfig()
+				if testCase.isError {
+					require.Error(t, err)
+					return
+				}
+
+				require.NoError(t, err)
+				testCase.check(t, tlsConfig)
+			})
+		}
+	})
+}
@@ -1,28 +1,141 @@
 package mqtt_client
 
 import (
+	"fmt"
 	"log"
 	"sync"
 	"time"
 )
 
+const (
+	AvailabilityOnline  = "online"
+	AvailabilityOffline = "offline"
+)
+
+// Subscription is a handle to a single callback registered with PersistentClient.SubscribeWithHandle
 type Subscription struct {
-	topic    string
-	qos      byte
-	callback func(message Message)
+	client *PersistentClient
+	topic  string
+	id     uint64
+	once   sync.Once
+}
+
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Unsubscribe removes just this callback; the provider is only unsubscribed once the last callback for the topic goes
+func (s *Subscription) Unsubscribe() error {
+	var err error
+
+	s.once.Do(func() {
+		err = s.client.removeHandler(s.topic, s.id)
+	})
+
+	return err
 }
 
 type PersistentClient struct {
-	client                Client
-	subscriptionByTopicMu sync.Mutex
-	subscriptionByTopic   map[string]Subscription
-	errorBeingHandledMu   sync.Mutex
-	errorBeingHandled     bool
+	client              Client
+	subscribeMu         sync.Mutex
+	dispatcher          *dispatcher
+	errorBeingHandledMu sync.Mutex
+	errorBeingHandled   bool
+	errorHandled        *sync.Cond
+	backoffOptions      BackoffOptions
+	stateMu             sync.Mutex
+	state               ConnectionState
+	lastObserverID      uint64
+	observerByID        map[uint64]func(event ConnectionEvent)
+	availabilityTopic   string
+	publishQueue        *PublishQueue
+	rateLimiter         *RateLimiter
+	drainMu             sync.Mutex
 }
 
 func NewPersistentClient() *PersistentClient {
-	return &PersistentClient{
-		subscriptionByTopic: make(map[string]Subscription),
+	c := &PersistentClient{
+		dispatcher:     newDispatcher(),
+		backoffOptions: DefaultBackoffOptions,
+		observerByID:   make(map[uint64]func(event ConnectionEvent)),
+	}
+
+	c.errorHandled = sync.NewCond(&c.errorBeingHandledMu)
+
+	return c
+}
+
+// SetBackoff controls the delay between reconnect attempts
+func (c *PersistentClient) SetBackoff(options BackoffOptions) {
+	c.errorBeingHandledMu.Lock()
+	defer c.errorBeingHandledMu.Unlock()
+
+	c.backoffOptions = options
+}
+
+func (c *PersistentClient) State() ConnectionState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.state
+}
+
+// AddObserver registers observer to be called (on the goroutine that caused it) for every change in connection
+// state; call the returned func to remove it
+func (c *PersistentClient) AddObserver(observer func(event ConnectionEvent)) func() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.lastObserverID++
+	id := c.lastObserverID
+
+	c.observerByID[id] = observer
+
+	return func() {
+		c.stateMu.Lock()
+		defer c.stateMu.Unlock()
+
+		delete(c.observerByID, id)
+	}
+}
+
+// Events is AddObserver as a channel; events are dropped (with a warning) rather than blocking if it's full
+func (c *PersistentClient) Events(bufferSize int) (<-chan ConnectionEvent, func()) {
+	events := make(chan ConnectionEvent, bufferSize)
+
+	remove := c.AddObserver(func(event ConnectionEvent) {
+		select {
+		case events <- event:
+		default:
+			log.Printf("warning: connection event channel full; dropping %+v", event)
+		}
+	})
+
+	return events, remove
+}
+
+func (c *PersistentClient) setState(state ConnectionState, err error, attempt int) {
+	c.stateMu.Lock()
+
+	event := ConnectionEvent{
+		Time:     time.Now(),
+		State:    state,
+		Previous: c.state,
+		Err:      err,
+		Attempt:  attempt,
+	}
+
+	c.state = state
+
+	observers := make([]func(event ConnectionEvent), 0, len(c.observerByID))
+	for _, observer := range c.observerByID {
+		observers = append(observers, observer)
+	}
+
+	c.stateMu.Unlock()
+
+	for _, observer := range observers {
+		observer(event)
 	}
 }
 
@@ -30,21 +143,199 @@ func (c *PersistentClient) SetClient(client Client) {
 	c.client = client
 }
 
+func (c *PersistentClient) GetClient() Client {
+	return c.client
+}
+
+func (c *PersistentClient) SetWill(topic string, qos byte, retained bool, payload interface{}) error {
+	return c.client.SetWill(topic, qos, retained, payload)
+}
+
+// SetAvailabilityTopic must be called before Connect; the topic gets a retained "online" on every (re)connect,
+// "offline" on a clean disconnect and "offline" via the will if we go away uncleanly
+func (c *PersistentClient) SetAvailabilityTopic(topic string) error {
+	err := c.client.SetWill(topic, AtLeastOnce, true, AvailabilityOffline)
+	if err != nil {
+		return err
+	}
+
+	c.availabilityTopic = topic
+
+	return nil
+}
+
+func (c *PersistentClient) publishAvailability(payload string) error {
+	if c.availabilityTopic == "" {
+		return nil
+	}
+
+	log.Printf("publishing %+v to %+v", payload, c.availabilityTopic)
+
+	return c.client.Publish(c.availabilityTopic, AtLeastOnce, true, payload)
+}
+
+// EnablePublishQueue makes Publish buffer messages (rather than block / fail) while disconnected; they're drained in
+// order on reconnect
+func (c *PersistentClient) EnablePublishQueue(options PublishQueueOptions) error {
+	publishQueue, err := NewPublishQueue(options)
+	if err != nil {
+		return err
+	}
+
+	c.publishQueue = publishQueue
+
+	return nil
+}
+
+func (c *PersistentClient) GetPublishQueue() *PublishQueue {
+	return c.publishQueue
+}
+
+// EnableRateLimit paces Publish and PublishWithProperties (but not the availability messages or the draining of the
+// publish queue, which were rate limited on the way in); see RateLimitOptions
+func (c *PersistentClient) EnableRateLimit(options RateLimitOptions) error {
+	rateLimiter, err := NewRateLimiter(options)
+	if err != nil {
+		return err
+	}
+
+	c.rateLimiter = rateLimiter
+
+	return nil
+}
+
+func (c *PersistentClient) GetRateLimiter() *RateLimiter {
+	return c.rateLimiter
+}
+
+func (c *PersistentClient) waitForRateLimit(topic string, quiet bool) error {
+	if c.rateLimiter == nil {
+		return nil
+	}
+
+	err := c.rateLimiter.Wait(topic)
+	if err != nil && !quiet {
+		log.Printf("failed to publish %+v because %+v", topic, err)
+	}
+
+	return err
+}
+
+// drainPublishQueue must be called with drainMu held
+func (c *PersistentClient) drainPublishQueue() error {
+	if c.publishQueue == nil {
+		return nil
+	}
+
+	drained := 0
+
+	for {
+		message, ok := c.publishQueue.Peek()
+		if !ok {
+			break
+		}
+
+		err := c.publish(message.Topic, message.QoS, message.Retained, message.Payload, message.Properties)
+		if err != nil {
+			if !c.isConnectionLost() && c.publishQueue.Fail() {
+				continue
+			}
+
+			return fmt.Errorf("failed to drain publish queue (%v drained, %v remaining) because: %v", drained, c.publishQueue.Len(), err)
+		}
+
+		c.publishQueue.Pop()
+		drained++
+	}
+
+	if drained > 0 {
+		log.Printf("drained %v messages from publish queue", drained)
+	}
+
+	return nil
+}
+
+// publish uses PublishWithProperties if properties isn't nil (and the client can still carry them)
+func (c *PersistentClient) publish(topic string, qos byte, retained bool, payload interface{}, properties *Properties) error {
+	if properties != nil {
+		propertiesClient, ok := c.client.(PropertiesClient)
+		if ok && propertiesClient.SupportsProperties() {
+			return propertiesClient.PublishWithProperties(topic, qos, retained, payload, *properties)
+		}
+	}
+
+	return c.client.Publish(topic, qos, retained, payload)
+}
+
+// isConnectionLost is true while we're not (or know we're no longer) connected
+func (c *PersistentClient) isConnectionLost() bool {
+	return c.isErrorBeingHandled() || c.State() != Connected
+}
+
+// publishOrQueue only queues what might get through once the connection is back; a message that can never be
+// published (e.g. to an invalid topic) is an error for the caller rather than something to hold up the queue with
+func (c *PersistentClient) publishOrQueue(topic string, qos byte, retained bool, payload interface{}, properties *Properties, quiet bool) error {
+	err := ValidatePublishTopic(topic)
+	if err == nil && qos > ExactlyOnce {
+		err = fmt.Errorf("invalid qos %v", qos)
+	}
+
+	if err != nil {
+		if !quiet {
+			log.Printf("failed to publish because %+v; not queueing", err)
+		}
+
+		return err
+	}
+
+	message := QueuedMessage{
+		Queued:     time.Now(),
+		Topic:      topic,
+		QoS:        qos,
+		Retained:   retained,
+		Payload:    getPayloadBytes(payload),
+		Properties: properties,
+	}
+
+	if !c.isErrorBeingHandled() {
+		c.drainMu.Lock()
+		err := c.drainPublishQueue()
+		if err == nil {
+			err = c.publish(topic, qos, retained, payload, properties)
+		}
+		c.drainMu.Unlock()
+
+		if err == nil {
+			return nil
+		}
+
+		if !quiet {
+			log.Printf("failed to publish because %+v; queueing", err)
+		}
+	} else if !quiet {
+		log.Printf("error being handled; queueing")
+	}
+
+	c.publishQueue.Push(message)
+
+	return nil
+}
+
 func (c *PersistentClient) unsubscribeAll() {
-	c.subscriptionByTopicMu.Lock()
-	defer c.subscriptionByTopicMu.Unlock()
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
 
-	for topic := range c.subscriptionByTopic {
+	for topic := range c.dispatcher.getFilters() {
 		_ = c.client.Unsubscribe(topic)
 	}
 }
 
 func (c *PersistentClient) resubscribeAll() error {
-	c.subscriptionByTopicMu.Lock()
-	defer c.subscriptionByTopicMu.Unlock()
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
 
-	for _, subscription := range c.subscriptionByTopic {
-		err := c.client.Subscribe(subscription.topic, subscription.qos, subscription.callback)
+	for topic, qos := range c.dispatcher.getFilters() {
+		err := c.client.Subscribe(topic, qos, c.dispatcher.getCallback(topic))
 		if err != nil {
 			return err
 		}
@@ -61,16 +352,15 @@ func (c *PersistentClient) isErrorBeingHandled() bool {
 }
 
 func (c *PersistentClient) waitWhileErrorBeingHandled() {
-	for {
-		if c.isErrorBeingHandled() {
-			log.Printf("error being handled; waiting...")
-
-			time.Sleep(time.Second)
+	c.errorBeingHandledMu.Lock()
+	defer c.errorBeingHandledMu.Unlock()
 
-			continue
-		}
+	if c.errorBeingHandled {
+		log.Printf("error being handled; waiting...")
+	}
 
-		break
+	for c.errorBeingHandled {
+		c.errorHandled.Wait()
 	}
 }
 
@@ -82,23 +372,37 @@ func (c *PersistentClient) HandleError(client Client, err error) {
 		c.errorBeingHandledMu.Unlock()
 		log.Printf("another error is already in progress, ignoring this error.")
 		return
-	} else {
-		c.errorBeingHandled = true
-		c.errorBeingHandledMu.Unlock()
 	}
 
-	for {
+	c.errorBeingHandled = true
+	backoffOptions := c.backoffOptions
+	c.errorBeingHandledMu.Unlock()
+
+	c.reconnect(err, backoffOptions)
+
+	c.errorBeingHandledMu.Lock()
+	c.errorBeingHandled = false
+	c.errorHandled.Broadcast()
+	c.errorBeingHandledMu.Unlock()
+}
+
+func (c *PersistentClient) reconnect(err error, backoffOptions BackoffOptions) {
+	for attempt := 1; ; attempt++ {
+		c.setState(Reconnecting, err, attempt)
+
 		log.Printf("unsubscribing from all topics...")
 		c.unsubscribeAll()
 
+		// not c.Disconnect() because the connection is probably broken anyway and the will covers availability
 		log.Printf("disconnecting...")
-		_ = c.Disconnect()
+		_ = c.client.Disconnect()
 
-		log.Printf("sleeping...")
-		time.Sleep(time.Second)
+		delay := backoffOptions.getDelay(attempt)
+		log.Printf("sleeping for %v before attempt %v...", delay, attempt)
+		time.Sleep(delay)
 
 		log.Printf("reconnecting...")
-		err = c.Connect()
+		err = c.connect()
 		if err != nil {
 			log.Printf("reconnect failed because %+v; trying again...", err)
 
@@ -114,31 +418,60 @@ func (c *PersistentClient) HandleError(client Client, err error) {
 		}
 
 		log.Printf("reconnected.")
-		break
-	}
+		c.setState(Connected, nil, attempt)
 
-	c.errorBeingHandledMu.Lock()
-	c.errorBeingHandled = false
-	c.errorBeingHandledMu.Unlock()
+		return
+	}
 }
 
 func (c *PersistentClient) Connect() error {
+	c.setState(Connecting, nil, 0)
+
+	err := c.connect()
+	if err != nil {
+		c.setState(Disconnected, err, 0)
+
+		return err
+	}
+
+	c.setState(Connected, nil, 0)
+
+	return nil
+}
+
+func (c *PersistentClient) connect() error {
 	log.Printf("connecting...")
 
 	err := c.client.Connect()
 
 	if err != nil {
 		log.Printf("failed to connect because %+v", err)
-	} else {
-		log.Printf("connected")
+
+		return err
 	}
 
-	return err
+	log.Printf("connected")
+
+	err = c.publishAvailability(AvailabilityOnline)
+	if err != nil {
+		log.Printf("failed to publish availability because %+v", err)
+
+		return err
+	}
+
+	c.drainMu.Lock()
+	err = c.drainPublishQueue()
+	c.drainMu.Unlock()
+	if err != nil {
+		log.Printf("warning: %v", err)
+	}
+
+	return nil
 }
 
+// Publish blocks while an error is being handled unless the publish queue is enabled, in which case the message is
+// queued and nil is returned (unless it could never be published, e.g. to an invalid topic)
 func (c *PersistentClient) Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error {
-	c.waitWhileErrorBeingHandled()
-
 	actualQuiet := false
 	if len(quiet) > 0 {
 		actualQuiet = quiet[0]
@@ -148,7 +481,18 @@ func (c *PersistentClient) Publish(topic string, qos byte, retained bool, payloa
 		log.Printf("publishing %+v to %+v", payload, topic)
 	}
 
-	err := c.client.Publish(topic, qos, retained, payload)
+	err := c.waitForRateLimit(topic, actualQuiet)
+	if err != nil {
+		return err
+	}
+
+	if c.publishQueue != nil {
+		return c.publishOrQueue(topic, qos, retained, payload, nil, actualQuiet)
+	}
+
+	c.waitWhileErrorBeingHandled()
+
+	err = c.client.Publish(topic, qos, retained, payload)
 	if err != nil {
 		if !actualQuiet {
 			log.Printf("failed to publish because %+v", err)
@@ -160,33 +504,119 @@ func (c *PersistentClient) Publish(topic string, qos byte, retained bool, payloa
 	return nil
 }
 
+func (c *PersistentClient) ReportsRetained() bool {
+	return ReportsRetained(c.client)
+}
+
+func (c *PersistentClient) SupportsProperties() bool {
+	propertiesClient, ok := c.client.(PropertiesClient)
+
+	return ok && propertiesClient.SupportsProperties()
+}
+
+// PublishWithProperties behaves like Publish (including the publish queue, if enabled)
+func (c *PersistentClient) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties Properties, quiet ...bool) error {
+	propertiesClient, ok := c.client.(PropertiesClient)
+	if !ok || !propertiesClient.SupportsProperties() {
+		return fmt.Errorf("%T doesn't support properties", c.client)
+	}
+
+	actualQuiet := len(quiet) > 0 && quiet[0]
+
+	if !actualQuiet {
+		log.Printf("publishing %+v to %+v with %+v", payload, topic, properties)
+	}
+
+	err := c.waitForRateLimit(topic, actualQuiet)
+	if err != nil {
+		return err
+	}
+
+	if c.publishQueue != nil {
+		return c.publishOrQueue(topic, qos, retained, payload, &properties, actualQuiet)
+	}
+
+	c.waitWhileErrorBeingHandled()
+
+	err = propertiesClient.PublishWithProperties(topic, qos, retained, payload, properties)
+	if err != nil && !actualQuiet {
+		log.Printf("failed to publish because %+v", err)
+	}
+
+	return err
+}
+
+// Subscribe adds a callback for topic (which may be a filter); any number of callbacks can share a topic and overlapping
+// filters are each dispatched to independently of the provider in use
 func (c *PersistentClient) Subscribe(topic string, qos byte, callback func(message Message)) error {
+	_, err := c.SubscribeWithHandle(topic, qos, callback)
+
+	return err
+}
+
+// SubscribeWithHandle is Subscribe but returns a handle that can be used to remove just this callback; note that a
+// callback added to a topic that's already subscribed won't see retained messages (the broker only sends those on
+// subscribe)
+func (c *PersistentClient) SubscribeWithHandle(topic string, qos byte, callback func(message Message)) (*Subscription, error) {
 	c.waitWhileErrorBeingHandled()
 
 	log.Printf("subscribing to %+v with %p", topic, callback)
 
-	err := c.client.Subscribe(topic, qos, callback)
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
 
-	if err != nil {
-		log.Printf("failed to subscribe because %+v", err)
-	} else {
-		c.subscriptionByTopicMu.Lock()
-		c.subscriptionByTopic[topic] = Subscription{
-			topic:    topic,
-			qos:      qos,
-			callback: callback,
+	previousQoS, _ := c.dispatcher.getQoS(topic)
+
+	// the handler goes in first so that it sees any retained messages delivered during the subscribe
+	id, needsSubscribe := c.dispatcher.add(topic, qos, callback)
+
+	if needsSubscribe {
+		err := c.client.Subscribe(topic, max(previousQoS, qos), c.dispatcher.getCallback(topic))
+		if err != nil {
+			log.Printf("failed to subscribe because %+v", err)
+
+			c.dispatcher.remove(topic, id)
+
+			return nil, err
 		}
-		c.subscriptionByTopicMu.Unlock()
+	}
+
+	log.Printf("subscribed")
 
-		log.Printf("subscribed")
+	return &Subscription{
+		client: c,
+		topic:  topic,
+		id:     id,
+	}, nil
+}
+
+func (c *PersistentClient) removeHandler(topic string, id uint64) error {
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
+
+	if !c.dispatcher.remove(topic, id) {
+		return nil
+	}
+
+	log.Printf("unsubscribing from %+v (no callbacks left)", topic)
+
+	err := c.client.Unsubscribe(topic)
+	if err != nil {
+		log.Printf("failed to unsubscribe because %+v", err)
 	}
 
 	return err
 }
 
+// Unsubscribe removes every callback for topic
 func (c *PersistentClient) Unsubscribe(topic string) error {
 	log.Printf("unsubscribing from %+v", topic)
 
+	c.subscribeMu.Lock()
+	defer c.subscribeMu.Unlock()
+
+	c.dispatcher.removeAll(topic)
+
 	err := c.client.Unsubscribe(topic)
 
 	if err != nil {
@@ -201,8 +631,15 @@ func (c *PersistentClient) Unsubscribe(topic string) error {
 func (c *PersistentClient) Disconnect() error {
 	log.Printf("disconnecting...")
 
+	err := c.publishAvailability(AvailabilityOffline)
+	if err != nil {
+		log.Printf("failed to publish availability because %+v", err)
+	}
+
 	_ = c.client.Disconnect()
 
+	c.setState(Disconnected, nil, 0)
+
 	log.Printf("disconnected")
 
 	return nil
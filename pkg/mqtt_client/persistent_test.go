@@ -0,0 +1,275 @@
+package mqtt_client_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+func TestPersistentClient(t *testing.T) {
+	t.Run("HandleErrorReconnectsAndResubscribes", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		p.SetClient(c)
+
+		require.NoError(t, p.SetAvailabilityTopic("test/availability"))
+		require.NoError(t, p.Connect())
+		b.RequireRetained(t, "test/availability", mqtt.AvailabilityOnline)
+
+		mu := sync.Mutex{}
+		received := make([]string, 0)
+		require.NoError(t, p.Subscribe("test/+/set", mqtt.ExactlyOnce, func(message mqtt.Message) {
+			mu.Lock()
+			received = append(received, message.Payload)
+			mu.Unlock()
+		}))
+
+		// first reconnect attempt fails, second succeeds
+		c.FailConnects(fmt.Errorf("injected connect failure"))
+		c.Drop(fmt.Errorf("injected connection loss"))
+		b.RequirePublished(t, "test/availability", mqtt.AvailabilityOffline)
+
+		require.Eventually(t, func() bool { return c.ConnectCount() == 2 }, time.Second*5, time.Millisecond*10)
+		b.WaitForPublished(t, "test/availability", mqtt.AvailabilityOnline, time.Second)
+
+		require.NoError(t, p.Publish("test/a/set", mqtt.ExactlyOnce, false, "1"))
+
+		mu.Lock()
+		require.Equal(t, []string{"1"}, received)
+		mu.Unlock()
+
+		require.NoError(t, p.Disconnect())
+		b.RequireRetained(t, "test/availability", mqtt.AvailabilityOffline)
+	})
+	t.Run("PublishQueueDrainsOnReconnect", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		p.SetClient(c)
+
+		require.NoError(t, p.EnablePublishQueue(mqtt.PublishQueueOptions{MaxSize: 2, OverflowPolicy: mqtt.DropOldest}))
+		require.NoError(t, p.Connect())
+
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "1"))
+
+		c.SetPublishError(fmt.Errorf("injected publish failure"))
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "2"))
+		c.SetPublishError(nil)
+
+		c.Drop(fmt.Errorf("injected connection loss"))
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "3"))
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "4"))
+
+		require.Eventually(t, func() bool { return c.ConnectCount() == 2 }, time.Second*5, time.Millisecond*10)
+		require.Eventually(t, func() bool { return p.GetPublishQueue().Len() == 0 }, time.Second*5, time.Millisecond*10)
+
+		// "2" fell out of the queue because the queue only holds 2
+		b.RequirePublishedSequence(t, "test/a/get", "1", "3", "4")
+		require.Equal(t, int64(1), p.GetPublishQueue().Dropped())
+	})
+	t.Run("PublishQueueDoesntGetStuck", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		p.SetClient(c)
+
+		require.NoError(t, p.EnablePublishQueue(mqtt.PublishQueueOptions{MaxSize: 10, MaxAttempts: 2}))
+		require.NoError(t, p.Connect())
+
+		// never going to work, so not queued
+		require.Error(t, p.Publish("test/+/get", mqtt.ExactlyOnce, false, "0"))
+		require.Equal(t, 0, p.GetPublishQueue().Len())
+
+		// fails while connected; it's queued, but only given so many more goes before it's dropped
+		c.SetPublishError(fmt.Errorf("injected publish failure"))
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "1"))
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "2"))
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "3"))
+		c.SetPublishError(nil)
+
+		require.NoError(t, p.Publish("test/a/get", mqtt.ExactlyOnce, false, "4"))
+		require.Equal(t, 0, p.GetPublishQueue().Len())
+
+		b.RequirePublishedSequence(t, "test/a/get", "2", "3", "4")
+		require.Equal(t, int64(1), p.GetPublishQueue().Dropped())
+	})
+	t.Run("PublishQueueKeepsProperties", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		c.EnableProperties()
+		p.SetClient(c)
+
+		require.NoError(t, p.EnablePublishQueue(mqtt.PublishQueueOptions{MaxSize: 2}))
+		require.NoError(t, p.Connect())
+
+		c.Drop(fmt.Errorf("injected connection loss"))
+		require.NoError(t, p.PublishWithProperties("test/a/get", mqtt.ExactlyOnce, false, "1", mqtt.Properties{
+			UserProperties: map[string]string{"origin": "some-bridge"},
+		}))
+
+		require.Eventually(t, func() bool { return p.GetPublishQueue().Len() == 0 }, time.Second*5, time.Millisecond*10)
+
+		publishedMessage, ok := b.LastPublishedTo("test/a/get")
+		require.True(t, ok)
+		require.Equal(t, "some-bridge", publishedMessage.Properties.UserProperties["origin"])
+	})
+	t.Run("PublishRateLimitDrop", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		p.SetClient(c)
+
+		require.NoError(t, p.SetAvailabilityTopic("test/availability"))
+		require.NoError(t, p.EnableRateLimit(mqtt.RateLimitOptions{
+			ByPrefix: map[string]mqtt.RateLimit{"test/noisy": {Rate: 0.001, Burst: 2}},
+			Policy:   mqtt.RateLimitDrop,
+		}))
+		require.NoError(t, p.Connect())
+
+		for _, payload := range []string{"1", "2", "3"} {
+			err := p.Publish("test/noisy/get", mqtt.ExactlyOnce, false, payload)
+			if payload == "3" {
+				require.True(t, errors.Is(err, mqtt.ErrRateLimited))
+			} else {
+				require.NoError(t, err)
+			}
+		}
+
+		require.NoError(t, p.Publish("test/quiet/get", mqtt.ExactlyOnce, false, "1"))
+
+		b.RequirePublishedSequence(t, "test/noisy/get", "1", "2")
+		b.RequirePublished(t, "test/quiet/get", "1")
+		require.Equal(t, int64(1), p.GetRateLimiter().Dropped())
+
+		// the availability messages aren't rate limited
+		require.NoError(t, p.Disconnect())
+		b.RequireRetained(t, "test/availability", mqtt.AvailabilityOffline)
+	})
+	t.Run("MultipleCallbacksPerTopicAndOverlappingFilters", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		p.SetClient(c)
+
+		require.NoError(t, p.Connect())
+
+		mu := sync.Mutex{}
+		received := make(map[string][]string)
+		record := func(name string) func(message mqtt.Message) {
+			return func(message mqtt.Message) {
+				mu.Lock()
+				received[name] = append(received[name], message.Topic+"="+message.Payload)
+				mu.Unlock()
+			}
+		}
+		getReceived := func(name string) []string {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return received[name]
+		}
+
+		require.NoError(t, p.Subscribe("home/#", mqtt.AtMostOnce, record("all")))
+		require.NoError(t, p.Subscribe("home/inside/+/get", mqtt.AtMostOnce, record("get1")))
+		s, err := p.SubscribeWithHandle("home/inside/+/get", mqtt.AtLeastOnce, record("get2"))
+		require.NoError(t, err)
+		require.Equal(t, "home/inside/+/get", s.Topic())
+
+		b.Inject("home/inside/a/get", mqtt.AtMostOnce, false, "1")
+		b.Inject("home/inside/a/set", mqtt.AtMostOnce, false, "2")
+
+		require.Equal(t, []string{"home/inside/a/get=1", "home/inside/a/set=2"}, getReceived("all"))
+		require.Equal(t, []string{"home/inside/a/get=1"}, getReceived("get1"))
+		require.Equal(t, []string{"home/inside/a/get=1"}, getReceived("get2"))
+
+		// removing one callback leaves the other (and the provider subscription) in place
+		require.NoError(t, s.Unsubscribe())
+		require.NoError(t, s.Unsubscribe())
+		b.Inject("home/inside/b/get", mqtt.AtMostOnce, false, "3")
+		require.Equal(t, []string{"home/inside/a/get=1", "home/inside/b/get=3"}, getReceived("get1"))
+		require.Equal(t, []string{"home/inside/a/get=1"}, getReceived("get2"))
+
+		// every callback survives a reconnect
+		c.Drop(fmt.Errorf("injected connection loss"))
+		require.Eventually(t, func() bool { return c.ConnectCount() == 2 && c.IsConnected() }, time.Second*5, time.Millisecond*10)
+		time.Sleep(time.Millisecond * 100)
+
+		b.Inject("home/inside/c/get", mqtt.AtMostOnce, false, "4")
+		require.Eventually(t, func() bool { return len(getReceived("get1")) == 3 }, time.Second, time.Millisecond*10)
+		require.Equal(t, "home/inside/c/get=4", getReceived("all")[3])
+
+		// Unsubscribe removes every callback for the topic
+		require.NoError(t, p.Unsubscribe("home/inside/+/get"))
+		b.Inject("home/inside/d/get", mqtt.AtMostOnce, false, "5")
+		require.Len(t, getReceived("get1"), 3)
+		require.Len(t, getReceived("all"), 5)
+	})
+	t.Run("ConnectionEventsAndBackoff", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		p := mqtt.NewPersistentClient()
+		c := b.NewClient(p.HandleError)
+		p.SetClient(c)
+		p.SetBackoff(mqtt.BackoffOptions{Initial: time.Millisecond * 10, Max: time.Millisecond * 20, Multiplier: 2})
+
+		events, remove := p.Events(16)
+		defer remove()
+
+		getNextEvent := func() mqtt.ConnectionEvent {
+			select {
+			case event := <-events:
+				return event
+			case <-time.After(time.Second * 5):
+				require.FailNow(t, "timed out waiting for a connection event")
+			}
+
+			return mqtt.ConnectionEvent{}
+		}
+
+		require.Equal(t, mqtt.Disconnected, p.State())
+
+		require.NoError(t, p.Connect())
+		require.Equal(t, mqtt.Connecting, getNextEvent().State)
+		require.Equal(t, mqtt.Connected, getNextEvent().State)
+		require.Equal(t, mqtt.Connected, p.State())
+
+		dropErr := fmt.Errorf("injected connection loss")
+		connectErr := fmt.Errorf("injected connect failure")
+		c.FailConnects(connectErr)
+		c.Drop(dropErr)
+
+		event := getNextEvent()
+		require.Equal(t, mqtt.Reconnecting, event.State)
+		require.Equal(t, mqtt.Connected, event.Previous)
+		require.Equal(t, dropErr, event.Err)
+		require.Equal(t, 1, event.Attempt)
+
+		event = getNextEvent()
+		require.Equal(t, mqtt.Reconnecting, event.State)
+		require.Equal(t, connectErr, event.Err)
+		require.Equal(t, 2, event.Attempt)
+
+		event = getNextEvent()
+		require.Equal(t, mqtt.Connected, event.State)
+		require.NoError(t, event.Err)
+
+		require.NoError(t, p.Disconnect())
+		require.Equal(t, mqtt.Disconnected, getNextEvent().State)
+		require.Equal(t, mqtt.Disconnected, p.State())
+	})
+}
@@ -1,22 +1,36 @@
 package mqtt_client
 
 import (
+	"fmt"
 	"log"
-	"os"
 	"strings"
 )
 
 func GetPahoClient(host, username, password string, errorHandler func(Client, error)) (client Client) {
-	return NewPahoClient(host, username, password, errorHandler)
+	client, err := NewPahoClientWithOptions(host, username, password, GetConnectionOptionsFromEnv(), errorHandler)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return client
 }
 
 func GetGMQClient(host, username, password string, errorHandler func(Client, error)) (client Client) {
-	return NewGMQClient(host, username, password, errorHandler)
+	client, err := NewGMQClientWithOptions(host, username, password, GetConnectionOptionsFromEnv(), errorHandler)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return client
 }
 
 func GetLibMQTTClient(host, username, password string, errorHandler func(Client, error)) (client Client) {
+	client, err := NewLibMQTTClientWithOptions(host, username, password, GetConnectionOptionsFromEnv(), errorHandler)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	return NewLibMQTTClient(host, username, password, errorHandler)
+	return client
 }
 
 func GetGlueClient(host, username, password string, errorHandler func(Client, error)) (client Client) {
@@ -28,46 +42,49 @@ func GetGlueClient(host, username, password string, errorHandler func(Client, er
 	return client
 }
 
-func GetMQTTClient(host, username, password string) (client Client) {
-	useGMQ := false
-	usePaho := false
-	useLibMQTT := false
-	useGlue := false
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		if pair[0] == "MQTT_CLIENT_PROVIDER" {
-			if strings.ToLower(pair[1]) == "gmq" {
-				useGMQ = true
-			} else if strings.ToLower(pair[1]) == "paho" {
-				usePaho = true
-			} else if strings.ToLower(pair[1]) == "libmqtt" {
-				useLibMQTT = true
-			} else if strings.ToLower(pair[1]) == "glue" {
-				useGlue = true
-			}
-		}
-	}
+func GetMQTTClient(host, username, password string) *PersistentClient {
+	return GetMQTTClientWithOptions(host, username, password, GetConnectionOptionsFromEnv())
+}
 
-	p := NewPersistentClient()
-
-	if usePaho {
-		log.Printf("using Paho")
-		client = GetPahoClient(host, username, password, p.HandleError)
-	} else if useGMQ {
-		log.Printf("using GMQ")
-		client = GetGMQClient(host, username, password, p.HandleError)
-	} else if useLibMQTT {
-		log.Printf("using LibMQTT")
-		client = GetLibMQTTClient(host, username, password, p.HandleError)
-	} else if useGlue {
-		log.Printf("using Glue")
-		client = GetGlueClient(host, username, password, p.HandleError)
-	} else {
-		log.Printf("using Glue (because it's the default)")
-		client = GetGlueClient(host, username, password, p.HandleError)
+// GetMQTTClientWithOptions accepts a bare host or a broker URL (see ParseBrokerURL) for host; the provider (and anything
+// else in Config) can be overridden with the MQTT_* env vars (see Config.WithEnvOverrides)
+func GetMQTTClientWithOptions(host, username, password string, options ConnectionOptions) *PersistentClient {
+	config, err := Config{
+		URL:               host,
+		Username:          username,
+		Password:          password,
+		ConnectionOptions: options,
+	}.WithEnvOverrides()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	p.SetClient(client)
+	p, err := NewMQTTClient(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	return p
 }
+
+func getGlueClientForBrokerURL(host, username, password string, options ConnectionOptions, errorHandler func(Client, error)) (Client, error) {
+	if options.IsTLS() {
+		return nil, fmt.Errorf("Glue doesn't support TLS (set %v or a password to use a shared secret instead)", GlueSecretEnvVar)
+	}
+
+	// Glue is brokerless so a broker URL is ignored (see ParseGlueOptions), but asking for anything other than plain
+	// TCP is a misconfiguration
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(host)), SchemeGlue+"://") {
+		brokerURL, err := ParseBrokerURL(host, options)
+		if err != nil {
+			return nil, err
+		}
+
+		err = brokerURL.checkSupportedBy("Glue", SchemeTCP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewGlueClient(host, username, password, errorHandler)
+}
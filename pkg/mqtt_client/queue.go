@@ -0,0 +1,340 @@
+package mqtt_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota
+	DropNewest
+	Block
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+func ParseOverflowPolicy(rawPolicy string) (OverflowPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(rawPolicy)) {
+	case "drop-oldest", "drop_oldest", "":
+		return DropOldest, nil
+	case "drop-newest", "drop_newest":
+		return DropNewest, nil
+	case "block":
+		return Block, nil
+	}
+
+	return DropOldest, fmt.Errorf("%#+v not one of %#+v, %#+v or %#+v", rawPolicy, "drop-oldest", "drop-newest", "block")
+}
+
+const DefaultMaxPublishAttempts = 3
+
+type PublishQueueOptions struct {
+	MaxSize        int
+	OverflowPolicy OverflowPolicy
+	SpoolPath      string // optional; if set the queue is persisted here so it survives a restart
+	MaxAttempts    int    // a message that fails this many times while connected is dropped; 0 means DefaultMaxPublishAttempts
+}
+
+type QueuedMessage struct {
+	Queued   time.Time `json:"queued"`
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	Payload  []byte    `json:"payload"` // base64 in the spool, so binary payloads (e.g. msgpack) survive
+	Attempts int       `json:"attempts,omitempty"`
+
+	Properties *Properties `json:"properties,omitempty"` // only for PublishWithProperties
+}
+
+type PublishQueue struct {
+	mu       sync.Mutex
+	notFull  *sync.Cond
+	options  PublishQueueOptions
+	messages []QueuedMessage
+	dropped  int64
+	spooled  int // lines in the spool
+}
+
+func NewPublishQueue(options PublishQueueOptions) (*PublishQueue, error) {
+	if options.MaxSize <= 0 {
+		return nil, fmt.Errorf("publish queue max size must be greater than 0; got %v", options.MaxSize)
+	}
+
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = DefaultMaxPublishAttempts
+	}
+
+	q := &PublishQueue{
+		options:  options,
+		messages: make([]QueuedMessage, 0),
+	}
+
+	q.notFull = sync.NewCond(&q.mu)
+
+	if options.SpoolPath != "" {
+		err := q.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// spoolEntry is a line of the spool, which is a log of what's been done to the queue (rather than a copy of it) so that
+// draining a long queue doesn't rewrite the whole thing for every message
+type spoolEntry struct {
+	Push *QueuedMessage `json:"push,omitempty"`
+	Pop  bool           `json:"pop,omitempty"`
+	Fail bool           `json:"fail,omitempty"`
+}
+
+func (q *PublishQueue) load() error {
+	data, err := os.ReadFile(q.options.SpoolPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to read publish queue spool %#+v because: %v", q.options.SpoolPath, err)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	messages := make([]QueuedMessage, 0)
+
+	// spools written before the log were the whole queue as a JSON array
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &messages)
+		if err != nil {
+			return fmt.Errorf("failed to parse publish queue spool %#+v because: %v", q.options.SpoolPath, err)
+		}
+	} else {
+		lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		for i, line := range lines {
+			entry := spoolEntry{}
+			err = json.Unmarshal(line, &entry)
+			if err != nil {
+				// a crash mid-append can only tear the last line
+				if i == len(lines)-1 {
+					log.Printf("warning: ignoring torn last line of publish queue spool %v because: %v", q.options.SpoolPath, err)
+					break
+				}
+
+				return fmt.Errorf("failed to parse line %v of publish queue spool %#+v because: %v", i+1, q.options.SpoolPath, err)
+			}
+
+			switch {
+			case entry.Push != nil:
+				messages = append(messages, *entry.Push)
+			case entry.Pop && len(messages) > 0:
+				messages = messages[1:]
+			case entry.Fail && len(messages) > 0:
+				messages[0].Attempts++
+			}
+		}
+	}
+
+	// the max size may have shrunk since the spool was written
+	if len(messages) > q.options.MaxSize {
+		q.dropped += int64(len(messages) - q.options.MaxSize)
+		messages = messages[len(messages)-q.options.MaxSize:]
+	}
+
+	q.messages = messages
+
+	log.Printf("loaded %v queued messages from %v", len(q.messages), q.options.SpoolPath)
+
+	q.compact()
+
+	return nil
+}
+
+// compact must be called with the lock held; it replaces the spool with just what's queued (writing a temp file and
+// renaming it so a crash can't leave a torn spool)
+func (q *PublishQueue) compact() {
+	data := make([]byte, 0)
+	for i := range q.messages {
+		line, err := json.Marshal(spoolEntry{Push: &q.messages[i]})
+		if err != nil {
+			log.Printf("warning: failed to serialize publish queue because: %v", err)
+			return
+		}
+
+		data = append(append(data, line...), '\n')
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(q.options.SpoolPath), filepath.Base(q.options.SpoolPath)+".*.tmp")
+	if err != nil {
+		log.Printf("warning: failed to create temp file for publish queue spool because: %v", err)
+		return
+	}
+
+	_, err = tempFile.Write(data)
+	closeErr := tempFile.Close()
+	if err != nil || closeErr != nil {
+		_ = os.Remove(tempFile.Name())
+		log.Printf("warning: failed to write publish queue spool because: %v / %v", err, closeErr)
+		return
+	}
+
+	err = os.Rename(tempFile.Name(), q.options.SpoolPath)
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		log.Printf("warning: failed to replace publish queue spool because: %v", err)
+		return
+	}
+
+	q.spooled = len(q.messages)
+}
+
+// save must be called with the lock held; it appends entry to the spool, compacting it once it's either got nothing
+// worth keeping or has more than MaxSize lines that could go (so the cost of compacting is spread over them)
+func (q *PublishQueue) save(entry spoolEntry) {
+	if q.options.SpoolPath == "" {
+		return
+	}
+
+	if len(q.messages) == 0 || q.spooled-len(q.messages) >= q.options.MaxSize {
+		q.compact()
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("warning: failed to serialize publish queue because: %v", err)
+		return
+	}
+
+	spoolFile, err := os.OpenFile(q.options.SpoolPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		log.Printf("warning: failed to open publish queue spool because: %v", err)
+		return
+	}
+
+	_, err = spoolFile.Write(append(line, '\n'))
+	closeErr := spoolFile.Close()
+	if err != nil || closeErr != nil {
+		log.Printf("warning: failed to append to publish queue spool because: %v / %v", err, closeErr)
+		return
+	}
+
+	q.spooled++
+}
+
+func (q *PublishQueue) Push(message QueuedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.messages) >= q.options.MaxSize {
+		switch q.options.OverflowPolicy {
+		case DropNewest:
+			q.dropped++
+			log.Printf("warning: publish queue full; dropping %q to %v", message.Payload, message.Topic)
+			return
+		case Block:
+			q.notFull.Wait()
+		default:
+			dropped := q.messages[0]
+			q.messages = q.messages[1:]
+			q.dropped++
+			log.Printf("warning: publish queue full; dropping %q to %v", dropped.Payload, dropped.Topic)
+			q.save(spoolEntry{Pop: true})
+		}
+	}
+
+	q.messages = append(q.messages, message)
+
+	q.save(spoolEntry{Push: &message})
+}
+
+func (q *PublishQueue) Peek() (QueuedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return QueuedMessage{}, false
+	}
+
+	return q.messages[0], true
+}
+
+func (q *PublishQueue) Pop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return
+	}
+
+	q.messages = q.messages[1:]
+
+	q.save(spoolEntry{Pop: true})
+
+	q.notFull.Broadcast()
+}
+
+// Fail notes a failed attempt (that wasn't down to the connection) to publish the message at the head of the queue; once
+// it's failed MaxAttempts times it's dropped (so that it can't hold up everything behind it) and true is returned
+func (q *PublishQueue) Fail() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return false
+	}
+
+	q.messages[0].Attempts++
+
+	if q.messages[0].Attempts < q.options.MaxAttempts {
+		q.save(spoolEntry{Fail: true})
+		return false
+	}
+
+	dropped := q.messages[0]
+	q.messages = q.messages[1:]
+	q.dropped++
+	log.Printf("warning: giving up on %q to %v after %v attempts; dropping it", dropped.Payload, dropped.Topic, dropped.Attempts)
+
+	q.save(spoolEntry{Pop: true})
+
+	q.notFull.Broadcast()
+
+	return true
+}
+
+func (q *PublishQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.messages)
+}
+
+func (q *PublishQueue) Dropped() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dropped
+}
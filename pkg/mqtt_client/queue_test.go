@@ -0,0 +1,161 @@
+package mqtt_client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getPayloads(q *PublishQueue) []string {
+	payloads := make([]string, 0)
+	for {
+		message, ok := q.Peek()
+		if !ok {
+			break
+		}
+
+		payloads = append(payloads, string(message.Payload))
+		q.Pop()
+	}
+
+	return payloads
+}
+
+func TestPublishQueue(t *testing.T) {
+	t.Run("DropOldest", func(t *testing.T) {
+		q, err := NewPublishQueue(PublishQueueOptions{MaxSize: 2, OverflowPolicy: DropOldest})
+		require.NoError(t, err)
+
+		for _, payload := range []string{"1", "2", "3"} {
+			q.Push(QueuedMessage{Topic: "a", Payload: []byte(payload)})
+		}
+
+		require.Equal(t, int64(1), q.Dropped())
+		require.Equal(t, []string{"2", "3"}, getPayloads(q))
+	})
+
+	t.Run("DropNewest", func(t *testing.T) {
+		q, err := NewPublishQueue(PublishQueueOptions{MaxSize: 2, OverflowPolicy: DropNewest})
+		require.NoError(t, err)
+
+		for _, payload := range []string{"1", "2", "3"} {
+			q.Push(QueuedMessage{Topic: "a", Payload: []byte(payload)})
+		}
+
+		require.Equal(t, int64(1), q.Dropped())
+		require.Equal(t, []string{"1", "2"}, getPayloads(q))
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		q, err := NewPublishQueue(PublishQueueOptions{MaxSize: 1, OverflowPolicy: Block})
+		require.NoError(t, err)
+
+		q.Push(QueuedMessage{Topic: "a", Payload: []byte("1")})
+
+		pushed := make(chan struct{})
+		go func() {
+			q.Push(QueuedMessage{Topic: "a", Payload: []byte("2")})
+			close(pushed)
+		}()
+
+		select {
+		case <-pushed:
+			require.FailNow(t, "push should have blocked")
+		case <-time.After(time.Millisecond * 50):
+		}
+
+		q.Pop()
+		<-pushed
+
+		require.Equal(t, []string{"2"}, getPayloads(q))
+	})
+
+	t.Run("Spool", func(t *testing.T) {
+		spoolPath := filepath.Join(t.TempDir(), "spool.json")
+
+		q, err := NewPublishQueue(PublishQueueOptions{MaxSize: 10, SpoolPath: spoolPath})
+		require.NoError(t, err)
+
+		for _, payload := range []string{"1", "2", "3"} {
+			q.Push(QueuedMessage{Topic: "a", QoS: ExactlyOnce, Retained: true, Payload: []byte(payload)})
+		}
+		q.Pop()
+
+		q, err = NewPublishQueue(PublishQueueOptions{MaxSize: 1, SpoolPath: spoolPath})
+		require.NoError(t, err)
+
+		message, ok := q.Peek()
+		require.True(t, ok)
+		require.Equal(t, "a", message.Topic)
+		require.Equal(t, ExactlyOnce, message.QoS)
+		require.True(t, message.Retained)
+		require.Equal(t, []string{"3"}, getPayloads(q))
+
+		// not valid UTF-8, so it'd be mangled if it went into the spool as a string
+		binaryPayload := []byte{0x82, 0xa4, 0x6e, 0x61, 0x6d, 0x65, 0xff, 0xfe, 0x00}
+
+		q.Push(QueuedMessage{Topic: "a", Payload: binaryPayload})
+
+		q, err = NewPublishQueue(PublishQueueOptions{MaxSize: 1, SpoolPath: spoolPath})
+		require.NoError(t, err)
+
+		message, ok = q.Peek()
+		require.True(t, ok)
+		require.Equal(t, binaryPayload, message.Payload)
+	})
+
+	t.Run("SpoolLog", func(t *testing.T) {
+		spoolPath := filepath.Join(t.TempDir(), "spool.json")
+
+		getLines := func() int {
+			data, err := os.ReadFile(spoolPath)
+			require.NoError(t, err)
+
+			return len(strings.Split(strings.TrimSpace(string(data)), "\n"))
+		}
+
+		// what older versions wrote
+		require.NoError(t, os.WriteFile(spoolPath, []byte(`[{"topic":"a","payload":"MQ=="},{"topic":"a","payload":"Mg=="}]`), 0o644))
+
+		q, err := NewPublishQueue(PublishQueueOptions{MaxSize: 4, SpoolPath: spoolPath})
+		require.NoError(t, err)
+		require.Equal(t, 2, q.Len())
+		require.Equal(t, 2, getLines())
+
+		for _, payload := range []string{"3", "4", "5", "6", "7", "8"} {
+			q.Push(QueuedMessage{Topic: "a", Payload: []byte(payload)})
+			q.Pop()
+		}
+
+		// compacted every so often rather than growing for every push and pop
+		require.LessOrEqual(t, getLines(), 2+4+1)
+		require.Equal(t, 2, q.Len())
+
+		// a crash mid-append
+		spoolFile, err := os.OpenFile(spoolPath, os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = spoolFile.WriteString(`{"push":{"topic":"a","pay`)
+		require.NoError(t, err)
+		require.NoError(t, spoolFile.Close())
+
+		q, err = NewPublishQueue(PublishQueueOptions{MaxSize: 4, SpoolPath: spoolPath})
+		require.NoError(t, err)
+		require.Equal(t, []string{"7", "8"}, getPayloads(q))
+		require.Equal(t, 0, q.Len())
+	})
+
+	t.Run("ParseOverflowPolicy", func(t *testing.T) {
+		for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Block} {
+			parsedPolicy, err := ParseOverflowPolicy(policy.String())
+			require.NoError(t, err)
+			require.Equal(t, policy, parsedPolicy)
+		}
+
+		_, err := ParseOverflowPolicy("banana")
+		require.Error(t, err)
+	})
+}
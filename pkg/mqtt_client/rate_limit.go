@@ -0,0 +1,334 @@
+package mqtt_client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("publish rate limit exceeded")
+
+type RateLimitPolicy int
+
+const (
+	RateLimitBlock RateLimitPolicy = iota
+	RateLimitDrop
+)
+
+func (p RateLimitPolicy) String() string {
+	switch p {
+	case RateLimitBlock:
+		return "block"
+	case RateLimitDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+func ParseRateLimitPolicy(rawPolicy string) (RateLimitPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(rawPolicy)) {
+	case "block", "":
+		return RateLimitBlock, nil
+	case "drop":
+		return RateLimitDrop, nil
+	}
+
+	return RateLimitBlock, fmt.Errorf("%#+v not one of %#+v or %#+v", rawPolicy, "block", "drop")
+}
+
+// RateLimit is a token bucket; Rate is in messages per second (0 means unlimited) and Burst is how many can go out
+// back-to-back (0 means one second's worth)
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (r RateLimit) getBurst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+
+	return max(1, r.Rate)
+}
+
+// ParseRateLimit parses "rate" or "rate:burst" (e.g. "10" or "10:50")
+func ParseRateLimit(rawRateLimit string) (RateLimit, error) {
+	rawRate, rawBurst, hasBurst := strings.Cut(strings.TrimSpace(rawRateLimit), ":")
+
+	rate, err := strconv.ParseFloat(rawRate, 64)
+	if err != nil || rate < 0 {
+		return RateLimit{}, fmt.Errorf("failed to parse rate from %#+v as a non-negative number", rawRateLimit)
+	}
+
+	rateLimit := RateLimit{Rate: rate}
+
+	if hasBurst {
+		rateLimit.Burst, err = strconv.Atoi(rawBurst)
+		if err != nil || rateLimit.Burst < 0 {
+			return RateLimit{}, fmt.Errorf("failed to parse burst from %#+v as a non-negative integer", rawRateLimit)
+		}
+	}
+
+	return rateLimit, nil
+}
+
+type RateLimitOptions struct {
+	Global RateLimit
+
+	// ByPrefix applies on top of Global to topics under each prefix (e.g. "home/arp" covers "home/arp/..."); only the
+	// longest matching prefix applies
+	ByPrefix map[string]RateLimit
+
+	Policy RateLimitPolicy
+}
+
+func (o RateLimitOptions) IsEnabled() bool {
+	if o.Global.Rate > 0 {
+		return true
+	}
+
+	for _, rateLimit := range o.ByPrefix {
+		if rateLimit.Rate > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddRateLimitFlags adds -publishRateLimit, -publishRateLimitByPrefix and -publishRateLimitPolicy to flagSet; the
+// returned func gives the RateLimitOptions once flagSet has been parsed (see RateLimitOptions.IsEnabled)
+func AddRateLimitFlags(flagSet *flag.FlagSet) func() (RateLimitOptions, error) {
+	globalPtr := flagSet.String("publishRateLimit", "", "publishes per second across all topics, optionally with a burst (e.g. 20 or 20:100; optional)")
+	byPrefixPtr := flagSet.String("publishRateLimitByPrefix", "", "comma separated prefix=rate[:burst] publish rate limits (e.g. home/arp=1:10; optional)")
+	policyPtr := flagSet.String("publishRateLimitPolicy", "block", "what to do with a publish that's over the rate limit (block or drop)")
+
+	return func() (RateLimitOptions, error) {
+		options := RateLimitOptions{
+			ByPrefix: make(map[string]RateLimit),
+		}
+
+		var err error
+
+		if strings.TrimSpace(*globalPtr) != "" {
+			options.Global, err = ParseRateLimit(*globalPtr)
+			if err != nil {
+				return options, err
+			}
+		}
+
+		for _, rawPrefixRateLimit := range strings.Split(*byPrefixPtr, ",") {
+			if strings.TrimSpace(rawPrefixRateLimit) == "" {
+				continue
+			}
+
+			prefix, rawRateLimit, ok := strings.Cut(rawPrefixRateLimit, "=")
+			if !ok {
+				return options, fmt.Errorf("%#+v not in the form prefix=rate[:burst]", rawPrefixRateLimit)
+			}
+
+			options.ByPrefix[strings.Trim(strings.TrimSpace(prefix), "/")], err = ParseRateLimit(rawRateLimit)
+			if err != nil {
+				return options, err
+			}
+		}
+
+		options.Policy, err = ParseRateLimitPolicy(*policyPtr)
+		if err != nil {
+			return options, err
+		}
+
+		return options, nil
+	}
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rateLimit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rateLimit.Rate,
+		burst:  rateLimit.getBurst(),
+		tokens: rateLimit.getBurst(),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// take removes a token (going into debt if need be) and returns how long until that token would have been available
+func (b *tokenBucket) take() time.Duration {
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// RateLimiter paces publishes with a global token bucket and one per topic prefix; a publish has to get a token from
+// both the global bucket and the bucket for its (longest matching) prefix
+type RateLimiter struct {
+	mu             sync.Mutex
+	options        RateLimitOptions
+	global         *tokenBucket
+	prefixes       []string
+	bucketByPrefix map[string]*tokenBucket
+	dropped        int64
+	delayed        int64
+	delay          time.Duration
+	now            func() time.Time
+	sleep          func(time.Duration)
+}
+
+func NewRateLimiter(options RateLimitOptions) (*RateLimiter, error) {
+	if !options.IsEnabled() {
+		return nil, fmt.Errorf("rate limiter needs a global or per-prefix rate greater than 0; got %+v", options)
+	}
+
+	l := &RateLimiter{
+		options:        options,
+		prefixes:       make([]string, 0),
+		bucketByPrefix: make(map[string]*tokenBucket),
+		now:            time.Now,
+		sleep:          time.Sleep,
+	}
+
+	now := l.now()
+
+	if options.Global.Rate > 0 {
+		l.global = newTokenBucket(options.Global, now)
+	}
+
+	for prefix, rateLimit := range options.ByPrefix {
+		if rateLimit.Rate <= 0 {
+			continue
+		}
+
+		prefix = strings.Trim(prefix, "/")
+		if strings.ContainsAny(prefix, "+#") {
+			return nil, fmt.Errorf("rate limit prefix %#+v can't contain wildcards", prefix)
+		}
+
+		l.prefixes = append(l.prefixes, prefix)
+		l.bucketByPrefix[prefix] = newTokenBucket(rateLimit, now)
+	}
+
+	// longest first, so the first match is the most specific
+	sort.Slice(l.prefixes, func(i, j int) bool {
+		if len(l.prefixes[i]) != len(l.prefixes[j]) {
+			return len(l.prefixes[i]) > len(l.prefixes[j])
+		}
+
+		return l.prefixes[i] < l.prefixes[j]
+	})
+
+	return l, nil
+}
+
+func (l *RateLimiter) getBuckets(topic string) []*tokenBucket {
+	buckets := make([]*tokenBucket, 0, 2)
+
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+
+	for _, prefix := range l.prefixes {
+		if topic == prefix || strings.HasPrefix(topic, prefix+"/") {
+			buckets = append(buckets, l.bucketByPrefix[prefix])
+			break
+		}
+	}
+
+	return buckets
+}
+
+// reserve returns how long the caller has to wait before publishing to topic, or ErrRateLimited if the policy is to
+// drop
+func (l *RateLimiter) reserve(topic string) (time.Duration, error) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := l.getBuckets(topic)
+
+	for _, bucket := range buckets {
+		bucket.refill(now)
+	}
+
+	if l.options.Policy == RateLimitDrop {
+		for _, bucket := range buckets {
+			if bucket.tokens < 1 {
+				l.dropped++
+				return 0, ErrRateLimited
+			}
+		}
+	}
+
+	wait := time.Duration(0)
+	for _, bucket := range buckets {
+		wait = max(wait, bucket.take())
+	}
+
+	if wait > 0 {
+		l.delayed++
+		l.delay += wait
+	}
+
+	return wait, nil
+}
+
+// Wait blocks until topic is within its budget (or returns ErrRateLimited straight away if the policy is to drop)
+func (l *RateLimiter) Wait(topic string) error {
+	wait, err := l.reserve(topic)
+	if err != nil {
+		return err
+	}
+
+	if wait > 0 {
+		l.sleep(wait)
+	}
+
+	return nil
+}
+
+// Dropped is how many publishes have been refused
+func (l *RateLimiter) Dropped() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.dropped
+}
+
+// Delayed is how many publishes have had to wait
+func (l *RateLimiter) Delayed() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.delayed
+}
+
+// Delay is the total time publishes have spent waiting
+func (l *RateLimiter) Delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.delay
+}
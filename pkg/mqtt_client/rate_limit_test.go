@@ -0,0 +1,158 @@
+package mqtt_client
+
+import (
+	"errors"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRateLimiterClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func withFakeClock(l *RateLimiter) *fakeRateLimiterClock {
+	clock := &fakeRateLimiterClock{now: time.Now()}
+
+	l.now = func() time.Time {
+		return clock.now
+	}
+
+	l.sleep = func(duration time.Duration) {
+		clock.sleeps = append(clock.sleeps, duration)
+		clock.now = clock.now.Add(duration)
+	}
+
+	return clock
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("Block", func(t *testing.T) {
+		l, err := NewRateLimiter(RateLimitOptions{Global: RateLimit{Rate: 10, Burst: 2}})
+		require.NoError(t, err)
+		clock := withFakeClock(l)
+
+		for i := 0; i < 4; i++ {
+			require.NoError(t, l.Wait("home/a"))
+		}
+
+		require.Equal(t, []time.Duration{time.Millisecond * 100, time.Millisecond * 100}, clock.sleeps)
+		require.Equal(t, int64(2), l.Delayed())
+		require.Equal(t, time.Millisecond*200, l.Delay())
+		require.Equal(t, int64(0), l.Dropped())
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		l, err := NewRateLimiter(RateLimitOptions{Global: RateLimit{Rate: 1, Burst: 2}, Policy: RateLimitDrop})
+		require.NoError(t, err)
+		clock := withFakeClock(l)
+
+		require.NoError(t, l.Wait("home/a"))
+		require.NoError(t, l.Wait("home/a"))
+		require.True(t, errors.Is(l.Wait("home/a"), ErrRateLimited))
+
+		clock.now = clock.now.Add(time.Second)
+		require.NoError(t, l.Wait("home/a"))
+		require.True(t, errors.Is(l.Wait("home/a"), ErrRateLimited))
+
+		require.Empty(t, clock.sleeps)
+		require.Equal(t, int64(2), l.Dropped())
+	})
+
+	t.Run("ByPrefix", func(t *testing.T) {
+		l, err := NewRateLimiter(RateLimitOptions{
+			ByPrefix: map[string]RateLimit{
+				"home/arp":        {Rate: 1, Burst: 1},
+				"home/arp/noisy/": {Rate: 1, Burst: 3},
+			},
+			Policy: RateLimitDrop,
+		})
+		require.NoError(t, err)
+		withFakeClock(l)
+
+		require.NoError(t, l.Wait("home/arp/192.168.1.1/get"))
+		require.True(t, errors.Is(l.Wait("home/arp/192.168.1.2/get"), ErrRateLimited))
+
+		// the longest prefix wins
+		for i := 0; i < 3; i++ {
+			require.NoError(t, l.Wait("home/arp/noisy/get"))
+		}
+		require.True(t, errors.Is(l.Wait("home/arp/noisy/get"), ErrRateLimited))
+
+		// prefixes are whole levels and anything without a budget isn't limited
+		for i := 0; i < 10; i++ {
+			require.NoError(t, l.Wait("home/arpeggio/get"))
+		}
+
+		require.Equal(t, int64(2), l.Dropped())
+	})
+
+	t.Run("GlobalAndPrefix", func(t *testing.T) {
+		l, err := NewRateLimiter(RateLimitOptions{
+			Global:   RateLimit{Rate: 2},
+			ByPrefix: map[string]RateLimit{"home/arp": {Rate: 1}},
+		})
+		require.NoError(t, err)
+		clock := withFakeClock(l)
+
+		// the second one is held back by the prefix budget
+		require.NoError(t, l.Wait("home/arp/a/get"))
+		require.NoError(t, l.Wait("home/arp/a/get"))
+
+		// the third one is held back by the global budget
+		for i := 0; i < 3; i++ {
+			require.NoError(t, l.Wait("home/other/get"))
+		}
+
+		require.Equal(t, []time.Duration{time.Second, time.Millisecond * 500}, clock.sleeps)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		_, err := NewRateLimiter(RateLimitOptions{ByPrefix: map[string]RateLimit{"home": {}}})
+		require.Error(t, err)
+
+		_, err = NewRateLimiter(RateLimitOptions{ByPrefix: map[string]RateLimit{"home/+": {Rate: 1}}})
+		require.Error(t, err)
+	})
+
+	t.Run("Flags", func(t *testing.T) {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		getRateLimitOptions := AddRateLimitFlags(flagSet)
+
+		require.NoError(t, flagSet.Parse([]string{
+			"-publishRateLimit", "20:100",
+			"-publishRateLimitByPrefix", "home/arp/=1:10, home/outside/weather=0.5",
+			"-publishRateLimitPolicy", "drop",
+		}))
+
+		options, err := getRateLimitOptions()
+		require.NoError(t, err)
+		require.True(t, options.IsEnabled())
+		require.Equal(t, RateLimitOptions{
+			Global: RateLimit{Rate: 20, Burst: 100},
+			ByPrefix: map[string]RateLimit{
+				"home/arp":             {Rate: 1, Burst: 10},
+				"home/outside/weather": {Rate: 0.5},
+			},
+			Policy: RateLimitDrop,
+		}, options)
+
+		flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+		getRateLimitOptions = AddRateLimitFlags(flagSet)
+		require.NoError(t, flagSet.Parse([]string{}))
+
+		options, err = getRateLimitOptions()
+		require.NoError(t, err)
+		require.False(t, options.IsEnabled())
+
+		flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+		getRateLimitOptions = AddRateLimitFlags(flagSet)
+		require.NoError(t, flagSet.Parse([]string{"-publishRateLimitByPrefix", "home/arp"}))
+
+		_, err = getRateLimitOptions()
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,79 @@
+package mqtt_client
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type ProviderFactory func(config Config, errorHandler func(Client, error)) (Client, error)
+
+var (
+	providerByNameMu sync.Mutex
+	providerByName   = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider is intended to be called from init(); like database/sql, registering a name twice panics
+func RegisterProvider(name string, factory ProviderFactory) {
+	providerByNameMu.Lock()
+	defer providerByNameMu.Unlock()
+
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if factory == nil {
+		panic(fmt.Sprintf("nil factory for provider %#+v", name))
+	}
+
+	if _, ok := providerByName[name]; ok {
+		panic(fmt.Sprintf("provider %#+v registered twice", name))
+	}
+
+	providerByName[name] = factory
+}
+
+func GetProviderNames() []string {
+	providerByNameMu.Lock()
+	defer providerByNameMu.Unlock()
+
+	names := make([]string, 0, len(providerByName))
+	for name := range providerByName {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// NewClient builds a bare (i.e. not persistent) client for config.Provider
+func NewClient(config Config, errorHandler func(Client, error)) (Client, error) {
+	provider := config.getProvider()
+
+	providerByNameMu.Lock()
+	factory, ok := providerByName[provider]
+	providerByNameMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %#+v; known providers are %v", config.Provider, strings.Join(GetProviderNames(), ", "))
+	}
+
+	return factory(config, errorHandler)
+}
+
+// NewMQTTClient is GetMQTTClient for a Config (and without the env overrides or the log.Fatal)
+func NewMQTTClient(config Config) (*PersistentClient, error) {
+	p := NewPersistentClient()
+
+	log.Printf("using %v", config.getProvider())
+
+	client, err := NewClient(config, p.HandleError)
+	if err != nil {
+		return nil, err
+	}
+
+	p.SetClient(client)
+
+	return p, nil
+}
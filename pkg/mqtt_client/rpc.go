@@ -0,0 +1,347 @@
+package mqtt_client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultRPCResponseTopicPrefix = "rpc/responses"
+	rpcErrorUserProperty          = "error"
+)
+
+// rpcEnvelope carries what MQTT 5 would put in properties for providers that only speak MQTT 3.1.1
+type rpcEnvelope struct {
+	CorrelationID string `json:"correlation_id"`
+	ResponseTopic string `json:"response_topic,omitempty"`
+	Error         string `json:"error,omitempty"`
+	Payload       []byte `json:"payload"`
+}
+
+type rpcMessage struct {
+	message       Message
+	correlationID string
+	responseTopic string
+	error         string
+	viaProperties bool // i.e. not an envelope
+}
+
+type RPCRemoteError struct {
+	Topic   string
+	Message string
+}
+
+func (e *RPCRemoteError) Error() string {
+	return fmt.Sprintf("rpc to %v failed remotely: %v", e.Topic, e.Message)
+}
+
+func getPropertiesClient(client Client) (PropertiesClient, bool) {
+	propertiesClient, ok := client.(PropertiesClient)
+	if !ok || !propertiesClient.SupportsProperties() {
+		return nil, false
+	}
+
+	return propertiesClient, true
+}
+
+// publishRPC only uses properties if asked to (i.e. the other end is known to speak MQTT 5) and client can; otherwise
+// it falls back to an envelope, which anything can read
+func publishRPC(client Client, topic string, payload interface{}, correlationID, responseTopic, errorMessage string, useProperties bool) error {
+	propertiesClient, ok := getPropertiesClient(client)
+	if useProperties && ok {
+		properties := Properties{
+			ResponseTopic:   responseTopic,
+			CorrelationData: []byte(correlationID),
+		}
+
+		if errorMessage != "" {
+			properties.UserProperties = map[string]string{rpcErrorUserProperty: errorMessage}
+		}
+
+		return propertiesClient.PublishWithProperties(topic, AtLeastOnce, false, payload, properties)
+	}
+
+	envelope, err := json.Marshal(rpcEnvelope{
+		CorrelationID: correlationID,
+		ResponseTopic: responseTopic,
+		Error:         errorMessage,
+		Payload:       getPayloadBytes(payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	return client.Publish(topic, AtLeastOnce, false, envelope)
+}
+
+// parseRPC unwraps either flavour of request / response; the returned message has the inner payload
+func parseRPC(message Message) (rpcMessage, error) {
+	if message.Properties != nil && len(message.Properties.CorrelationData) > 0 {
+		return rpcMessage{
+			message:       message,
+			correlationID: string(message.Properties.CorrelationData),
+			responseTopic: message.Properties.ResponseTopic,
+			error:         message.Properties.UserProperties[rpcErrorUserProperty],
+			viaProperties: true,
+		}, nil
+	}
+
+	data := message.RawPayload
+	if data == nil {
+		data = []byte(message.Payload)
+	}
+
+	envelope := rpcEnvelope{}
+	err := json.Unmarshal(data, &envelope)
+	if err != nil {
+		return rpcMessage{}, fmt.Errorf("failed to parse rpc envelope %#+v from %v because: %v", message.Payload, message.Topic, err)
+	}
+
+	if envelope.CorrelationID == "" {
+		return rpcMessage{}, fmt.Errorf("rpc envelope %#+v from %v has no correlation id", message.Payload, message.Topic)
+	}
+
+	message.Payload = string(envelope.Payload)
+	message.RawPayload = envelope.Payload
+
+	return rpcMessage{
+		message:       message,
+		correlationID: envelope.CorrelationID,
+		responseTopic: envelope.ResponseTopic,
+		error:         envelope.Error,
+	}, nil
+}
+
+type rpcResponse struct {
+	message Message
+	err     error
+}
+
+type RPCClient struct {
+	client                  Client
+	responseTopic           string
+	mu                      sync.Mutex
+	responseByCorrelationID map[string]chan rpcResponse
+	useProperties           bool
+}
+
+// NewRPCClient subscribes to a response topic (unique to this RPCClient) under responseTopicPrefix (or
+// DefaultRPCResponseTopicPrefix if empty)
+func NewRPCClient(client Client, responseTopicPrefix string) (*RPCClient, error) {
+	if responseTopicPrefix == "" {
+		responseTopicPrefix = DefaultRPCResponseTopicPrefix
+	}
+
+	c := &RPCClient{
+		client:                  client,
+		responseTopic:           fmt.Sprintf("%v/%v", responseTopicPrefix, getClientID("rpc")),
+		responseByCorrelationID: make(map[string]chan rpcResponse),
+	}
+
+	err := client.Subscribe(c.responseTopic, AtLeastOnce, c.handleResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *RPCClient) ResponseTopic() string {
+	return c.responseTopic
+}
+
+// SetUseProperties makes requests carry MQTT 5 properties rather than an envelope; only do this if every server it'll
+// call can receive them (an MQTT 3.1.1 server would just see the bare payload), as the default envelope works for both
+func (c *RPCClient) SetUseProperties(useProperties bool) error {
+	if _, ok := getPropertiesClient(c.client); useProperties && !ok {
+		return fmt.Errorf("%T doesn't support properties", c.client)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.useProperties = useProperties
+
+	return nil
+}
+
+func (c *RPCClient) handleResponse(message Message) {
+	response, err := parseRPC(message)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	responses, ok := c.responseByCorrelationID[response.correlationID]
+	c.mu.Unlock()
+
+	if !ok {
+		log.Printf("warning: ignoring rpc response for unknown (or timed out) correlation id %v", response.correlationID)
+		return
+	}
+
+	var remoteErr error
+	if response.error != "" {
+		remoteErr = &RPCRemoteError{Topic: message.Topic, Message: response.error}
+	}
+
+	select {
+	case responses <- rpcResponse{message: response.message, err: remoteErr}:
+	default:
+	}
+}
+
+// Call publishes payload to topic and waits for the response (or for ctx to be done); a handler error on the other
+// end comes back as an *RPCRemoteError
+func (c *RPCClient) Call(ctx context.Context, topic string, payload interface{}) (Message, error) {
+	correlationID := uuid.NewString()
+	responses := make(chan rpcResponse, 1)
+
+	c.mu.Lock()
+	c.responseByCorrelationID[correlationID] = responses
+	useProperties := c.useProperties
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.responseByCorrelationID, correlationID)
+		c.mu.Unlock()
+	}()
+
+	err := publishRPC(c.client, topic, payload, correlationID, c.responseTopic, "", useProperties)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to publish rpc request to %v because: %v", topic, err)
+	}
+
+	select {
+	case response := <-responses:
+		return response.message, response.err
+	case <-ctx.Done():
+		return Message{}, fmt.Errorf("rpc to %v gave no response because: %w", topic, ctx.Err())
+	}
+}
+
+func (c *RPCClient) CallWithTimeout(topic string, payload interface{}, timeout time.Duration) (Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return c.Call(ctx, topic, payload)
+}
+
+func (c *RPCClient) Close() error {
+	return c.client.Unsubscribe(c.responseTopic)
+}
+
+// RPCHandler gets the request with the payload unwrapped; whatever it returns is sent back as the response payload
+type RPCHandler func(ctx context.Context, request Message) (interface{}, error)
+
+type RPCServer struct {
+	client         Client
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mu             sync.Mutex
+	handlerByTopic map[string]RPCHandler
+}
+
+func NewRPCServer(client Client) *RPCServer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &RPCServer{
+		client:         client,
+		ctx:            ctx,
+		cancel:         cancel,
+		handlerByTopic: make(map[string]RPCHandler),
+	}
+}
+
+// Handle subscribes to topic (which may be a filter); each request is handled in its own goroutine
+func (s *RPCServer) Handle(topic string, handler RPCHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.handlerByTopic[topic]; ok {
+		return fmt.Errorf("rpc handler for %v already registered", topic)
+	}
+
+	err := s.client.Subscribe(topic, AtLeastOnce, func(message Message) {
+		s.handleRequest(handler, message)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.handlerByTopic[topic] = handler
+
+	return nil
+}
+
+func (s *RPCServer) Remove(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.handlerByTopic[topic]; !ok {
+		return nil
+	}
+
+	delete(s.handlerByTopic, topic)
+
+	return s.client.Unsubscribe(topic)
+}
+
+func (s *RPCServer) handleRequest(handler RPCHandler, message Message) {
+	request, err := parseRPC(message)
+	if err != nil {
+		log.Printf("warning: %v", err)
+		return
+	}
+
+	if request.responseTopic == "" {
+		log.Printf("warning: ignoring rpc request on %v with no response topic", message.Topic)
+		return
+	}
+
+	go func() {
+		result, err := handler(s.ctx, request.message)
+
+		errorMessage := ""
+		var payload interface{} = ""
+		if err != nil {
+			errorMessage = err.Error()
+		} else if result != nil {
+			payload = result
+		}
+
+		// reply in kind, as that's what the caller is known to be able to read
+		err = publishRPC(s.client, request.responseTopic, payload, request.correlationID, "", errorMessage, request.viaProperties)
+		if err != nil {
+			log.Printf("warning: failed to publish rpc response for %v to %v because: %v", message.Topic, request.responseTopic, err)
+		}
+	}()
+}
+
+// Close unsubscribes every handler and cancels the context handed to any that are still running
+func (s *RPCServer) Close() error {
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lastErr error
+	for topic := range s.handlerByTopic {
+		err := s.client.Unsubscribe(topic)
+		if err != nil {
+			lastErr = err
+		}
+
+		delete(s.handlerByTopic, topic)
+	}
+
+	return lastErr
+}
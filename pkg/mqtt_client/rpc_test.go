@@ -0,0 +1,156 @@
+package mqtt_client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+func TestRPC(t *testing.T) {
+	upper := func(ctx context.Context, request mqtt.Message) (interface{}, error) {
+		if request.Payload == "" {
+			return nil, fmt.Errorf("empty request")
+		}
+
+		return strings.ToUpper(request.Payload), nil
+	}
+
+	t.Run("Envelope", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		serverClient := b.NewClient(nil)
+		require.NoError(t, serverClient.Connect())
+		server := mqtt.NewRPCServer(serverClient)
+		require.NoError(t, server.Handle("test/rpc/upper", upper))
+		require.Error(t, server.Handle("test/rpc/upper", upper))
+
+		clientClient := b.NewClient(nil)
+		require.NoError(t, clientClient.Connect())
+		client, err := mqtt.NewRPCClient(clientClient, "")
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(client.ResponseTopic(), mqtt.DefaultRPCResponseTopicPrefix+"/"))
+
+		response, err := client.CallWithTimeout("test/rpc/upper", "hello", time.Second)
+		require.NoError(t, err)
+		require.Equal(t, "HELLO", response.Payload)
+		require.Equal(t, []byte("HELLO"), response.RawPayload)
+
+		// the request went out as an envelope because neither end speaks MQTT 5
+		published, ok := b.LastPublishedTo("test/rpc/upper")
+		require.True(t, ok)
+		require.Nil(t, published.Properties)
+		require.Contains(t, published.Payload, `"correlation_id"`)
+
+		_, err = client.CallWithTimeout("test/rpc/upper", "", time.Second)
+		remoteErr := &mqtt.RPCRemoteError{}
+		require.True(t, errors.As(err, &remoteErr))
+		require.Equal(t, "empty request", remoteErr.Message)
+
+		require.NoError(t, server.Close())
+		require.NoError(t, client.Close())
+	})
+
+	t.Run("Properties", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		serverClient := b.NewClient(nil)
+		serverClient.EnableProperties()
+		require.NoError(t, serverClient.Connect())
+		server := mqtt.NewRPCServer(serverClient)
+		require.NoError(t, server.Handle("test/rpc/+", upper))
+
+		p := mqtt.NewPersistentClient()
+		clientClient := b.NewClient(p.HandleError)
+		clientClient.EnableProperties()
+		p.SetClient(clientClient)
+		require.NoError(t, p.Connect())
+		require.True(t, p.SupportsProperties())
+
+		client, err := mqtt.NewRPCClient(p, "test/responses")
+		require.NoError(t, err)
+		require.NoError(t, client.SetUseProperties(true))
+
+		response, err := client.CallWithTimeout("test/rpc/upper", "hello", time.Second)
+		require.NoError(t, err)
+		require.Equal(t, "HELLO", response.Payload)
+
+		published, ok := b.LastPublishedTo("test/rpc/upper")
+		require.True(t, ok)
+		require.Equal(t, "hello", published.Payload)
+		require.NotNil(t, published.Properties)
+		require.Equal(t, client.ResponseTopic(), published.Properties.ResponseTopic)
+		require.NotEmpty(t, published.Properties.CorrelationData)
+
+		published, ok = b.LastPublishedTo(client.ResponseTopic())
+		require.True(t, ok)
+		require.Equal(t, "HELLO", published.Payload)
+
+		require.NoError(t, server.Close())
+	})
+
+	t.Run("MixedVersions", func(t *testing.T) {
+		for _, tc := range []struct {
+			name             string
+			serverProperties bool
+			clientProperties bool
+		}{
+			{"V5CallerV3Server", false, true},
+			{"V3CallerV5Server", true, false},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				b := mqtttest.NewBroker()
+
+				serverClient := b.NewClient(nil)
+				if tc.serverProperties {
+					serverClient.EnableProperties()
+				}
+				require.NoError(t, serverClient.Connect())
+				server := mqtt.NewRPCServer(serverClient)
+				require.NoError(t, server.Handle("test/rpc/upper", upper))
+
+				clientClient := b.NewClient(nil)
+				if tc.clientProperties {
+					clientClient.EnableProperties()
+				}
+				require.NoError(t, clientClient.Connect())
+				client, err := mqtt.NewRPCClient(clientClient, "")
+				require.NoError(t, err)
+				require.Equal(t, tc.clientProperties, client.SetUseProperties(true) == nil)
+				require.NoError(t, client.SetUseProperties(false))
+
+				response, err := client.CallWithTimeout("test/rpc/upper", "hello", time.Second)
+				require.NoError(t, err)
+				require.Equal(t, "HELLO", response.Payload)
+
+				// the reply is in the same flavour as the request
+				published, ok := b.LastPublishedTo(client.ResponseTopic())
+				require.True(t, ok)
+				require.Nil(t, published.Properties)
+				require.Contains(t, published.Payload, `"correlation_id"`)
+			})
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+		client, err := mqtt.NewRPCClient(c, "")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+
+		_, err = client.Call(ctx, "test/rpc/nobody", "hello")
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+}
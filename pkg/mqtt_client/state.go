@@ -0,0 +1,80 @@
+package mqtt_client
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connecting
+	Connected
+	Reconnecting
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+type ConnectionEvent struct {
+	Time     time.Time
+	State    ConnectionState
+	Previous ConnectionState
+	Err      error // whatever caused the change (if anything)
+	Attempt  int   // reconnect attempt number (starting at 1) for Reconnecting events
+}
+
+type BackoffOptions struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64 // fraction of the delay to randomise by in either direction (e.g. 0.2 for +/- 20%)
+}
+
+var DefaultBackoffOptions = BackoffOptions{
+	Initial:    time.Second,
+	Max:        time.Second * 30,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// getDelay returns the delay before the given reconnect attempt (starting at 1)
+func (o BackoffOptions) getDelay(attempt int) time.Duration {
+	if o.Initial <= 0 {
+		o.Initial = DefaultBackoffOptions.Initial
+	}
+
+	if o.Max < o.Initial {
+		o.Max = o.Initial
+	}
+
+	if o.Multiplier < 1 {
+		o.Multiplier = 1
+	}
+
+	delay := math.Min(
+		float64(o.Initial)*math.Pow(o.Multiplier, float64(max(attempt-1, 0))),
+		float64(o.Max),
+	)
+
+	if o.Jitter > 0 {
+		delay += delay * o.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(math.Min(delay, float64(o.Max)))
+}
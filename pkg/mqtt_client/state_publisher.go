@@ -0,0 +1,269 @@
+package mqtt_client
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Publisher is the publishing half of Client
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error
+}
+
+// PublishFunc lets a bare func (e.g. someClient.Publish) be used as a Publisher
+type PublishFunc func(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error
+
+func (f PublishFunc) Publish(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error {
+	return f(topic, qos, retained, payload, quiet...)
+}
+
+type StatePublisherOptions struct {
+	QoS      byte
+	Retained bool
+
+	// RefreshInterval republishes values that haven't changed this often (0 means never)
+	RefreshInterval time.Duration
+
+	// Deadband treats numeric payloads within this of the last published value as unchanged
+	Deadband float64
+
+	// MinInterval holds back changes to a topic until this long after it was last published (only the latest value
+	// goes out); needs Start
+	MinInterval time.Duration
+
+	// StaleAfter forgets values that haven't been Set for this long; if StalePayload is set it's published in their
+	// place, otherwise retained values are cleared (0 means never)
+	StaleAfter   time.Duration
+	StalePayload interface{}
+}
+
+type statePublisherEntry struct {
+	published   *Message
+	publishedAt time.Time
+	pending     *Message
+	setAt       time.Time
+}
+
+// StatePublisher is for daemons that poll some device and publish its state; it only publishes a topic when the value
+// has changed (see Message.MostlyEqual and StatePublisherOptions.Deadband), subject to the other options
+type StatePublisher struct {
+	mu           sync.Mutex
+	publisher    Publisher
+	options      StatePublisherOptions
+	entryByTopic map[string]*statePublisherEntry
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+func NewStatePublisher(publisher Publisher, options StatePublisherOptions) *StatePublisher {
+	return &StatePublisher{
+		publisher:    publisher,
+		options:      options,
+		entryByTopic: make(map[string]*statePublisherEntry),
+	}
+}
+
+func (p *StatePublisher) withinDeadband(a string, b string) bool {
+	if p.options.Deadband <= 0 {
+		return false
+	}
+
+	aValue, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+
+	bValue, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return false
+	}
+
+	return math.Abs(aValue-bValue) < p.options.Deadband
+}
+
+func (p *StatePublisher) unchanged(entry *statePublisherEntry, message *Message) bool {
+	if entry.published == nil {
+		return false
+	}
+
+	return entry.published.MostlyEqual(message) || p.withinDeadband(entry.published.Payload, message.Payload)
+}
+
+// publish must be called with the lock held
+func (p *StatePublisher) publish(entry *statePublisherEntry, message *Message, now time.Time) error {
+	err := p.publisher.Publish(message.Topic, p.options.QoS, p.options.Retained, message.Payload, true)
+	if err != nil {
+		return fmt.Errorf("failed to publish %#+v to %v because: %v", message.Payload, message.Topic, err)
+	}
+
+	entry.published = message
+	entry.publishedAt = now
+	entry.pending = nil
+
+	return nil
+}
+
+// Set publishes payload to topic if it's different to what was last published there (or if the refresh is due)
+func (p *StatePublisher) Set(topic string, payload interface{}) error {
+	now := time.Now()
+
+	message := &Message{
+		Topic:   topic,
+		Payload: string(getPayloadBytes(payload)),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entryByTopic[topic]
+	if !ok {
+		entry = &statePublisherEntry{}
+		p.entryByTopic[topic] = entry
+	}
+
+	entry.setAt = now
+
+	if p.unchanged(entry, message) {
+		entry.pending = nil
+
+		if p.options.RefreshInterval <= 0 || now.Sub(entry.publishedAt) < p.options.RefreshInterval {
+			return nil
+		}
+
+		return p.publish(entry, entry.published, now)
+	}
+
+	if entry.published != nil && now.Sub(entry.publishedAt) < p.options.MinInterval {
+		entry.pending = message
+		return nil
+	}
+
+	return p.publish(entry, message, now)
+}
+
+// Forget drops what we know about topic, so the next Set for it will publish regardless
+func (p *StatePublisher) Forget(topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.entryByTopic, topic)
+}
+
+// Refresh republishes the latest value for every topic
+func (p *StatePublisher) Refresh() error {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, entry := range p.entryByTopic {
+		message := entry.pending
+		if message == nil {
+			message = entry.published
+		}
+
+		if message == nil {
+			continue
+		}
+
+		err := p.publish(entry, message, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tick publishes held back values that are now due, refreshes values that are due and expires stale ones
+func (p *StatePublisher) tick(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for topic, entry := range p.entryByTopic {
+		var err error
+
+		switch {
+		case p.options.StaleAfter > 0 && now.Sub(entry.setAt) >= p.options.StaleAfter:
+			delete(p.entryByTopic, topic)
+
+			if p.options.StalePayload != nil {
+				log.Printf("%v not set for %v; publishing %#+v", topic, now.Sub(entry.setAt), p.options.StalePayload)
+				err = p.publisher.Publish(topic, p.options.QoS, p.options.Retained, p.options.StalePayload, true)
+			} else if p.options.Retained && entry.published != nil {
+				log.Printf("%v not set for %v; clearing retained value", topic, now.Sub(entry.setAt))
+				err = p.publisher.Publish(topic, p.options.QoS, true, "", true)
+			}
+		case entry.pending != nil && now.Sub(entry.publishedAt) >= p.options.MinInterval:
+			err = p.publish(entry, entry.pending, now)
+		case entry.published != nil && p.options.RefreshInterval > 0 && now.Sub(entry.publishedAt) >= p.options.RefreshInterval:
+			err = p.publish(entry, entry.published, now)
+		}
+
+		if err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+}
+
+func (p *StatePublisher) getTickInterval() time.Duration {
+	interval := time.Second
+
+	for _, possibleInterval := range []time.Duration{p.options.RefreshInterval, p.options.MinInterval, p.options.StaleAfter} {
+		if possibleInterval > 0 {
+			interval = min(interval, possibleInterval/4)
+		}
+	}
+
+	return max(interval, time.Millisecond*10)
+}
+
+func (p *StatePublisher) run(stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(p.getTickInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			p.tick(now)
+		}
+	}
+}
+
+// Start runs the refreshes, held back publishes and expiry in the background; without it, refreshes only happen
+// when Set is called
+func (p *StatePublisher) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+
+	go p.run(p.stop, p.stopped)
+}
+
+func (p *StatePublisher) Stop() {
+	p.mu.Lock()
+	stop, stopped := p.stop, p.stopped
+	p.stop, p.stopped = nil, nil
+	p.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-stopped
+}
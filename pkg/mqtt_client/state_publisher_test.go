@@ -0,0 +1,102 @@
+package mqtt_client_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+func TestStatePublisher(t *testing.T) {
+	setup := func(t *testing.T, options mqtt.StatePublisherOptions) (*mqtttest.Broker, *mqtttest.Client, *mqtt.StatePublisher) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		p := mqtt.NewStatePublisher(c, options)
+		t.Cleanup(p.Stop)
+
+		return b, c, p
+	}
+
+	t.Run("PublishesOnChange", func(t *testing.T) {
+		b, c, p := setup(t, mqtt.StatePublisherOptions{QoS: mqtt.ExactlyOnce, Retained: true})
+
+		for _, payload := range []interface{}{"1", "1", 1, "0", "0", "1"} {
+			require.NoError(t, p.Set("test/switch/state/get", payload))
+		}
+
+		b.RequirePublishedSequence(t, "test/switch/state/get", "1", "0", "1")
+		b.RequireRetained(t, "test/switch/state/get", "1")
+
+		// a failed publish isn't remembered, so the same value goes out again next time
+		c.SetPublishError(fmt.Errorf("injected publish failure"))
+		require.Error(t, p.Set("test/switch/state/get", "0"))
+		c.SetPublishError(nil)
+		require.NoError(t, p.Set("test/switch/state/get", "0"))
+		b.RequirePublishedSequence(t, "test/switch/state/get", "1", "0", "1", "0")
+
+		p.Forget("test/switch/state/get")
+		require.NoError(t, p.Set("test/switch/state/get", "0"))
+		b.RequirePublishedSequence(t, "test/switch/state/get", "1", "0", "1", "0", "0")
+
+		require.NoError(t, p.Refresh())
+		b.RequirePublishedSequence(t, "test/switch/state/get", "1", "0", "1", "0", "0", "0")
+	})
+
+	t.Run("Deadband", func(t *testing.T) {
+		b, _, p := setup(t, mqtt.StatePublisherOptions{Deadband: 0.5})
+
+		for _, payload := range []interface{}{20.0, 20.3, 20.4, 20.6, "banana", "banana", 20.6} {
+			require.NoError(t, p.Set("test/sensor/temperature/get", payload))
+		}
+
+		b.RequirePublishedSequence(t, "test/sensor/temperature/get", "20", "20.6", "banana", "20.6")
+	})
+
+	t.Run("MinInterval", func(t *testing.T) {
+		b, _, p := setup(t, mqtt.StatePublisherOptions{MinInterval: time.Millisecond * 100})
+		p.Start()
+
+		for _, payload := range []string{"1", "2", "3"} {
+			require.NoError(t, p.Set("test/sensor/motion/get", payload))
+		}
+
+		b.RequirePublishedSequence(t, "test/sensor/motion/get", "1")
+		require.Eventually(t, func() bool {
+			return len(b.PublishedTo("test/sensor/motion/get")) == 2
+		}, time.Second, time.Millisecond*10)
+		b.RequirePublishedSequence(t, "test/sensor/motion/get", "1", "3")
+	})
+
+	t.Run("RefreshInterval", func(t *testing.T) {
+		b, _, p := setup(t, mqtt.StatePublisherOptions{RefreshInterval: time.Millisecond * 20})
+		p.Start()
+
+		require.NoError(t, p.Set("test/switch/state/get", "1"))
+		require.Eventually(t, func() bool {
+			return len(b.PublishedTo("test/switch/state/get")) >= 3
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("StaleAfter", func(t *testing.T) {
+		b, _, p := setup(t, mqtt.StatePublisherOptions{Retained: true, StaleAfter: time.Millisecond * 50})
+		p.Start()
+
+		require.NoError(t, p.Set("test/switch/state/get", "1"))
+		require.Eventually(t, func() bool {
+			_, ok := b.Retained("test/switch/state/get")
+			return !ok
+		}, time.Second, time.Millisecond*10)
+
+		b, _, p = setup(t, mqtt.StatePublisherOptions{StaleAfter: time.Millisecond * 50, StalePayload: "unknown"})
+		p.Start()
+
+		require.NoError(t, p.Set("test/switch/state/get", "1"))
+		b.WaitForPublished(t, "test/switch/state/get", "unknown", time.Second)
+	})
+}
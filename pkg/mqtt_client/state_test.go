@@ -0,0 +1,30 @@
+package mqtt_client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffOptions(t *testing.T) {
+	t.Run("ExponentialWithCap", func(t *testing.T) {
+		o := BackoffOptions{Initial: time.Second, Max: time.Second * 5, Multiplier: 2}
+
+		require.Equal(t, time.Second, o.getDelay(1))
+		require.Equal(t, time.Second*2, o.getDelay(2))
+		require.Equal(t, time.Second*4, o.getDelay(3))
+		require.Equal(t, time.Second*5, o.getDelay(4))
+		require.Equal(t, time.Second*5, o.getDelay(100))
+	})
+
+	t.Run("Jitter", func(t *testing.T) {
+		o := BackoffOptions{Initial: time.Second, Max: time.Second * 30, Multiplier: 2, Jitter: 0.5}
+
+		for i := 0; i < 100; i++ {
+			delay := o.getDelay(2)
+			require.GreaterOrEqual(t, int64(delay), int64(time.Second))
+			require.LessOrEqual(t, int64(delay), int64(time.Second*3))
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package mqtt_client
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// TopicMatches implements MQTT topic filter matching (including + and # wildcards and the rule that wildcards at
+// the first level don't match topics starting with $); shared subscriptions are matched against their inner filter
+func TopicMatches(filter string, topic string) bool {
+	_, sharedFilter, ok := ParseSharedSubscription(filter)
+	if ok {
+		filter = sharedFilter
+	}
+
+	if filter == topic {
+		return true
+	}
+
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+
+	if strings.HasPrefix(topic, "$") && (filterParts[0] == "+" || filterParts[0] == "#") {
+		return false
+	}
+
+	for i, filterPart := range filterParts {
+		if filterPart == "#" {
+			// # must be last and also matches the parent level (e.g. a/# matches a)
+			return i == len(filterParts)-1
+		}
+
+		if i >= len(topicParts) {
+			return false
+		}
+
+		if filterPart == "+" {
+			continue
+		}
+
+		if filterPart != topicParts[i] {
+			return false
+		}
+	}
+
+	return len(filterParts) == len(topicParts)
+}
+
+func IsTopicFilter(topic string) bool {
+	return strings.ContainsAny(topic, "+#")
+}
+
+// ValidatePublishTopic catches the topics a broker will never accept a publish to (no matter how often it's retried)
+func ValidatePublishTopic(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic empty")
+	}
+
+	if len(topic) > 65535 {
+		return fmt.Errorf("topic %v bytes long; can't be more than 65535", len(topic))
+	}
+
+	if IsTopicFilter(topic) {
+		return fmt.Errorf("topic %#+v has wildcards", topic)
+	}
+
+	if !utf8.ValidString(topic) || strings.ContainsRune(topic, 0) {
+		return fmt.Errorf("topic %#+v not valid UTF-8 (or has a NUL)", topic)
+	}
+
+	return nil
+}
+
+const sharedSubscriptionPrefix = "$share/"
+
+// SharedSubscription returns the filter for an MQTT 5 shared subscription; the broker hands each message matching
+// filter to only one of the subscribers in group
+func SharedSubscription(group string, filter string) string {
+	return sharedSubscriptionPrefix + group + "/" + filter
+}
+
+// ParseSharedSubscription splits a shared subscription (e.g. "$share/some-group/home/#") into its group and filter
+func ParseSharedSubscription(topic string) (group string, filter string, ok bool) {
+	if !strings.HasPrefix(topic, sharedSubscriptionPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(topic, sharedSubscriptionPrefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func IsSharedSubscription(topic string) bool {
+	_, _, ok := ParseSharedSubscription(topic)
+
+	return ok
+}
@@ -0,0 +1,60 @@
+package mqtt_client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopicMatches(t *testing.T) {
+	for _, tc := range []struct {
+		filter  string
+		topic   string
+		matches bool
+	}{
+		{"home/inside/heater/state/get", "home/inside/heater/state/get", true},
+		{"home/inside/heater/state/get", "home/inside/heater/state/set", false},
+		{"home/#", "home/inside/heater/state/get", true},
+		{"home/#", "home", true},
+		{"#", "home/inside", true},
+		{"+/+/#", "home/inside", true},
+		{"+/+/#", "home", false},
+		{"home/inside/+/get", "home/inside/heater/get", true},
+		{"home/inside/+/get", "home/inside/heater/state/get", false},
+		{"home/+", "home/inside/heater", false},
+		{"home/+", "home/", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"home/#/get", "home/inside/get", false},
+		{"$share/http/+/+/#", "home/inside/heater/state/get", true},
+		{"$share/http/home/outside/#", "home/inside/heater/state/get", false},
+		{"$share/http/#", "$SYS/broker/uptime", false},
+	} {
+		require.Equal(t, tc.matches, TopicMatches(tc.filter, tc.topic), "%#+v vs %#+v", tc.filter, tc.topic)
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	topic := SharedSubscription("http", "+/+/#")
+	require.Equal(t, "$share/http/+/+/#", topic)
+	require.True(t, IsSharedSubscription(topic))
+
+	group, filter, ok := ParseSharedSubscription(topic)
+	require.True(t, ok)
+	require.Equal(t, "http", group)
+	require.Equal(t, "+/+/#", filter)
+
+	for _, notShared := range []string{"home/inside/#", "$share/http", "$share//home/#", "$SYS/broker/uptime"} {
+		require.False(t, IsSharedSubscription(notShared), notShared)
+	}
+}
+
+func TestValidatePublishTopic(t *testing.T) {
+	require.NoError(t, ValidatePublishTopic("home/inside/heater/state/get"))
+
+	for _, topic := range []string{"", "home/#", "home/+/state", "home/\x00", "home/\xff", strings.Repeat("a", 65536)} {
+		require.Error(t, ValidatePublishTopic(topic), topic)
+	}
+}
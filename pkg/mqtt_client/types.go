@@ -8,11 +8,41 @@ const (
 	ExactlyOnce = byte(2)
 )
 
+// OriginUserProperty is the MQTT 5 user property that carries the ID of whatever originally published a message
+const OriginUserProperty = "origin"
+
 type Message struct {
-	Received  time.Time
-	Topic     string
-	MessageID uint16
-	Payload   string
+	Received   time.Time
+	Topic      string
+	MessageID  uint16
+	QoS        byte
+	Retained   bool // true for a retained message replayed on subscribe (vs a live update)
+	Duplicate  bool
+	Payload    string
+	RawPayload []byte
+	Properties *Properties // only set by providers that speak MQTT 5
+	Origin     string      // only set by providers that know who published the message (e.g. Glue's endpoint ID)
+}
+
+type Properties struct {
+	ResponseTopic   string
+	CorrelationData []byte
+	ContentType     string
+	UserProperties  map[string]string
+	MessageExpiry   time.Duration // whole seconds on the wire; 0 means the message doesn't expire
+}
+
+// GetOrigin is Origin if the provider set it, otherwise the OriginUserProperty (if there is one)
+func (m *Message) GetOrigin() string {
+	if m.Origin != "" {
+		return m.Origin
+	}
+
+	if m.Properties == nil {
+		return ""
+	}
+
+	return m.Properties.UserProperties[OriginUserProperty]
 }
 
 func (m *Message) MostlyEqual(other *Message) bool {
@@ -17,3 +17,14 @@ func getClientID(provider string) string {
 
 	return fmt.Sprintf("%v_%v", provider, identifier)
 }
+
+func getPayloadBytes(payload interface{}) []byte {
+	switch v := payload.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return []byte(fmt.Sprintf("%v", payload))
+	}
+}
@@ -5,10 +5,17 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 
 	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
 )
 
+// Leadership is satisfied by (e.g.) *leader_election.Elector
+type Leadership interface {
+	IsLeader() bool
+	Token() uint64 // fencing token; 0 unless leading
+}
+
 type Client struct {
 	mu *sync.Mutex
 
@@ -19,7 +26,10 @@ type Client struct {
 	host        string
 	codes       string
 	sendIR      func(string, []byte) error
-	publish     func(topic string, qos byte, retained bool, payload interface{}, quiet ...bool) error
+
+	statePublisher *mqtt.StatePublisher
+
+	leadership Leadership // nil means always the leader
 }
 
 func NewClient(
@@ -35,7 +45,11 @@ func NewClient(
 		host:        host,
 		codes:       codes,
 		sendIR:      sendIR,
-		publish:     publish,
+		statePublisher: mqtt.NewStatePublisher(mqtt.PublishFunc(publish), mqtt.StatePublisherOptions{
+			QoS:             mqtt.ExactlyOnce,
+			Retained:        true,
+			RefreshInterval: time.Minute,
+		}),
 	}
 
 	// model sets device state
@@ -57,12 +71,42 @@ func NewClient(
 	return &c
 }
 
+// SetLeadership makes the client only send IR and publish state while leadership says it's the leader (standbys just
+// keep their models up to date); it must be called before the client is subscribed to anything
+func (c *Client) SetLeadership(leadership Leadership) {
+	c.leadership = leadership
+}
+
+// getToken returns our fencing token and whether or not we're the leader
+func (c *Client) getToken() (uint64, bool) {
+	if c.leadership == nil {
+		return 0, true
+	}
+
+	token := c.leadership.Token()
+
+	return token, token != 0 && c.leadership.IsLeader()
+}
+
+// isStillLeader is whether or not we're still the leader that token was taken as
+func (c *Client) isStillLeader(token uint64) bool {
+	currentToken, leading := c.getToken()
+
+	return leading && currentToken == token
+}
+
 func (c *Client) setState(on bool, mode string, temperature int64) error {
 	var code []byte
 	var err error
 
 	log.Printf("setState(on=%#+v, mode=%#+v, temperature=%#+v)", on, mode, temperature)
 
+	token, leading := c.getToken()
+	if !leading {
+		log.Printf("not the leader; not sending IR to %v", c.host)
+		return nil
+	}
+
 	if !c.router.IsGetCallbacks() {
 		if on && !c.model.on || ((mode == "cool" || mode == "heat") && mode != c.model.mode) {
 			code, err = GetCode(c.codes, on, "fan_only", temperature)
@@ -82,6 +126,10 @@ func (c *Client) setState(on bool, mode string, temperature int64) error {
 		return fmt.Errorf("cannot call setState(%#+v, %#+v, %#+v) because: %v", on, mode, temperature, err)
 	}
 
+	if !c.isStillLeader(token) {
+		return fmt.Errorf("cannot call setState(%#+v, %#+v, %#+v) because leadership (token %v) was lost", on, mode, temperature, token)
+	}
+
 	err = c.sendIR(c.host, code)
 	if err != nil {
 		return fmt.Errorf("cannot call setState(%#+v, %#+v, %#+v) because: %v", on, mode, temperature, err)
@@ -101,13 +149,22 @@ func (c *Client) DisableRestoreMode() {
 }
 
 func (c *Client) Handle(message mqtt.Message) {
+	token, _ := c.getToken()
+
 	outgoingMessage, ok := c.router.Handle(message)
 	if !ok {
 		return
 	}
 
+	// the leader publishes state for everyone; if we've been deposed since this came in, the new leader has it covered
+	if !c.isStillLeader(token) {
+		log.Printf("not the leader; not publishing %#+v", outgoingMessage)
+		return
+	}
+
+	// by way of the state publisher so that Update doesn't publish it all over again
 	c.mu.Lock()
-	err := c.publish(outgoingMessage.Topic, mqtt.ExactlyOnce, true, outgoingMessage.Payload)
+	err := c.statePublisher.Set(outgoingMessage.Topic, outgoingMessage.Payload)
 	c.mu.Unlock()
 
 	if err != nil {
@@ -119,6 +176,11 @@ func (c *Client) Update() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	_, leading := c.getToken()
+	if !leading {
+		return nil
+	}
+
 	rawOn, mode, temperature := c.model.GetState()
 
 	on := "OFF"
@@ -144,9 +206,9 @@ func (c *Client) Update() error {
 	}
 
 	for _, outgoingMessage := range outgoingMessages {
-		err := c.publish(outgoingMessage.Topic, mqtt.ExactlyOnce, true, outgoingMessage.Payload, true)
+		err := c.statePublisher.Set(outgoingMessage.Topic, outgoingMessage.Payload)
 		if err != nil {
-			return fmt.Errorf("failed to publish %#+v because: %v", outgoingMessage, err)
+			return err
 		}
 	}
 
@@ -0,0 +1,168 @@
+package smart_aircons_client
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+)
+
+type fakeLeadership struct {
+	mu    sync.Mutex
+	token uint64
+}
+
+func (l *fakeLeadership) IsLeader() bool {
+	return l.Token() != 0
+}
+
+func (l *fakeLeadership) Token() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.token
+}
+
+func (l *fakeLeadership) setToken(token uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.token = token
+}
+
+func TestClient(t *testing.T) {
+	setup := func(t *testing.T) (*mqtttest.Broker, *Client, func() [][]byte) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+
+		mu := sync.Mutex{}
+		sentCodes := make([][]byte, 0)
+
+		client := NewClient(
+			"test/smart-aircons/living-room",
+			"some-host",
+			"new_fujitsu",
+			func(host string, code []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				require.Equal(t, "some-host", host)
+				sentCodes = append(sentCodes, code)
+
+				return nil
+			},
+			c.Publish,
+		)
+
+		require.NoError(t, c.Subscribe("test/smart-aircons/living-room/#", mqtt.ExactlyOnce, client.Handle))
+
+		return b, client, func() [][]byte {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return append([][]byte{}, sentCodes...)
+		}
+	}
+
+	t.Run("HandleSet", func(t *testing.T) {
+		b, client, getSentCodes := setup(t)
+
+		b.Inject("test/smart-aircons/living-room/mode/set", mqtt.ExactlyOnce, false, "cool")
+
+		coolCode, err := GetCode("new_fujitsu", true, "cool", defaultTemperature)
+		require.NoError(t, err)
+		fanOnlyCode, err := GetCode("new_fujitsu", true, "fan_only", defaultTemperature)
+		require.NoError(t, err)
+
+		// turning on into cool goes via fan_only first
+		require.Equal(t, [][]byte{fanOnlyCode, coolCode}, getSentCodes())
+		b.RequireRetained(t, "test/smart-aircons/living-room/mode/get", "cool")
+
+		// the echo went by way of the state publisher, so the next update has nothing new to say about the mode
+		require.NoError(t, client.Update())
+		b.RequirePublishedSequence(t, "test/smart-aircons/living-room/mode/get", "cool")
+	})
+
+	t.Run("HandleInvalidSet", func(t *testing.T) {
+		b, _, getSentCodes := setup(t)
+
+		b.Inject("test/smart-aircons/living-room/temperature/set", mqtt.ExactlyOnce, false, "99")
+
+		require.Empty(t, getSentCodes())
+		// the router echoes whatever it was given, even if the handler refused it
+		b.RequirePublished(t, "test/smart-aircons/living-room/temperature/get", "99")
+	})
+
+	t.Run("HandleGetIgnoredOutsideRestoreMode", func(t *testing.T) {
+		b, _, getSentCodes := setup(t)
+
+		b.Inject("test/smart-aircons/living-room/power/get", mqtt.ExactlyOnce, true, "ON")
+
+		require.Empty(t, getSentCodes())
+	})
+
+	t.Run("OnlySendsAndPublishesWhileLeader", func(t *testing.T) {
+		b, client, getSentCodes := setup(t)
+
+		leadership := &fakeLeadership{}
+		client.SetLeadership(leadership)
+
+		// a standby keeps its model up to date but leaves the IR and the state to the leader
+		b.Inject("test/smart-aircons/living-room/mode/set", mqtt.ExactlyOnce, false, "cool")
+		require.Empty(t, getSentCodes())
+		require.Empty(t, b.PublishedTo("test/smart-aircons/living-room/mode/get"))
+		require.NoError(t, client.Update())
+		require.Empty(t, b.PublishedTo("test/smart-aircons/living-room/+/get"))
+
+		_, mode, _ := client.model.GetState()
+		require.Equal(t, "cool", mode)
+
+		leadership.setToken(1)
+		b.Inject("test/smart-aircons/living-room/temperature/set", mqtt.ExactlyOnce, false, "20")
+		require.Len(t, getSentCodes(), 1)
+		b.RequireRetained(t, "test/smart-aircons/living-room/temperature/get", "20")
+	})
+
+	t.Run("RestoreModeHonoursRetainedGets", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+		c := b.NewClient(nil)
+		require.NoError(t, c.Connect())
+		require.NoError(t, c.Publish("test/smart-aircons/living-room/temperature/get", mqtt.ExactlyOnce, true, "20.0"))
+
+		sentCodes := make([][]byte, 0)
+		client := NewClient(
+			"test/smart-aircons/living-room",
+			"some-host",
+			"new_fujitsu",
+			func(host string, code []byte) error {
+				sentCodes = append(sentCodes, code)
+				return nil
+			},
+			c.Publish,
+		)
+
+		client.EnableRestoreMode()
+		require.NoError(t, c.Subscribe("test/smart-aircons/living-room/#", mqtt.ExactlyOnce, client.Handle))
+		client.DisableRestoreMode()
+
+		on, mode, temperature := client.model.GetState()
+		require.True(t, on)
+		require.Equal(t, defaultMode, mode)
+		require.Equal(t, int64(20), temperature)
+
+		// no fan_only preamble while restoring
+		require.Len(t, sentCodes, 1)
+
+		require.NoError(t, client.Update())
+		b.RequireRetained(t, "test/smart-aircons/living-room/power/get", "ON")
+		b.RequireRetained(t, "test/smart-aircons/living-room/temperature/get", "20")
+
+		// nothing has changed, so nothing more goes out
+		require.NoError(t, client.Update())
+		b.RequirePublishedSequence(t, "test/smart-aircons/living-room/power/get", "ON")
+	})
+}
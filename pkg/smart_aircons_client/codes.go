@@ -3,6 +3,7 @@ package smart_aircons_client
 import (
 	"fmt"
 	"log"
+	"sort"
 )
 
 var allCodes = map[string]map[string][]byte{}
@@ -40,3 +41,19 @@ func GetCode(name string, on bool, mode string, temperature int64) ([]byte, erro
 
 	return code, nil
 }
+
+func GetCodeNames(name string) ([]string, error) {
+	codes, ok := allCodes[name]
+	if !ok {
+		return nil, fmt.Errorf("%#+v not a recognized name", name)
+	}
+
+	codeNames := make([]string, 0, len(codes))
+	for codeName := range codes {
+		codeNames = append(codeNames, codeName)
+	}
+
+	sort.Strings(codeNames)
+
+	return codeNames, nil
+}
@@ -5,6 +5,8 @@ import (
 	"math"
 	"strconv"
 	"strings"
+
+	"github.com/initialed85/mqtt_things/pkg/mqtt_action_router"
 )
 
 func OnToPayload(on bool) (string, error) {
@@ -15,15 +17,14 @@ func OnToPayload(on bool) (string, error) {
 	}
 }
 
+// PayloadToOn accepts any of the action router's payload dialects (e.g. "ON", "1", "true" or {"state":"ON"})
 func PayloadToOn(payload string) (bool, error) {
-	payload = strings.ToUpper(strings.TrimSpace(payload))
-	if payload == "ON" {
-		return true, nil
-	} else if payload == "OFF" {
-		return false, nil
+	state, err := mqtt_action_router.PayloadFormat{Accept: mqtt_action_router.GetDialects(), Output: mqtt_action_router.OnOff}.Parse(payload)
+	if err != nil {
+		return false, err
 	}
 
-	return false, fmt.Errorf("%#+v not one of %#+v or %#+v", payload, "ON", "OFF")
+	return state == mqtt_action_router.On, nil
 }
 
 func ModeToPayload(mode string) (string, error) {
@@ -0,0 +1,29 @@
+package smart_aircons_client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloads(t *testing.T) {
+	t.Run("PayloadToOn", func(t *testing.T) {
+		for payload, expected := range map[string]bool{
+			"ON":               true,
+			"off":              false,
+			"1":                true,
+			"false":            false,
+			`{"state": "ON"}`:  true,
+			`{"state": false}`: false,
+		} {
+			on, err := PayloadToOn(payload)
+			require.NoError(t, err, "%#+v", payload)
+			require.Equal(t, expected, on, "%#+v", payload)
+		}
+
+		for _, payload := range []string{"", "2", "maybe", `{"power":"ON"}`} {
+			_, err := PayloadToOn(payload)
+			require.Error(t, err, "%#+v", payload)
+		}
+	})
+}
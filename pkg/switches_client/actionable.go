@@ -25,3 +25,18 @@ func (a *Actionable) Off(arguments interface{}) error {
 
 	return s.Off()
 }
+
+// Read is for mqtt_action_router.Router.Reconcile
+func (a *Actionable) Read(arguments interface{}) (interface{}, error) {
+	s, err := a.Client.GetSwitch(arguments.(Arguments).Name)
+	if err != nil {
+		return Unknown, err
+	}
+
+	err = s.Update()
+	if err != nil {
+		return Unknown, err
+	}
+
+	return s.State, nil
+}
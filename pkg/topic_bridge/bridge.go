@@ -0,0 +1,326 @@
+package topic_bridge
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+// echoExpiry is how long we wait for something we published to come back to us on a side that can't tell us who
+// published it
+const echoExpiry = time.Second * 10
+
+// Side is one end of a Bridge
+type Side struct {
+	Name   string
+	Client mqtt.Client
+
+	// OriginID is what Client sets Message.Origin to for our own publishes (e.g. GlueClient.EndpointID), if anything
+	OriginID string
+}
+
+type echoKey struct {
+	topic   string
+	payload string
+}
+
+type echo struct {
+	count   int
+	expires time.Time
+}
+
+type side struct {
+	Side
+	mu          sync.Mutex
+	echoByKey   map[echoKey]*echo
+	lastExpired time.Time
+}
+
+// canCarryOrigin is true if we'll be able to recognise our own publishes when they come back to us
+func (s *side) canCarryOrigin() bool {
+	if s.OriginID != "" {
+		return true
+	}
+
+	propertiesClient, ok := s.Client.(mqtt.PropertiesClient)
+
+	return ok && propertiesClient.SupportsProperties()
+}
+
+func (s *side) expireEchoes(now time.Time) {
+	if now.Sub(s.lastExpired) < echoExpiry {
+		return
+	}
+
+	for key, echo := range s.echoByKey {
+		if now.After(echo.expires) {
+			delete(s.echoByKey, key)
+		}
+	}
+
+	s.lastExpired = now
+}
+
+func (s *side) addEcho(topic string, payload string) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireEchoes(now)
+
+	key := echoKey{topic, payload}
+
+	possibleEcho, ok := s.echoByKey[key]
+	if !ok {
+		possibleEcho = &echo{}
+		s.echoByKey[key] = possibleEcho
+	}
+
+	possibleEcho.count++
+	possibleEcho.expires = now.Add(echoExpiry)
+}
+
+func (s *side) consumeEcho(topic string, payload string) bool {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireEchoes(now)
+
+	key := echoKey{topic, payload}
+
+	possibleEcho, ok := s.echoByKey[key]
+	if !ok || now.After(possibleEcho.expires) {
+		return false
+	}
+
+	possibleEcho.count--
+	if possibleEcho.count <= 0 {
+		delete(s.echoByKey, key)
+	}
+
+	return true
+}
+
+type direction struct {
+	name            string
+	bridgeID        string
+	from            *side
+	to              *side
+	route           *Route
+	mu              sync.Mutex
+	snapshotByTopic map[string]mqtt.Message
+}
+
+func (d *direction) isOwn(message mqtt.Message) bool {
+	origin := message.GetOrigin()
+	if origin != "" && (origin == d.bridgeID || origin == d.from.OriginID) {
+		return true
+	}
+
+	return !d.from.canCarryOrigin() && d.from.consumeEcho(message.Topic, message.Payload)
+}
+
+// updateSnapshot keeps the latest value of every topic we've seen a retained message for
+func (d *direction) updateSnapshot(message mqtt.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.snapshotByTopic[message.Topic]
+	if !message.Retained && !ok {
+		return
+	}
+
+	if len(message.RawPayload) == 0 && message.Payload == "" {
+		delete(d.snapshotByTopic, message.Topic)
+		return
+	}
+
+	message.Retained = true
+	d.snapshotByTopic[message.Topic] = message
+}
+
+func (d *direction) getCallback(filter string) func(message mqtt.Message) {
+	return func(message mqtt.Message) {
+		// overlapping include filters would otherwise see the same message more than once
+		for _, possibleFilter := range d.route.Include() {
+			if mqtt.TopicMatches(possibleFilter, message.Topic) {
+				if possibleFilter != filter {
+					return
+				}
+
+				break
+			}
+		}
+
+		if d.isOwn(message) || !d.route.Matches(message.Topic) {
+			return
+		}
+
+		d.updateSnapshot(message)
+
+		err := d.forward(message)
+		if err != nil {
+			log.Printf("warning: %v failed to forward %v because: %v", d.name, message.Topic, err)
+		}
+	}
+}
+
+func (d *direction) forward(message mqtt.Message) error {
+	topic := d.route.Rewrite(message.Topic)
+
+	err := d.route.Wait(topic)
+	if err != nil {
+		return err
+	}
+
+	qos := d.route.QoS(message.QoS)
+	retained := d.route.Retain(message.Retained)
+
+	var payload interface{} = message.Payload
+	if message.RawPayload != nil {
+		payload = message.RawPayload
+	}
+
+	propertiesClient, ok := d.to.Client.(mqtt.PropertiesClient)
+	if ok && propertiesClient.SupportsProperties() {
+		properties := mqtt.Properties{}
+		if message.Properties != nil {
+			properties = *message.Properties
+		}
+
+		userProperties := make(map[string]string)
+		for key, value := range properties.UserProperties {
+			userProperties[key] = value
+		}
+
+		userProperties[mqtt.OriginUserProperty] = d.bridgeID
+		properties.UserProperties = userProperties
+
+		return propertiesClient.PublishWithProperties(topic, qos, retained, payload, properties, true)
+	}
+
+	if !d.to.canCarryOrigin() {
+		d.to.addEcho(topic, message.Payload)
+	}
+
+	return d.to.Client.Publish(topic, qos, retained, payload, true)
+}
+
+func (d *direction) resync() int {
+	d.mu.Lock()
+	messages := make([]mqtt.Message, 0, len(d.snapshotByTopic))
+	for _, message := range d.snapshotByTopic {
+		messages = append(messages, message)
+	}
+	d.mu.Unlock()
+
+	for _, message := range messages {
+		err := d.forward(message)
+		if err != nil {
+			log.Printf("warning: %v failed to resync %v because: %v", d.name, message.Topic, err)
+		}
+	}
+
+	return len(messages)
+}
+
+// Bridge forwards messages between two clients (in both directions, each with its own Route); a message the bridge
+// itself published is recognised by its origin (see Side.OriginID and mqtt.OriginUserProperty) or, failing that, by
+// it coming back soon after with the same topic and payload
+type Bridge struct {
+	id         string
+	directions []*direction
+}
+
+// New returns a Bridge between a and b; aToB or bToA can be nil for a one-way bridge
+func New(id string, a Side, b Side, aToB *Route, bToA *Route) (*Bridge, error) {
+	if id == "" {
+		return nil, fmt.Errorf("bridge ID can't be empty")
+	}
+
+	if a.Name == b.Name {
+		return nil, fmt.Errorf("both sides called %#+v", a.Name)
+	}
+
+	sideA := &side{Side: a, echoByKey: make(map[echoKey]*echo)}
+	sideB := &side{Side: b, echoByKey: make(map[echoKey]*echo)}
+
+	bridge := &Bridge{
+		id:         id,
+		directions: make([]*direction, 0, 2),
+	}
+
+	for _, possibleDirection := range []*direction{
+		{from: sideA, to: sideB, route: aToB},
+		{from: sideB, to: sideA, route: bToA},
+	} {
+		if possibleDirection.route == nil {
+			continue
+		}
+
+		// without Retained there's no snapshot to resync from, and a keep rule would quietly drop the retain flag
+		if !mqtt.ReportsRetained(possibleDirection.from.Client) {
+			return nil, fmt.Errorf("%v can't tell retained messages from live ones (%T); use a client that can", possibleDirection.from.Name, possibleDirection.from.Client)
+		}
+
+		possibleDirection.name = fmt.Sprintf("%v_to_%v", possibleDirection.from.Name, possibleDirection.to.Name)
+		possibleDirection.bridgeID = id
+		possibleDirection.snapshotByTopic = make(map[string]mqtt.Message)
+
+		bridge.directions = append(bridge.directions, possibleDirection)
+	}
+
+	return bridge, nil
+}
+
+// Start subscribes to the include filters of each direction (so both clients must be connected)
+func (b *Bridge) Start() error {
+	for _, d := range b.directions {
+		for _, filter := range d.route.Include() {
+			err := d.from.Client.Subscribe(filter, mqtt.ExactlyOnce, d.getCallback(filter))
+			if err != nil {
+				return fmt.Errorf("%v failed to subscribe to %v because: %v", d.name, filter, err)
+			}
+		}
+
+		log.Printf("%v forwarding %v", d.name, d.route.Include())
+	}
+
+	return nil
+}
+
+func (b *Bridge) Stop() error {
+	var lastErr error
+
+	for _, d := range b.directions {
+		for _, filter := range d.route.Include() {
+			err := d.from.Client.Unsubscribe(filter)
+			if err != nil {
+				lastErr = fmt.Errorf("%v failed to unsubscribe from %v because: %v", d.name, filter, err)
+				log.Printf("warning: %v", lastErr)
+			}
+		}
+	}
+
+	return lastErr
+}
+
+// Resync republishes (as retained) the latest value of every retained topic that's been forwarded to the side
+// called to; it's for when something on that side has turned up late (e.g. a new Glue peer) or lost its state
+func (b *Bridge) Resync(to string) {
+	for _, d := range b.directions {
+		if d.to.Name != to {
+			continue
+		}
+
+		count := d.resync()
+
+		log.Printf("%v resynced %v retained topics", d.name, count)
+	}
+}
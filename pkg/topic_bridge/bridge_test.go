@@ -0,0 +1,269 @@
+package topic_bridge_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/mqtt_client/mqtttest"
+	"github.com/initialed85/mqtt_things/pkg/topic_bridge"
+)
+
+func getConnectedClient(t *testing.T, b *mqtttest.Broker) *mqtttest.Client {
+	c := b.NewClient(nil)
+	require.NoError(t, c.Connect())
+
+	return c
+}
+
+func getRoute(t *testing.T, rule topic_bridge.Rule) *topic_bridge.Route {
+	route, err := topic_bridge.NewRoute(rule)
+	require.NoError(t, err)
+
+	return route
+}
+
+func TestBridge(t *testing.T) {
+	t.Run("IncludeExcludeRewrite", func(t *testing.T) {
+		brokerA, brokerB := mqtttest.NewBroker(), mqtttest.NewBroker()
+		userA := getConnectedClient(t, brokerA)
+
+		qos := mqtt.AtLeastOnce
+
+		bridge, err := topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: getConnectedClient(t, brokerA)},
+			topic_bridge.Side{Name: "b", Client: getConnectedClient(t, brokerB)},
+			getRoute(t, topic_bridge.Rule{
+				Include: []string{"home/#", "home/inside/#"},
+				Exclude: []string{"home/secret/#"},
+				Rewrite: []topic_bridge.Rewrite{{From: "home/inside", To: "site-a/inside"}, {From: "home", To: "site-a"}},
+				Retain:  topic_bridge.RetainAlways,
+				QoS:     &qos,
+			}),
+			nil,
+		)
+		require.NoError(t, err)
+		require.NoError(t, bridge.Start())
+
+		require.NoError(t, userA.Publish("home/inside/lights/get", mqtt.ExactlyOnce, false, "1"))
+		require.NoError(t, userA.Publish("home/outside/lights/get", mqtt.ExactlyOnce, false, "0"))
+		require.NoError(t, userA.Publish("home/secret/code/get", mqtt.ExactlyOnce, false, "1234"))
+		require.NoError(t, userA.Publish("other/lights/get", mqtt.ExactlyOnce, false, "1"))
+
+		// once, in spite of the overlapping include filters
+		brokerB.RequirePublishedSequence(t, "site-a/inside/lights/get", "1")
+		brokerB.RequirePublishedSequence(t, "site-a/outside/lights/get", "0")
+		brokerB.RequireNotPublished(t, "+/secret/#")
+		brokerB.RequireNotPublished(t, "other/#")
+
+		publishedMessage, ok := brokerB.LastPublishedTo("site-a/inside/lights/get")
+		require.True(t, ok)
+		require.Equal(t, mqtt.AtLeastOnce, publishedMessage.QoS)
+		require.True(t, publishedMessage.Retained)
+
+		require.NoError(t, bridge.Stop())
+		require.NoError(t, userA.Publish("home/inside/lights/get", mqtt.ExactlyOnce, false, "0"))
+		brokerB.RequirePublishedSequence(t, "site-a/inside/lights/get", "1")
+	})
+
+	t.Run("LoopPreventionWithoutProperties", func(t *testing.T) {
+		brokerA, brokerB := mqtttest.NewBroker(), mqtttest.NewBroker()
+		userA, userB := getConnectedClient(t, brokerA), getConnectedClient(t, brokerB)
+
+		rule := topic_bridge.Rule{Include: []string{"home/#"}}
+
+		bridge, err := topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: getConnectedClient(t, brokerA)},
+			topic_bridge.Side{Name: "b", Client: getConnectedClient(t, brokerB)},
+			getRoute(t, rule),
+			getRoute(t, rule),
+		)
+		require.NoError(t, err)
+		require.NoError(t, bridge.Start())
+
+		require.NoError(t, userA.Publish("home/lights/set", mqtt.ExactlyOnce, false, "1"))
+		brokerA.RequirePublishedSequence(t, "home/#", "1")
+		brokerB.RequirePublishedSequence(t, "home/#", "1")
+
+		// the same thing coming from the other side is a different message
+		require.NoError(t, userB.Publish("home/lights/set", mqtt.ExactlyOnce, false, "1"))
+		brokerA.RequirePublishedSequence(t, "home/#", "1", "1")
+		brokerB.RequirePublishedSequence(t, "home/#", "1", "1")
+	})
+
+	t.Run("LoopPreventionWithProperties", func(t *testing.T) {
+		brokerA, brokerB := mqtttest.NewBroker(), mqtttest.NewBroker()
+		userA := getConnectedClient(t, brokerA)
+
+		bridgeA, bridgeB := getConnectedClient(t, brokerA), getConnectedClient(t, brokerB)
+		bridgeA.EnableProperties()
+		bridgeB.EnableProperties()
+
+		rule := topic_bridge.Rule{Include: []string{"home/#"}}
+
+		bridge, err := topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: bridgeA},
+			topic_bridge.Side{Name: "b", Client: bridgeB},
+			getRoute(t, rule),
+			getRoute(t, rule),
+		)
+		require.NoError(t, err)
+		require.NoError(t, bridge.Start())
+
+		require.NoError(t, userA.Publish("home/lights/set", mqtt.ExactlyOnce, false, "1"))
+		brokerA.RequirePublishedSequence(t, "home/#", "1")
+		brokerB.RequirePublishedSequence(t, "home/#", "1")
+
+		publishedMessage, ok := brokerB.LastPublishedTo("home/lights/set")
+		require.True(t, ok)
+		require.Equal(t, "some-bridge", publishedMessage.Properties.UserProperties[mqtt.OriginUserProperty])
+	})
+
+	t.Run("LoopPreventionWithOriginID", func(t *testing.T) {
+		brokerA, brokerB := mqtttest.NewBroker(), mqtttest.NewBroker()
+		userA := getConnectedClient(t, brokerA)
+		userA.EnableProperties()
+
+		bridgeA := getConnectedClient(t, brokerA)
+		bridgeA.EnableProperties()
+
+		bridge, err := topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: bridgeA, OriginID: "some-endpoint"},
+			topic_bridge.Side{Name: "b", Client: getConnectedClient(t, brokerB)},
+			getRoute(t, topic_bridge.Rule{Include: []string{"home/#"}}),
+			nil,
+		)
+		require.NoError(t, err)
+		require.NoError(t, bridge.Start())
+
+		require.NoError(t, userA.PublishWithProperties("home/a/set", mqtt.ExactlyOnce, false, "1", mqtt.Properties{
+			UserProperties: map[string]string{mqtt.OriginUserProperty: "some-endpoint"},
+		}))
+		require.NoError(t, userA.PublishWithProperties("home/b/set", mqtt.ExactlyOnce, false, "1", mqtt.Properties{
+			UserProperties: map[string]string{mqtt.OriginUserProperty: "some-other-endpoint"},
+		}))
+
+		brokerB.RequireNotPublished(t, "home/a/set")
+		brokerB.RequirePublishedSequence(t, "home/b/set", "1")
+	})
+
+	t.Run("SnapshotAndResync", func(t *testing.T) {
+		brokerA, brokerB := mqtttest.NewBroker(), mqtttest.NewBroker()
+		userA := getConnectedClient(t, brokerA)
+
+		require.NoError(t, userA.Publish("home/a/get", mqtt.ExactlyOnce, true, "1"))
+		require.NoError(t, userA.Publish("home/b/get", mqtt.ExactlyOnce, true, "1"))
+
+		bridge, err := topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: getConnectedClient(t, brokerA)},
+			topic_bridge.Side{Name: "b", Client: getConnectedClient(t, brokerB)},
+			getRoute(t, topic_bridge.Rule{Include: []string{"home/#"}}),
+			nil,
+		)
+		require.NoError(t, err)
+		require.NoError(t, bridge.Start())
+
+		brokerB.RequireRetained(t, "home/a/get", "1")
+		brokerB.RequireRetained(t, "home/b/get", "1")
+
+		// a live update to a retained topic is kept, an empty payload forgets it and anything else isn't kept
+		require.NoError(t, userA.Publish("home/a/get", mqtt.ExactlyOnce, true, "0"))
+		require.NoError(t, userA.Publish("home/b/get", mqtt.ExactlyOnce, true, ""))
+		require.NoError(t, userA.Publish("home/c/get", mqtt.ExactlyOnce, false, "1"))
+
+		brokerB.ClearPublished()
+		bridge.Resync("a")
+		brokerB.RequireNotPublished(t, "#")
+
+		bridge.Resync("b")
+		brokerB.RequireNotPublished(t, "home/b/get")
+		brokerB.RequireNotPublished(t, "home/c/get")
+		brokerB.RequirePublishedSequence(t, "home/a/get", "0")
+
+		publishedMessage, ok := brokerB.LastPublishedTo("home/a/get")
+		require.True(t, ok)
+		require.True(t, publishedMessage.Retained)
+	})
+
+	t.Run("RejectsClientsThatDontReportRetained", func(t *testing.T) {
+		brokerA, brokerB := mqtttest.NewBroker(), mqtttest.NewBroker()
+		userA := getConnectedClient(t, brokerA)
+		require.NoError(t, userA.Publish("home/a/get", mqtt.ExactlyOnce, true, "1"))
+
+		// like GMQ, this one hands over retained messages as if they were live (so there'd never be a snapshot)
+		gmqLikeClient := getConnectedClient(t, brokerA)
+		gmqLikeClient.DisableRetained()
+
+		var received mqtt.Message
+		require.NoError(t, gmqLikeClient.Subscribe("home/a/get", mqtt.ExactlyOnce, func(message mqtt.Message) {
+			received = message
+		}))
+		require.Equal(t, "1", received.Payload)
+		require.False(t, received.Retained)
+
+		persistentClient := mqtt.NewPersistentClient()
+		persistentClient.SetClient(gmqLikeClient)
+
+		_, err := topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: persistentClient},
+			topic_bridge.Side{Name: "b", Client: getConnectedClient(t, brokerB)},
+			getRoute(t, topic_bridge.Rule{Include: []string{"home/#"}}),
+			nil,
+		)
+		require.Error(t, err)
+
+		// it's fine on the receiving end
+		_, err = topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: persistentClient},
+			topic_bridge.Side{Name: "b", Client: getConnectedClient(t, brokerB)},
+			nil,
+			getRoute(t, topic_bridge.Rule{Include: []string{"home/#"}}),
+		)
+		require.NoError(t, err)
+	})
+
+	t.Run("RateLimitDrop", func(t *testing.T) {
+		brokerA, brokerB := mqtttest.NewBroker(), mqtttest.NewBroker()
+		userA := getConnectedClient(t, brokerA)
+
+		bridge, err := topic_bridge.New(
+			"some-bridge",
+			topic_bridge.Side{Name: "a", Client: getConnectedClient(t, brokerA)},
+			topic_bridge.Side{Name: "b", Client: getConnectedClient(t, brokerB)},
+			getRoute(t, topic_bridge.Rule{
+				Include:           []string{"home/#"},
+				RateLimitByPrefix: map[string]string{"home/noisy": "0.001:1"},
+				RateLimitPolicy:   "drop",
+			}),
+			nil,
+		)
+		require.NoError(t, err)
+		require.NoError(t, bridge.Start())
+
+		for _, payload := range []string{"1", "2", "3"} {
+			require.NoError(t, userA.Publish("home/noisy/get", mqtt.ExactlyOnce, false, payload))
+			require.NoError(t, userA.Publish("home/quiet/get", mqtt.ExactlyOnce, false, payload))
+		}
+
+		brokerB.RequirePublishedSequence(t, "home/noisy/get", "1")
+		brokerB.RequirePublishedSequence(t, "home/quiet/get", "1", "2", "3")
+	})
+
+	t.Run("New", func(t *testing.T) {
+		b := mqtttest.NewBroker()
+
+		_, err := topic_bridge.New("", topic_bridge.Side{Name: "a", Client: b.NewClient(nil)}, topic_bridge.Side{Name: "b", Client: b.NewClient(nil)}, nil, nil)
+		require.Error(t, err)
+
+		_, err = topic_bridge.New("some-bridge", topic_bridge.Side{Name: "a", Client: b.NewClient(nil)}, topic_bridge.Side{Name: "a", Client: b.NewClient(nil)}, nil, nil)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,226 @@
+package topic_bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+)
+
+const (
+	RetainKeep   = "keep" // as received (Glue never has retained messages)
+	RetainAlways = "always"
+	RetainNever  = "never"
+)
+
+// Rewrite replaces the leading levels From with To (e.g. "home/inside" -> "site-b/inside")
+type Rewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Rule is one direction's worth of a rule file; a topic is forwarded if it matches one of Include and none of
+// Exclude, then the first matching Rewrite is applied to it
+type Rule struct {
+	Include           []string          `json:"include"`
+	Exclude           []string          `json:"exclude,omitempty"`
+	Rewrite           []Rewrite         `json:"rewrite,omitempty"`
+	Retain            string            `json:"retain,omitempty"` // RetainKeep (the default), RetainAlways or RetainNever
+	QoS               *byte             `json:"qos,omitempty"`    // nil means as received
+	RateLimit         string            `json:"rate_limit,omitempty"`
+	RateLimitByPrefix map[string]string `json:"rate_limit_by_prefix,omitempty"`
+	RateLimitPolicy   string            `json:"rate_limit_policy,omitempty"`
+}
+
+// LoadRules reads a JSON object of direction name (which must be one of directions) to Rule from path
+func LoadRules(path string, directions ...string) (map[string]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule file %#+v because: %v", path, err)
+	}
+
+	ruleByDirection := make(map[string]Rule)
+
+	err = json.Unmarshal(data, &ruleByDirection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rule file %#+v because: %v", path, err)
+	}
+
+	for direction, rule := range ruleByDirection {
+		known := false
+		for _, possibleDirection := range directions {
+			if direction == possibleDirection {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return nil, fmt.Errorf("unknown direction %#+v in rule file %#+v; expected one of %v", direction, path, strings.Join(directions, ", "))
+		}
+
+		_, err = NewRoute(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule for %v in rule file %#+v because: %v", direction, path, err)
+		}
+	}
+
+	return ruleByDirection, nil
+}
+
+// Route is a Rule that's been checked and is ready to use
+type Route struct {
+	rule        Rule
+	rateLimiter *mqtt.RateLimiter
+}
+
+func checkFilter(filter string) error {
+	if strings.TrimSpace(filter) == "" {
+		return fmt.Errorf("empty filter")
+	}
+
+	if mqtt.IsSharedSubscription(filter) {
+		return fmt.Errorf("filter %#+v can't be a shared subscription", filter)
+	}
+
+	return nil
+}
+
+func NewRoute(rule Rule) (*Route, error) {
+	if len(rule.Include) == 0 {
+		return nil, fmt.Errorf("no include filters")
+	}
+
+	for _, filter := range append(append([]string{}, rule.Include...), rule.Exclude...) {
+		err := checkFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rule.Rewrite = append([]Rewrite{}, rule.Rewrite...)
+	for i, rewrite := range rule.Rewrite {
+		rewrite.From = strings.Trim(rewrite.From, "/")
+		rewrite.To = strings.Trim(rewrite.To, "/")
+
+		if rewrite.From == "" || mqtt.IsTopicFilter(rewrite.From) || mqtt.IsTopicFilter(rewrite.To) {
+			return nil, fmt.Errorf("rewrite %+v must be from a non-empty prefix to a prefix, without wildcards", rule.Rewrite[i])
+		}
+
+		rule.Rewrite[i] = rewrite
+	}
+
+	switch rule.Retain {
+	case "":
+		rule.Retain = RetainKeep
+	case RetainKeep, RetainAlways, RetainNever:
+	default:
+		return nil, fmt.Errorf("retain %#+v not one of %#+v, %#+v or %#+v", rule.Retain, RetainKeep, RetainAlways, RetainNever)
+	}
+
+	if rule.QoS != nil && *rule.QoS > mqtt.ExactlyOnce {
+		return nil, fmt.Errorf("qos %v not 0, 1 or 2", *rule.QoS)
+	}
+
+	route := &Route{
+		rule: rule,
+	}
+
+	rateLimitOptions := mqtt.RateLimitOptions{
+		ByPrefix: make(map[string]mqtt.RateLimit),
+	}
+
+	var err error
+
+	if rule.RateLimit != "" {
+		rateLimitOptions.Global, err = mqtt.ParseRateLimit(rule.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for prefix, rawRateLimit := range rule.RateLimitByPrefix {
+		rateLimitOptions.ByPrefix[prefix], err = mqtt.ParseRateLimit(rawRateLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rateLimitOptions.Policy, err = mqtt.ParseRateLimitPolicy(rule.RateLimitPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if rateLimitOptions.IsEnabled() {
+		route.rateLimiter, err = mqtt.NewRateLimiter(rateLimitOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return route, nil
+}
+
+func (r *Route) Include() []string {
+	return r.rule.Include
+}
+
+func (r *Route) Matches(topic string) bool {
+	for _, filter := range r.rule.Exclude {
+		if mqtt.TopicMatches(filter, topic) {
+			return false
+		}
+	}
+
+	for _, filter := range r.rule.Include {
+		if mqtt.TopicMatches(filter, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Route) Rewrite(topic string) string {
+	for _, rewrite := range r.rule.Rewrite {
+		if topic == rewrite.From {
+			return rewrite.To
+		}
+
+		if strings.HasPrefix(topic, rewrite.From+"/") {
+			return strings.Trim(rewrite.To+"/"+strings.TrimPrefix(topic, rewrite.From+"/"), "/")
+		}
+	}
+
+	return topic
+}
+
+func (r *Route) QoS(received byte) byte {
+	if r.rule.QoS == nil {
+		return received
+	}
+
+	return *r.rule.QoS
+}
+
+func (r *Route) Retain(received bool) bool {
+	switch r.rule.Retain {
+	case RetainAlways:
+		return true
+	case RetainNever:
+		return false
+	default:
+		return received
+	}
+}
+
+// Wait applies the rate limit (if there is one) to topic (after it's been rewritten)
+func (r *Route) Wait(topic string) error {
+	if r.rateLimiter == nil {
+		return nil
+	}
+
+	return r.rateLimiter.Wait(topic)
+}
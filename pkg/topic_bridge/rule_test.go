@@ -0,0 +1,67 @@
+package topic_bridge_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/initialed85/mqtt_things/pkg/mqtt_client"
+	"github.com/initialed85/mqtt_things/pkg/topic_bridge"
+)
+
+func TestRules(t *testing.T) {
+	t.Run("NewRoute", func(t *testing.T) {
+		qos := byte(3)
+
+		for _, rule := range []topic_bridge.Rule{
+			{},
+			{Include: []string{""}},
+			{Include: []string{"$share/some-group/home/#"}},
+			{Include: []string{"home/#"}, Rewrite: []topic_bridge.Rewrite{{From: "home/+", To: "site-a"}}},
+			{Include: []string{"home/#"}, Rewrite: []topic_bridge.Rewrite{{From: "", To: "site-a"}}},
+			{Include: []string{"home/#"}, Retain: "sometimes"},
+			{Include: []string{"home/#"}, QoS: &qos},
+			{Include: []string{"home/#"}, RateLimit: "fast"},
+			{Include: []string{"home/#"}, RateLimitPolicy: "panic"},
+		} {
+			_, err := topic_bridge.NewRoute(rule)
+			require.Error(t, err, "%+v", rule)
+		}
+
+		route := getRoute(t, topic_bridge.Rule{
+			Include: []string{"home/#"},
+			Rewrite: []topic_bridge.Rewrite{{From: "/home/", To: ""}},
+		})
+		require.Equal(t, "lights/get", route.Rewrite("home/lights/get"))
+		require.Equal(t, "homely/lights/get", route.Rewrite("homely/lights/get"))
+		require.Equal(t, mqtt.AtLeastOnce, route.QoS(mqtt.AtLeastOnce))
+		require.True(t, route.Retain(true))
+	})
+
+	t.Run("LoadRules", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rules.json")
+
+		require.NoError(t, os.WriteFile(path, []byte(`{
+			"a_to_b": {"include": ["home/#"], "exclude": ["home/secret/#"], "qos": 1},
+			"b_to_a": {"include": ["home/+/set"], "retain": "never"}
+		}`), 0644))
+
+		ruleByDirection, err := topic_bridge.LoadRules(path, "a_to_b", "b_to_a")
+		require.NoError(t, err)
+		require.Len(t, ruleByDirection, 2)
+		require.Equal(t, []string{"home/secret/#"}, ruleByDirection["a_to_b"].Exclude)
+		require.Equal(t, topic_bridge.RetainNever, ruleByDirection["b_to_a"].Retain)
+
+		_, err = topic_bridge.LoadRules(path, "a_to_b")
+		require.Error(t, err)
+
+		require.NoError(t, os.WriteFile(path, []byte(`{"a_to_b": {"include": []}}`), 0644))
+		_, err = topic_bridge.LoadRules(path, "a_to_b")
+		require.Error(t, err)
+
+		_, err = topic_bridge.LoadRules(filepath.Join(t.TempDir(), "missing.json"), "a_to_b")
+		require.Error(t, err)
+	})
+}
@@ -56,21 +56,21 @@ query: windspeedmph = "1.3"
 */
 
 type Weather struct {
-	Timestamp         time.Time // UTC
-	StationID         string    // as given to Weather Underground
-	Latitude          float64   // injected, doesn't come from weather station
-	Longitude         float64   // injected, doesn't come from weather station
-	Temperature       float64   // deg C
-	DewPoint          float64   // deg C
-	Humidity          float64   // %
-	WindSpeed         float64   // m/s instantaneous
-	WindDirection     float64   // deg
-	WindGust          float64   // m/s max over a vendor-determined period
-	AirPressure       float64   // hPa
-	RainLast60Mins    float64   // mm last 60 minutes
-	RainToday         float64   // mm since 00:00 local time
-	TemperatureIndoor float64   // deg C
-	HumidityIndoor    float64   // %
+	Timestamp         time.Time `json:"timestamp"`          // UTC
+	StationID         string    `json:"station_id"`         // as given to Weather Underground
+	Latitude          float64   `json:"latitude"`           // injected, doesn't come from weather station
+	Longitude         float64   `json:"longitude"`          // injected, doesn't come from weather station
+	Temperature       float64   `json:"temperature"`        // deg C
+	DewPoint          float64   `json:"dew_point"`          // deg C
+	Humidity          float64   `json:"humidity"`           // %
+	WindSpeed         float64   `json:"wind_speed"`         // m/s instantaneous
+	WindDirection     float64   `json:"wind_direction"`     // deg
+	WindGust          float64   `json:"wind_gust"`          // m/s max over a vendor-determined period
+	AirPressure       float64   `json:"air_pressure"`       // hPa
+	RainLast60Mins    float64   `json:"rain_last_60_mins"`  // mm last 60 minutes
+	RainToday         float64   `json:"rain_today"`         // mm since 00:00 local time
+	TemperatureIndoor float64   `json:"temperature_indoor"` // deg C
+	HumidityIndoor    float64   `json:"humidity_indoor"`    // %
 }
 
 func Run(